@@ -0,0 +1,275 @@
+package admin
+
+/**
+ * 管理端口：/healthz 存活检查，/readyz 就绪检查，/metrics 指标，按配置开启 /debug/pprof/
+ * tcp 和 websocket 服务器本身没有 http 服务，单独监听一个只对内网开放的地址
+ * 配置了操作人时再挂上 HandleAPI 注册的运维接口，请求要带 Authorization: Bearer <token>
+ */
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"gameserver/ipfilter"
+	"gameserver/metrics"
+	"gameserver/tcp/restart"
+	"gameserver/tcp/sync/atomic"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config 管理端口配置
+type Config struct {
+	Address    string   `yaml:"address"`     // 监听地址，为空时不开启，不要暴露到公网
+	Pprof      bool     `yaml:"pprof"`       // 是否开启 /debug/pprof/
+	PprofAllow []string `yaml:"pprof-allow"` // 允许访问 pprof 的网段，为空时只允许本机
+
+	Operators map[string]string `yaml:"operators"` // 运维接口的操作人 -> token，为空时不开启运维接口
+	Console   string            `yaml:"console"`   // GM 控制台的 telnet 监听地址，用同样的操作人 token 登录，为空时不开启
+}
+
+// 每个就绪检查最多等这么久，连不上的数据库不能把 /readyz 卡住
+const checkTimeout = 2 * time.Second
+
+// 没有配置 pprof-allow 时只允许本机
+var defaultPprofAllow = []string{"127.0.0.0/8", "::1"}
+
+var (
+	// ErrDraining 正在关闭或者平滑重启，不再接收新玩家
+	ErrDraining = errors.New("正在排空连接")
+	// ErrNotListening 监听还没有准备好或者已经关闭
+	ErrNotListening = errors.New("没有在监听")
+	// ErrTimeout 检查超时
+	ErrTimeout = errors.New("检查超时")
+)
+
+// 请求上下文里保存操作人的 key
+type operatorKey struct{}
+
+type api struct {
+	pattern string
+	handler http.Handler
+}
+
+type check struct {
+	name string
+	f    func() error
+}
+
+var (
+	mu        sync.RWMutex
+	checks    []check
+	apis      []api
+	listeners = make(map[string]bool) // 监听名字 -> 是否在监听
+	draining  atomic.Boolean
+)
+
+// AddCheck 添加一个就绪检查，返回错误时 /readyz 返回 503
+func AddCheck(name string, f func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check{name: name, f: f})
+}
+
+// HandleAPI 注册需要认证的运维接口，必须在 Handler 或者 ListenAndServe 之前调用
+func HandleAPI(pattern string, h http.Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	apis = append(apis, api{pattern: pattern, handler: h})
+}
+
+// Operator 运维接口里取当前请求的操作人
+func Operator(r *http.Request) string {
+	name, _ := r.Context().Value(operatorKey{}).(string)
+	return name
+}
+
+// SetListening 标记监听是否可用，开始监听后设为 true，关闭后设为 false
+func SetListening(name string, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	listeners[name] = ok
+}
+
+// SetDraining 开始关闭或者平滑重启时调用，之后 /readyz 一直返回 503，负载均衡不再转发新连接
+func SetDraining() {
+	draining.Set(true)
+}
+
+// Handler 管理端口的所有接口，登录服务器这类已经有 http 服务的可以直接挂上去
+func Handler(cfg Config) (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.Handle("/metrics", metrics.Handler())
+	if cfg.Pprof {
+		allow := cfg.PprofAllow
+		if len(allow) == 0 {
+			allow = defaultPprofAllow
+		}
+		nets, err := ipfilter.ParseNets(allow)
+		if err != nil {
+			return nil, err
+		}
+		gate := func(h http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				// pprof 能拿到内存里的数据，只看直连地址，不信任任何转发头
+				if !nets.ContainsAddr(r.RemoteAddr) {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				h(w, r)
+			}
+		}
+		mux.HandleFunc("/debug/pprof/", gate(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", gate(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", gate(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", gate(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", gate(pprof.Trace))
+	}
+	mu.RLock()
+	list := append([]api(nil), apis...)
+	mu.RUnlock()
+	if len(list) > 0 && len(cfg.Operators) == 0 {
+		slog.Warn("没有配置操作人，运维接口不开启")
+	}
+	if len(cfg.Operators) > 0 {
+		for _, a := range list {
+			mux.Handle(a.pattern, authenticate(cfg.Operators, a.handler))
+		}
+	}
+	return mux, nil
+}
+
+// authenticate 按 token 找到操作人，放进请求上下文
+func authenticate(operators map[string]string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := FindOperator(operators, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if name == "" {
+			slog.Warn("运维接口认证失败", "path", r.URL.Path, "addr", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), operatorKey{}, name)))
+	})
+}
+
+// FindOperator 按 token 找操作人，找不到时返回空字符串，GM 控制台也用它认证
+func FindOperator(operators map[string]string, token string) string {
+	name := ""
+	for n, t := range operators {
+		// 所有 token 都比一遍，耗时和猜中第几个无关
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			name = n
+		}
+	}
+	return name
+}
+
+// ListenAndServe 监听管理端口，一般用 go 启动，出错时已经记了日志
+// 平滑重启时新进程接管旧进程的监听，旧进程排空期间端口还被占着，不能自己重新监听
+func ListenAndServe(cfg Config) error {
+	h, err := Handler(cfg)
+	if err != nil {
+		slog.Error("管理端口配置错误", "err", err)
+		return err
+	}
+	ln, err := restart.Listen("admin", cfg.Address)
+	if err != nil {
+		slog.Error("管理端口监听失败", "addr", cfg.Address, "err", err)
+		return err
+	}
+	slog.Info("管理端口开始监听", "addr", ln.Addr().String(), "pprof", cfg.Pprof, "operators", len(cfg.Operators))
+	if err := http.Serve(ln, h); err != nil {
+		slog.Error("管理端口退出", "err", err)
+		return err
+	}
+	return nil
+}
+
+// healthz 进程还活着就返回 200
+func healthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readyz 所有检查都通过时返回 200，不然返回 503 和每一项的结果
+func readyz(w http.ResponseWriter, r *http.Request) {
+	results := Ready()
+	ready := true
+	for _, v := range results {
+		if v != "ok" {
+			ready = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}{ready, results})
+}
+
+// Ready 执行所有就绪检查，返回每一项的结果，通过的是 "ok"
+func Ready() map[string]string {
+	mu.RLock()
+	list := append([]check(nil), checks...)
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		if !listeners[name] {
+			err = ErrNotListening
+		}
+		list = append(list, check{name: "listener:" + name, f: func() error { return err }})
+	}
+	mu.RUnlock()
+	list = append(list, check{name: "draining", f: func() error {
+		if draining.Get() {
+			return ErrDraining
+		}
+		return nil
+	}})
+
+	results := make(map[string]string, len(list))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range list {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+			err := run(c.f)
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			if err != nil {
+				results[c.name] = err.Error()
+			} else {
+				results[c.name] = "ok"
+			}
+		}(c)
+	}
+	wg.Wait()
+	return results
+}
+
+// run 执行一个检查，超时按失败处理，检查本身留在后台跑完
+func run(f func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(checkTimeout):
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,37 @@
+package game
+
+import (
+	"context"
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/session"
+)
+
+// refuseInactive 封禁、停封、待注销的账号不能登录
+// 用校验 token 时读到的账号，不再查一次；没有带过来时拒绝，不能放过没检查状态的账号
+func refuseInactive(ctx context.Context, s session.Session, accid int64) *protocol.Packet {
+	a, ok := model.AccountFrom(ctx)
+	if !ok || int64(a.Accid) != accid {
+		session.Log(s).Error("登录时没有带上账号信息", "login_accid", accid)
+		return protocol.NewErrorPacket(protocol.ERR_AUTH, "account error")
+	}
+	status := a.CurrentStatus()
+	if status == model.AccountActive {
+		return nil
+	}
+	session.Log(s).Info("账号不可用，拒绝登录", "login_accid", accid, "status", status, "until", a.Status_until)
+	return AccountStatusPacket(status, a.Status_reason, a.Status_until)
+}
+
+// AccountStatusPacket 账号不可用时发给客户端的错误包，正常状态返回 nil
+func AccountStatusPacket(status string, reason string, until int64) *protocol.Packet {
+	switch status {
+	case model.AccountSuspended:
+		return protocol.NewBannedPacket(reason, until)
+	case model.AccountBanned:
+		return protocol.NewBannedPacket(reason, 0)
+	case model.AccountPendingDeletion:
+		return protocol.NewErrorPacket(protocol.ERR_DELETING, reason)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package game
+
+/**
+ * 游戏命令处理，只依赖 session.Session，不关心玩家是从哪种连接进来的
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"gameserver/metrics"
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/ratelimit"
+	"gameserver/session"
+)
+
+// Rooms 本进程的所有房间
+var Rooms = NewRoomManager()
+
+// Register 把游戏命令注册到路由上
+func Register(r *session.Router) {
+	r.HandlePublic(protocol.LOGIN_AUTH, func(ctx context.Context, s session.Session, p *protocol.Packet) {
+		loginAuth(ctx, r, s, p)
+	})
+	r.FilterLogin(refuseLogin)
+	r.FilterLogin(refuseInactive)
+	r.Handle(protocol.ROOM_JOIN, roomJoin)
+	r.Handle(protocol.ROOM_LEAVE, roomLeave)
+	r.Handle(protocol.ROOM_SYNC, roomSync)
+	// 默认的命令限速，可以在配置文件里覆盖
+	r.Limit(protocol.LOGIN_AUTH, ratelimit.Rule{Rate: 1, Burst: 3})
+	r.Limit(protocol.ROOM_JOIN, ratelimit.Rule{Rate: 2, Burst: 5})
+	r.Limit(protocol.ROOM_LEAVE, ratelimit.Rule{Rate: 2, Burst: 5})
+	r.Limit(protocol.ROOM_SYNC, ratelimit.Rule{Rate: 30, Burst: 60})
+	r.OnClose(func(s session.Session) {
+		if room := Rooms.Leave(s); room != nil {
+			notifyRoom(room)
+		}
+	})
+}
+
+// NewRouter 创建注册好游戏命令的路由
+func NewRouter() *session.Router {
+	r := session.NewRouter()
+	Register(r)
+	return r
+}
+
+// LoginAuthBody LOGIN_AUTH 的消息体，token 是 http 登录时拿到的
+type LoginAuthBody struct {
+	Account string `json:"account"`
+	Token   string `json:"token"`
+}
+
+// loginAuth 登录验证，校验 http 登录时写入 redis 的 token，并把账号绑定到会话上
+func loginAuth(ctx context.Context, r *session.Router, s session.Session, p *protocol.Packet) {
+	var body LoginAuthBody
+	if err := json.Unmarshal(p.Body, &body); err != nil {
+		session.LogPacket(s, p).Warn("LOGIN_AUTH 消息体错误", "err", err)
+		metrics.Login(s.Transport(), protocol.ERR_AUTH)
+		reject(s, p, protocol.ERR_AUTH, "bad login body")
+		return
+	}
+	accinfo, err := model.VerifyToken(ctx, body.Account, body.Token)
+	if err != nil {
+		session.LogPacket(s, p).Warn("auth认证失败", "account", body.Account, "err", err)
+		metrics.Login(s.Transport(), protocol.ERR_AUTH)
+		reject(s, p, protocol.ERR_AUTH, "token error")
+		return
+	}
+	session.SetToken(s, body.Token)
+	if e := r.Login(model.WithAccount(ctx, accinfo), s, int64(accinfo.Accid)); e != nil {
+		e.Seq = p.Seq
+		_ = s.Send(e)
+		_ = s.Close()
+		return
+	}
+	session.LogPacket(s, p).Info("auth检查通过")
+	_ = s.Send(&protocol.Packet{Cmd: protocol.LOGIN_AUTH, Accid: int64(accinfo.Accid), Seq: p.Seq})
+}
+
+// reject 回复错误并断开
+func reject(s session.Session, p *protocol.Packet, code uint32, msg string) {
+	e := protocol.NewErrorPacket(code, msg)
+	e.Seq = p.Seq
+	_ = s.Send(e)
+	_ = s.Close()
+}
+
+// roomJoin 加入房间，子命令是房间ID，0 表示新建
+func roomJoin(ctx context.Context, s session.Session, p *protocol.Packet) {
+	// 维护期间不再开新局，已经在进行的对局可以打完
+	if m := Maintenance(); m != nil {
+		e := protocol.NewMaintenancePacket(protocol.MaintenanceRefuse, m.Reason, m.Shutdown, m.Until)
+		e.Seq = p.Seq
+		_ = s.Send(e)
+		return
+	}
+	room, err := Rooms.Join(s, p.SubCmd)
+	if err != nil {
+		e := protocol.NewErrorPacket(protocol.ERR_ROOM, err.Error())
+		e.Seq = p.Seq
+		_ = s.Send(e)
+		return
+	}
+	_ = s.Send(&protocol.Packet{Cmd: protocol.ROOM_JOIN, SubCmd: room.ID, Accid: s.Accid(), Seq: p.Seq})
+	notifyRoom(room)
+}
+
+// roomLeave 离开房间
+func roomLeave(ctx context.Context, s session.Session, p *protocol.Packet) {
+	if room := Rooms.Leave(s); room != nil {
+		_ = s.Send(&protocol.Packet{Cmd: protocol.ROOM_LEAVE, SubCmd: room.ID, Accid: s.Accid(), Seq: p.Seq})
+		notifyRoom(room)
+	}
+}
+
+// roomSync 把玩家的操作转发给同房间的其他玩家
+func roomSync(ctx context.Context, s session.Session, p *protocol.Packet) {
+	room := RoomOf(s)
+	if room == nil {
+		return
+	}
+	room.Broadcast(&protocol.Packet{Cmd: protocol.ROOM_SYNC, SubCmd: p.SubCmd, Accid: s.Accid(), Body: p.Body}, s.ID())
+}
+
+// notifyRoom 通知房间内所有人当前成员
+func notifyRoom(room *Room) {
+	body, _ := json.Marshal(room.Info())
+	room.Broadcast(&protocol.Packet{Cmd: protocol.ROOM_STATE, SubCmd: room.ID, Body: body}, 0)
+}
@@ -0,0 +1,150 @@
+package game
+
+/**
+ * 停服维护：定时读取 redis 里的维护状态
+ * 发布维护后马上拒绝新登录和开新局，给在线玩家倒计时；到停服时间后断开不在房间里的玩家，
+ * 房间里的对局打完（或者等太久）之后关闭服务器
+ * 停服时间之后才启动的进程（发新版本或者平滑重启）不会停服，维护结束前只拒绝登录
+ */
+
+import (
+	"context"
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/session"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 会话属性里标记已经通知过断开的 key
+const attrKicked = "maintenance_kicked"
+
+const (
+	// 多久从 redis 读一次维护状态
+	maintenanceRefresh = 5 * time.Second
+	// 到停服时间后，最多等对局多久
+	matchWaitTimeout = 30 * time.Minute
+)
+
+// 倒计时通知的时间点，从大到小
+var countdownMarks = []time.Duration{
+	30 * time.Minute, 15 * time.Minute, 10 * time.Minute, 5 * time.Minute,
+	3 * time.Minute, 2 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second,
+}
+
+var (
+	maintenanceMu sync.RWMutex
+	maintenance   *model.Maintenance // 当前的维护状态，nil 表示正常
+)
+
+// Maintenance 当前的维护状态，没有维护时返回 nil
+func Maintenance() *model.Maintenance {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	return maintenance
+}
+
+// refuseLogin 维护期间拒绝所有新登录
+func refuseLogin(ctx context.Context, s session.Session, accid int64) *protocol.Packet {
+	m := Maintenance()
+	if m == nil {
+		return nil
+	}
+	session.Log(s).Info("维护中，拒绝登录", "login_accid", accid)
+	return protocol.NewMaintenancePacket(protocol.MaintenanceRefuse, m.Reason, m.Shutdown, m.Until)
+}
+
+// WatchMaintenance 按维护状态倒计时和停服，对局都结束后调用 shutdown 关闭服务器，一般用 go 启动
+func WatchMaintenance(r *session.Router, shutdown func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	started := time.Now()
+	mark := 0 // 下一个要通知的倒计时点
+	var lastRefresh time.Time
+	var skipped time.Time // 已经记过日志的、启动前就过了的停服时间
+	for now := range ticker.C {
+		if now.Sub(lastRefresh) >= maintenanceRefresh {
+			lastRefresh = now
+			old, m, ok := refreshMaintenance()
+			if ok {
+				switch {
+				case old != nil && m == nil && !now.Before(old.Until):
+					// 到了预计结束时间 key 自己过期，不是运维取消的，不发取消通知
+					slog.Info("维护已结束", "until", old.Until)
+				case old != nil && m == nil:
+					slog.Info("维护已取消")
+					r.Broadcast(protocol.NewMaintenancePacket(protocol.MaintenanceCancel, old.Reason, old.Shutdown, old.Until))
+				case m != nil && (old == nil || !old.Shutdown.Equal(m.Shutdown)):
+					slog.Info("收到维护通知", "reason", m.Reason, "shutdown", m.Shutdown, "until", m.Until)
+					// 马上通知一次，跳过已经过去的倒计时点
+					mark = 0
+					for mark < len(countdownMarks) && now.Add(countdownMarks[mark]).After(m.Shutdown) {
+						mark++
+					}
+					r.Broadcast(protocol.NewMaintenancePacket(protocol.MaintenanceCountdown, m.Reason, m.Shutdown, m.Until))
+				}
+			}
+		}
+
+		m := Maintenance()
+		if m == nil {
+			continue
+		}
+		if remain := m.Shutdown.Sub(now); remain > 0 {
+			announce := false
+			for mark < len(countdownMarks) && remain <= countdownMarks[mark] {
+				announce = true
+				mark++
+			}
+			if announce {
+				r.Broadcast(protocol.NewMaintenancePacket(protocol.MaintenanceCountdown, m.Reason, m.Shutdown, m.Until))
+			}
+			continue
+		}
+
+		// 停服时间之后才启动的进程是维护期间上线的，不停服，只拒绝登录
+		if !started.Before(m.Shutdown) {
+			if !skipped.Equal(m.Shutdown) {
+				skipped = m.Shutdown
+				slog.Info("进程在停服时间之后启动，维护结束前只拒绝登录", "shutdown", m.Shutdown, "until", m.Until)
+			}
+			continue
+		}
+
+		// 已经到停服时间，对局中的玩家打完再走
+		timeout := now.Sub(m.Shutdown) > matchWaitTimeout
+		kick := protocol.NewMaintenancePacket(protocol.MaintenanceKick, m.Reason, m.Shutdown, m.Until)
+		for _, s := range r.Online() {
+			if RoomOf(s) != nil && !timeout {
+				continue
+			}
+			if _, ok := s.Attributes().Get(attrKicked); ok {
+				continue
+			}
+			s.Attributes().Set(attrKicked, true)
+			cp := *kick
+			_ = s.Send(&cp)
+			_ = s.Close()
+		}
+		if len(Rooms.List()) == 0 || timeout {
+			slog.Info("对局都已结束，开始停服维护", "timeout", timeout)
+			shutdown()
+			return
+		}
+	}
+}
+
+// refreshMaintenance 从 redis 读取维护状态，读取失败时保持原来的状态
+func refreshMaintenance() (old *model.Maintenance, m *model.Maintenance, ok bool) {
+	m, err := model.GetMaintenance(context.Background())
+	if err != nil {
+		slog.Error("读取维护状态失败", "err", err)
+		return nil, nil, false
+	}
+	maintenanceMu.Lock()
+	old = maintenance
+	maintenance = m
+	maintenanceMu.Unlock()
+	return old, m, true
+}
@@ -0,0 +1,20 @@
+package game
+
+import (
+	"errors"
+	"gameserver/admin"
+	"gameserver/model"
+)
+
+// AddReadyChecks 游戏服务器的就绪检查：数据库、redis 和维护状态
+// 维护期间拒绝新登录，负载均衡不应该再把玩家转发过来
+func AddReadyChecks() {
+	admin.AddCheck("mysql", model.PingMySQL)
+	admin.AddCheck("redis", model.PingRedis)
+	admin.AddCheck("maintenance", func() error {
+		if m := Maintenance(); m != nil {
+			return errors.New("维护中: " + m.Reason)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+package game
+
+/**
+ * 房间，成员是 session.Session，所以 tcp、udp、websocket 的玩家可以在同一个房间里
+ */
+
+import (
+	"errors"
+	"gameserver/protocol"
+	"gameserver/session"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 会话属性里保存所在房间的 key
+const attrRoom = "room"
+
+// 每个房间默认的最大人数
+const DefaultRoomSize = 8
+
+var (
+	ErrRoomNotFound = errors.New("房间不存在")
+	ErrRoomFull     = errors.New("房间已满")
+)
+
+// Room 一局游戏
+type Room struct {
+	ID      uint32
+	Created time.Time
+	MaxSize int
+
+	mu      sync.RWMutex
+	members map[int64]session.Session // 会话ID -> 会话
+}
+
+// RoomInfo 房间信息，用于查询
+type RoomInfo struct {
+	ID      uint32    `json:"id"`
+	Created time.Time `json:"created"`
+	Members []Member  `json:"members"`
+}
+
+// Member 房间成员
+type Member struct {
+	Session   int64  `json:"session"`
+	Accid     int64  `json:"accid"`
+	Transport string `json:"transport"`
+}
+
+// Broadcast 发给房间内所有成员，except 为 0 时不排除任何人
+func (r *Room) Broadcast(p *protocol.Packet, except int64) {
+	r.mu.RLock()
+	members := make([]session.Session, 0, len(r.members))
+	for id, s := range r.members {
+		if id != except {
+			members = append(members, s)
+		}
+	}
+	r.mu.RUnlock()
+	for _, s := range members {
+		// 每个连接编码方式可能不一样，各发一份拷贝
+		cp := *p
+		_ = s.Send(&cp)
+	}
+}
+
+// Info 房间当前状态
+func (r *Room) Info() RoomInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	info := RoomInfo{ID: r.ID, Created: r.Created}
+	for _, s := range r.members {
+		info.Members = append(info.Members, Member{Session: s.ID(), Accid: s.Accid(), Transport: s.Transport()})
+	}
+	sort.Slice(info.Members, func(i, j int) bool { return info.Members[i].Session < info.Members[j].Session })
+	return info
+}
+
+// Len 成员数
+func (r *Room) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// RoomManager 管理一个进程内的所有房间
+type RoomManager struct {
+	mu     sync.Mutex
+	rooms  map[uint32]*Room
+	nextID uint32
+}
+
+// NewRoomManager 创建房间管理
+func NewRoomManager() *RoomManager {
+	return &RoomManager{rooms: make(map[uint32]*Room)}
+}
+
+// Join 加入房间，id 为 0 时新建一个房间，已经在其他房间时先离开
+func (m *RoomManager) Join(s session.Session, id uint32) (*Room, error) {
+	m.Leave(s)
+	m.mu.Lock()
+	var room *Room
+	if id == 0 {
+		m.nextID++
+		room = &Room{
+			ID:      m.nextID,
+			Created: time.Now(),
+			MaxSize: DefaultRoomSize,
+			members: make(map[int64]session.Session),
+		}
+		m.rooms[room.ID] = room
+	} else {
+		room = m.rooms[id]
+	}
+	if room == nil {
+		m.mu.Unlock()
+		return nil, ErrRoomNotFound
+	}
+	room.mu.Lock()
+	if len(room.members) >= room.MaxSize {
+		room.mu.Unlock()
+		m.mu.Unlock()
+		return nil, ErrRoomFull
+	}
+	room.members[s.ID()] = s
+	room.mu.Unlock()
+	m.mu.Unlock()
+
+	s.Attributes().Set(attrRoom, room)
+	return room, nil
+}
+
+// Leave 离开所在房间，房间空了就删除
+func (m *RoomManager) Leave(s session.Session) *Room {
+	v, ok := s.Attributes().Get(attrRoom)
+	if !ok {
+		return nil
+	}
+	s.Attributes().Delete(attrRoom)
+	room := v.(*Room)
+
+	m.mu.Lock()
+	room.mu.Lock()
+	delete(room.members, s.ID())
+	empty := len(room.members) == 0
+	room.mu.Unlock()
+	if empty {
+		delete(m.rooms, room.ID)
+	}
+	m.mu.Unlock()
+	return room
+}
+
+// Get 按ID查找房间
+func (m *RoomManager) Get(id uint32) *Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rooms[id]
+}
+
+// List 所有房间的状态
+func (m *RoomManager) List() []RoomInfo {
+	m.mu.Lock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	m.mu.Unlock()
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		infos = append(infos, r.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// RoomOf 会话所在的房间
+func RoomOf(s session.Session) *Room {
+	if v, ok := s.Attributes().Get(attrRoom); ok {
+		return v.(*Room)
+	}
+	return nil
+}
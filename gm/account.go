@@ -0,0 +1,103 @@
+package gm
+
+import (
+	"context"
+	"fmt"
+	"gameserver/game"
+	"gameserver/model"
+	"time"
+)
+
+// 查询账号时带上最近多少次状态修改
+const accountHistoryLimit = 20
+
+// AccountInfo 账号当前的状态和修改历史
+type AccountInfo struct {
+	Accid    int64                    `json:"accid"`
+	Account  string                   `json:"account"`
+	Status   string                   `json:"status"` // 停封到期后是 active
+	Reason   string                   `json:"reason,omitempty"`
+	Operator string                   `json:"operator,omitempty"`
+	Until    int64                    `json:"until,omitempty"` // 停封的解封时间，unix 秒
+	History  []model.AccountStatusLog `json:"history"`
+}
+
+// SuspendAccount 停封账号一段时间，到期自动恢复，在线的会话踢下线，返回本节点踢掉的数量
+func SuspendAccount(ctx context.Context, accid int64, d time.Duration, reason string, operator string) (int, error) {
+	if d <= 0 {
+		return 0, ErrBadDuration
+	}
+	return setAccountStatus(ctx, accid, model.AccountSuspended, time.Now().Add(d).Unix(), reason, operator)
+}
+
+// BanAccount 永久封禁账号，在线的会话踢下线，返回本节点踢掉的数量
+func BanAccount(ctx context.Context, accid int64, reason string, operator string) (int, error) {
+	return setAccountStatus(ctx, accid, model.AccountBanned, 0, reason, operator)
+}
+
+// DeleteAccount 标记账号待注销，在线的会话踢下线，返回本节点踢掉的数量
+// 只改状态不删数据，恢复之前不能登录
+func DeleteAccount(ctx context.Context, accid int64, reason string, operator string) (int, error) {
+	return setAccountStatus(ctx, accid, model.AccountPendingDeletion, 0, reason, operator)
+}
+
+// UnbanAccount 把账号恢复正常，解除封禁、停封，撤销待注销
+func UnbanAccount(ctx context.Context, accid int64, reason string, operator string) error {
+	_, err := setAccountStatus(ctx, accid, model.AccountActive, 0, reason, operator)
+	return err
+}
+
+// GetAccount 账号当前的状态和最近的修改历史
+func GetAccount(ctx context.Context, accid int64) (*AccountInfo, error) {
+	if accid <= 0 {
+		return nil, ErrBadAccid
+	}
+	a, err := model.GetAccountByAccid(ctx, accid)
+	if err != nil {
+		return nil, err
+	}
+	history, err := model.GetAccountStatusLog(ctx, accid, accountHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	info := &AccountInfo{
+		Accid:   accid,
+		Account: a.Account,
+		Status:  a.CurrentStatus(),
+		History: history,
+	}
+	if info.Status != model.AccountActive {
+		info.Reason = a.Status_reason
+		info.Operator = a.Status_operator
+		info.Until = a.Status_until
+	}
+	return info, nil
+}
+
+// setAccountStatus 修改账号状态，不能登录的状态把所有节点上的会话踢下线
+func setAccountStatus(ctx context.Context, accid int64, status string, until int64, reason string, operator string) (int, error) {
+	if accid <= 0 {
+		return 0, ErrBadAccid
+	}
+	detail := fmt.Sprintf("status=%s reason=%s", status, reason)
+	if until > 0 {
+		detail += " until=" + time.Unix(until, 0).Format("2006-01-02 15:04:05")
+	}
+	err := model.SetAccountStatus(ctx, model.AccountStatusLog{
+		Accid:    int(accid),
+		Status:   status,
+		Reason:   reason,
+		Operator: operator,
+		Until:    until,
+	})
+	if err != nil {
+		audit(ctx, operator, "account_status", accidTarget(accid), detail, err)
+		return 0, err
+	}
+	n := 0
+	if p := game.AccountStatusPacket(status, reason, until); p != nil {
+		n = kickAccount(ctx, accid, p.SubCmd, reason, until)
+	}
+	audit(ctx, operator, "account_status", accidTarget(accid), fmt.Sprintf("%s kicked=%d", detail, n), nil)
+	return n, nil
+}
@@ -0,0 +1,292 @@
+package gm
+
+/**
+ * 运维 HTTP 接口，挂在管理端口上，认证和操作人由 admin 负责
+ *
+ *	GET    /api/sessions                                  在线会话
+ *	POST   /api/kick          {"session":1} 或 {"accid":1, "reason":""}  踢下线
+ *	GET    /api/account?accid=1                           账号状态和最近的修改历史
+ *	POST   /api/ban/account   {"accid":1, "duration":"24h", "reason":""}  停封到期自动恢复，duration 为空时永久封禁，都会踢下线
+ *	POST   /api/unban/account {"accid":1, "reason":""}   恢复正常，也用来撤销待注销
+ *	POST   /api/delete/account {"accid":1, "reason":""}  标记待注销并踢下线
+ *	GET    /api/ban/ip                                    封禁中的 IP
+ *	POST   /api/ban/ip        {"ip":"1.2.3.4", "duration":"1h", "reason":""}
+ *	POST   /api/unban/ip      {"ip":"1.2.3.4"}
+ *	POST   /api/notice        {"text":"..."}              系统公告
+ *	GET    /api/maintenance                               维护状态
+ *	POST   /api/maintenance   {"after":"10m", "duration":"2h", "reason":""}
+ *	DELETE /api/maintenance                               取消维护
+ *	GET    /api/rooms                                     房间和成员
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"gameserver/admin"
+	"gameserver/model"
+	"gameserver/ratelimit"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 请求体的最大长度
+const maxRequestBody = 64 * 1024
+
+// request 所有接口共用的请求体，各接口只用到其中几项
+type request struct {
+	Session  int64  `json:"session"`
+	Accid    int64  `json:"accid"`
+	IP       string `json:"ip"`
+	Duration string `json:"duration"` // time.ParseDuration 的格式，比如 30m、24h
+	After    string `json:"after"`
+	Reason   string `json:"reason"`
+	Text     string `json:"text"`
+}
+
+// Handler 运维接口，用 admin.HandleAPI("/api/", gm.Handler()) 注册
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", only(http.MethodGet, sessionsHandler))
+	mux.HandleFunc("/api/kick", only(http.MethodPost, kickHandler))
+	mux.HandleFunc("/api/account", only(http.MethodGet, accountHandler))
+	mux.HandleFunc("/api/ban/account", only(http.MethodPost, banAccountHandler))
+	mux.HandleFunc("/api/unban/account", only(http.MethodPost, unbanAccountHandler))
+	mux.HandleFunc("/api/delete/account", only(http.MethodPost, deleteAccountHandler))
+	mux.HandleFunc("/api/ban/ip", banIPHandler)
+	mux.HandleFunc("/api/unban/ip", only(http.MethodPost, unbanIPHandler))
+	mux.HandleFunc("/api/notice", only(http.MethodPost, noticeHandler))
+	mux.HandleFunc("/api/maintenance", maintenanceHandler)
+	mux.HandleFunc("/api/rooms", only(http.MethodGet, roomsHandler))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(WithSource(r.Context(), SourceAPI, r.RemoteAddr)))
+	})
+}
+
+// only 限制请求方法
+func only(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Sessions())
+}
+
+func kickHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Session != 0 {
+		if err := Kick(r.Context(), req.Session, req.Reason, admin.Operator(r)); err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"kicked": 1})
+		return
+	}
+	n, err := KickAccount(r.Context(), req.Accid, req.Reason, admin.Operator(r))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+}
+
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	accid, err := strconv.ParseInt(r.URL.Query().Get("accid"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrBadAccid)
+		return
+	}
+	info, err := GetAccount(r.Context(), accid)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func banAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	var n int
+	var err error
+	if req.Duration == "" {
+		n, err = BanAccount(r.Context(), req.Accid, req.Reason, admin.Operator(r))
+	} else {
+		d, perr := time.ParseDuration(req.Duration)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, perr)
+			return
+		}
+		n, err = SuspendAccount(r.Context(), req.Accid, d, req.Reason, admin.Operator(r))
+	}
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+}
+
+func unbanAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := UnbanAccount(r.Context(), req.Accid, req.Reason, admin.Operator(r)); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	n, err := DeleteAccount(r.Context(), req.Accid, req.Reason, admin.Operator(r))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+}
+
+func banIPHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, ratelimit.Bans.List())
+	case http.MethodPost:
+		req, ok := readRequest(w, r)
+		if !ok {
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := BanIP(r.Context(), req.IP, d, req.Reason, admin.Operator(r))
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func unbanIPHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := UnbanIP(r.Context(), req.IP, admin.Operator(r)); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func noticeHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	n, err := Notice(r.Context(), req.Text, admin.Operator(r))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sent": n})
+}
+
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m, err := model.GetMaintenance(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]*model.Maintenance{"maintenance": m})
+	case http.MethodPost:
+		req, ok := readRequest(w, r)
+		if !ok {
+			return
+		}
+		var after time.Duration
+		if req.After != "" {
+			var err error
+			if after, err = time.ParseDuration(req.After); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		m, err := StartMaintenance(r.Context(), after, d, req.Reason, admin.Operator(r))
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]*model.Maintenance{"maintenance": m})
+	case http.MethodDelete:
+		if err := StopMaintenance(r.Context(), admin.Operator(r)); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Rooms())
+}
+
+// readRequest 解析 JSON 请求体，失败时已经回复了 400
+func readRequest(w http.ResponseWriter, r *http.Request) (*request, bool) {
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// statusOf 参数错误返回 400，其他的是 redis 这类内部错误
+func statusOf(err error) int {
+	switch err {
+	case ErrBadAccid, ErrBadIP, ErrBadDuration, ErrEmptyNotice, ErrBadItem, ErrBadCount, ErrBadLevel:
+		return http.StatusBadRequest
+	case ErrSessionNotFound, model.ErrAccountNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
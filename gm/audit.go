@@ -0,0 +1,69 @@
+package gm
+
+import (
+	"context"
+	"gameserver/model"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// 写操作记录最多等这么久，mysql 卡住时不能一直挂着 GM 的请求
+	auditTimeout = 3 * time.Second
+	// detail、result 字段的长度，公告、错误信息这类长内容截断
+	maxAuditDetail = 1024
+	maxAuditResult = 255
+)
+
+// 操作来源
+const (
+	SourceAPI     = "api"
+	SourceConsole = "console"
+)
+
+// 请求上下文里保存操作来源的 key
+type sourceKey struct{}
+
+type source struct {
+	name string
+	addr string
+}
+
+// WithSource 标记操作来自哪里，记在操作记录里
+func WithSource(ctx context.Context, name string, addr string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source{name: name, addr: addr})
+}
+
+// audit 记日志并写一条操作记录，写失败只记日志，操作本身已经生效了
+func audit(ctx context.Context, operator string, action string, target string, detail string, err error) {
+	src, _ := ctx.Value(sourceKey{}).(source)
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	slog.Info("GM操作", "operator", operator, "source", src.name, "addr", src.addr, "action", action, "target", target, "detail", detail, "result", result)
+	// 请求取消了记录也要写完
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditTimeout)
+	defer cancel()
+	if err := model.InsertGMAudit(ctx, model.GMAudit{
+		Operator:   operator,
+		Source:     src.name,
+		Addr:       src.addr,
+		Action:     action,
+		Target:     target,
+		Detail:     truncate(detail, maxAuditDetail),
+		Result:     truncate(result, maxAuditResult),
+		Created_at: time.Now().Format("2006-01-02 15:04:05"),
+	}); err != nil {
+		slog.Error("写GM操作记录失败", "operator", operator, "action", action, "target", target, "err", err)
+	}
+}
+
+// truncate 最多保留 n 个字符
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,345 @@
+package gm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gameserver/model"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 查操作记录时默认显示多少条
+const auditLimit = 20
+
+// command 一个控制台命令
+type command struct {
+	name     string
+	usage    string                 // 参数说明
+	help     string                 // 一句话说明
+	minArgs  int                    // 最少几个参数
+	complete func(pos int) []string // 第 pos 个参数的补全候选，为空时不补全
+	run      func(c *console, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	// help 要列出所有命令，放到 init 里避免初始化循环
+	commands = []*command{
+		{name: "help", usage: "[命令]", help: "查看命令说明", complete: completeCommands, run: helpCommand},
+		{name: "online", help: "本节点的在线会话", run: onlineCommand},
+		{name: "kick", usage: "<accid> [原因]", help: "把账号踢下线", minArgs: 1, complete: completeAccid, run: kickCommand},
+		{name: "account", usage: "<accid>", help: "账号状态和最近的修改历史", minArgs: 1, complete: completeAccid, run: accountCommand},
+		{name: "suspend", usage: "<accid> <时长> [原因]", help: "停封账号并踢下线，到期自动恢复，时长比如 30m、24h", minArgs: 2, complete: completeAccid, run: suspendCommand},
+		{name: "ban", usage: "<accid> [原因]", help: "永久封禁账号并踢下线", minArgs: 1, complete: completeAccid, run: banCommand},
+		{name: "unban", usage: "<accid> [原因]", help: "恢复账号，解除封禁、停封，撤销待注销", minArgs: 1, complete: completeAccid, run: unbanCommand},
+		{name: "delete", usage: "<accid> [原因]", help: "标记账号待注销并踢下线", minArgs: 1, complete: completeAccid, run: deleteCommand},
+		{name: "give", usage: "<accid> <道具ID> <数量>", help: "给玩家发道具，不在线也可以发", minArgs: 3, complete: completeAccid, run: giveCommand},
+		{name: "setlevel", usage: "<accid> <等级>", help: "修改玩家等级", minArgs: 2, complete: completeAccid, run: setLevelCommand},
+		{name: "notice", usage: "<内容>", help: "给本节点所有在线玩家发系统公告", minArgs: 1, run: noticeCommand},
+		{name: "room", usage: "list", help: "本节点的房间和成员", complete: completeRoom, run: roomCommand},
+		{name: "audit", usage: "[accid]", help: "最近的GM操作记录，可以只看一个账号的", complete: completeAccid, run: auditCommand},
+		{name: "quit", help: "退出控制台", run: quitCommand},
+	}
+}
+
+// findCommand 按名字找命令
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func errUnknownCommand(name string) error {
+	return errors.New("没有这个命令 " + name + "，输入 help 查看所有命令")
+}
+
+func errUsage(cmd *command) error {
+	return errors.New("用法: " + cmd.name + " " + cmd.usage)
+}
+
+func completeCommands(pos int) []string {
+	if pos != 0 {
+		return nil
+	}
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// completeAccid 第一个参数补全本节点在线的账号
+func completeAccid(pos int) []string {
+	if pos != 0 {
+		return nil
+	}
+	seen := make(map[int64]bool)
+	var accids []string
+	for _, s := range all() {
+		if accid := s.Accid(); accid > 0 && !seen[accid] {
+			seen[accid] = true
+			accids = append(accids, strconv.FormatInt(accid, 10))
+		}
+	}
+	return accids
+}
+
+func completeRoom(pos int) []string {
+	if pos != 0 {
+		return nil
+	}
+	return []string{"list"}
+}
+
+func helpCommand(c *console, args []string) error {
+	if len(args) > 0 {
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			return errUnknownCommand(args[0])
+		}
+		c.println(cmd.name + " " + cmd.usage + "\n  " + cmd.help)
+		return nil
+	}
+	c.table(func(w *tabwriter.Writer) {
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "%s %s\t%s\n", cmd.name, cmd.usage, cmd.help)
+		}
+	})
+	return nil
+}
+
+func onlineCommand(c *console, args []string) error {
+	infos := Sessions()
+	authed := 0
+	c.table(func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "SESSION\tACCID\tTRANSPORT\tIP\tRTT(ms)\tROOM")
+		for _, info := range infos {
+			if info.Authed {
+				authed++
+			}
+			room := "-"
+			if info.Room != 0 {
+				room = strconv.FormatUint(uint64(info.Room), 10)
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%.1f\t%s\n", info.ID, info.Accid, info.Transport, info.IP, info.RTT, room)
+		}
+	})
+	c.println(fmt.Sprintf("共 %d 个会话，已登录 %d 个", len(infos), authed))
+	return nil
+}
+
+func kickCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := KickAccount(c.ctx, accid, strings.Join(args[1:], " "), c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("踢下线 %d 个会话", n))
+	return nil
+}
+
+func accountCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	info, err := GetAccount(c.ctx, accid)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("%d %s 状态 %s", info.Accid, info.Account, info.Status))
+	if info.Status != model.AccountActive {
+		c.println(fmt.Sprintf("原因 %s，操作人 %s%s", info.Reason, info.Operator, untilText(info.Until)))
+	}
+	c.table(func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "TIME\tSTATUS\tOPERATOR\tUNTIL\tREASON")
+		for _, l := range info.History {
+			until := "-"
+			if l.Until > 0 {
+				until = time.Unix(l.Until, 0).Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", l.Created_at, l.Status, l.Operator, until, l.Reason)
+		}
+	})
+	return nil
+}
+
+func suspendCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil {
+		return ErrBadDuration
+	}
+	n, err := SuspendAccount(c.ctx, accid, d, strings.Join(args[2:], " "), c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("已停封到 %s，踢下线 %d 个会话", time.Now().Add(d).Format("2006-01-02 15:04:05"), n))
+	return nil
+}
+
+func banCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := BanAccount(c.ctx, accid, strings.Join(args[1:], " "), c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("已永久封禁，踢下线 %d 个会话", n))
+	return nil
+}
+
+func unbanCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	if err := UnbanAccount(c.ctx, accid, strings.Join(args[1:], " "), c.operator); err != nil {
+		return err
+	}
+	c.println("账号已恢复正常")
+	return nil
+}
+
+func deleteCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := DeleteAccount(c.ctx, accid, strings.Join(args[1:], " "), c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("已标记待注销，踢下线 %d 个会话", n))
+	return nil
+}
+
+// untilText 停封的解封时间，没有时为空
+func untilText(until int64) string {
+	if until <= 0 {
+		return ""
+	}
+	return "，解封时间 " + time.Unix(until, 0).Format("2006-01-02 15:04:05")
+}
+
+func giveCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return ErrBadCount
+	}
+	total, err := GiveItem(c.ctx, accid, args[1], n, c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("已发放，%s 现在有 %d 个", args[1], total))
+	return nil
+}
+
+func setLevelCommand(c *console, args []string) error {
+	accid, err := parseAccid(args[0])
+	if err != nil {
+		return err
+	}
+	level, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ErrBadLevel
+	}
+	if err := SetLevel(c.ctx, accid, level, c.operator); err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("等级已改为 %d", level))
+	return nil
+}
+
+func noticeCommand(c *console, args []string) error {
+	n, err := Notice(c.ctx, strings.Join(args, " "), c.operator)
+	if err != nil {
+		return err
+	}
+	c.println(fmt.Sprintf("已发送给 %d 个玩家", n))
+	return nil
+}
+
+func roomCommand(c *console, args []string) error {
+	if len(args) > 0 && args[0] != "list" {
+		return errUsage(findCommand("room"))
+	}
+	rooms := Rooms()
+	c.table(func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ROOM\tCREATED\tMEMBERS")
+		for _, room := range rooms {
+			members := make([]string, 0, len(room.Members))
+			for _, m := range room.Members {
+				members = append(members, fmt.Sprintf("%d(%s)", m.Accid, m.Transport))
+			}
+			sort.Strings(members)
+			fmt.Fprintf(w, "%d\t%s\t%s\n", room.ID, room.Created.Format("15:04:05"), strings.Join(members, " "))
+		}
+	})
+	c.println(fmt.Sprintf("共 %d 个房间", len(rooms)))
+	return nil
+}
+
+func auditCommand(c *console, args []string) error {
+	target := ""
+	if len(args) > 0 {
+		accid, err := parseAccid(args[0])
+		if err != nil {
+			return err
+		}
+		target = accidTarget(accid)
+	}
+	audits, err := model.GetGMAudits(c.ctx, target, auditLimit)
+	if err != nil {
+		return err
+	}
+	c.table(func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "TIME\tOPERATOR\tSOURCE\tACTION\tTARGET\tRESULT\tDETAIL")
+		for _, a := range audits {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.Created_at, a.Operator, a.Source, a.Action, a.Target, a.Result, a.Detail)
+		}
+	})
+	return nil
+}
+
+func quitCommand(c *console, args []string) error {
+	return errQuit
+}
+
+// parseAccid 解析账号ID参数
+func parseAccid(s string) (int64, error) {
+	accid, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || accid <= 0 {
+		return 0, ErrBadAccid
+	}
+	return accid, nil
+}
+
+// table 用 tabwriter 按列对齐输出
+func (c *console) table(f func(w *tabwriter.Writer)) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	f(w)
+	_ = w.Flush()
+	c.print(strings.ReplaceAll(buf.String(), "\n", "\r\n"))
+}
@@ -0,0 +1,378 @@
+package gm
+
+/**
+ * GM 控制台：telnet 连上来，输入操作人 token 登录后敲命令，help 查看所有命令
+ * 让 telnet 客户端进入字符模式，服务器自己回显和做行编辑：
+ * 退格、Ctrl-U 清空、Ctrl-C 取消、Ctrl-D 退出、上下键翻历史、tab 补全命令和在线账号
+ * 明文传输，只在内网监听
+ */
+
+import (
+	"bufio"
+	"context"
+	"gameserver/admin"
+	"gameserver/tcp/restart"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	consoleIdleTimeout = 15 * time.Minute // 这么久没有输入就断开
+	maxLoginAttempts   = 3                // 连续输错几次 token 断开
+	maxLineLen         = 1024             // 一行最多多少个字符
+	maxHistory         = 100              // 记住最近多少条命令
+)
+
+// telnet 协议的控制字节
+const (
+	telIAC  = 255
+	telDONT = 254
+	telDO   = 253
+	telWONT = 252
+	telWILL = 251
+	telSB   = 250
+	telSE   = 240
+	optEcho = 1
+	optSGA  = 3
+)
+
+// 控制字符
+const (
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyCtrlU     = 0x15
+	keyEsc       = 0x1b
+	keyDelete    = 0x7f
+)
+
+// errQuit 输入了 quit 或者 Ctrl-D
+var errQuit = io.EOF
+
+// console 一个控制台连接
+type console struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	addr     string
+	operator string
+	ctx      context.Context
+	prompt   string
+	history  []string
+	skipLF   bool // 上一个字节是 \r，后面跟着的 \n 或者 \0 不算新的一行
+}
+
+// ServeConsole 监听 GM 控制台，operators 和管理接口的一样，一般用 go 启动，出错时已经记了日志
+// 和管理端口一样，平滑重启时由新进程接管监听
+func ServeConsole(address string, operators map[string]string) error {
+	if len(operators) == 0 {
+		slog.Warn("没有配置操作人，GM控制台不开启")
+		return nil
+	}
+	ln, err := restart.Listen("console", address)
+	if err != nil {
+		slog.Error("GM控制台监听失败", "addr", address, "err", err)
+		return err
+	}
+	slog.Info("GM控制台开始监听", "addr", ln.Addr().String())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("GM控制台退出", "err", err)
+			return err
+		}
+		go serveConsole(conn, operators)
+	}
+}
+
+func serveConsole(conn net.Conn, operators map[string]string) {
+	defer conn.Close()
+	c := &console{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		addr: conn.RemoteAddr().String(),
+	}
+	// 服务器负责回显，客户端不等回车逐个字节发送，tab 和方向键才能马上处理
+	_, _ = c.w.Write([]byte{telIAC, telWILL, optEcho, telIAC, telWILL, optSGA})
+	c.println("GM控制台，输入 token 登录")
+	for i := 0; i < maxLoginAttempts && c.operator == ""; i++ {
+		token, err := c.readLine("token: ", false)
+		if err != nil {
+			return
+		}
+		if c.operator = admin.FindOperator(operators, strings.TrimSpace(token)); c.operator == "" {
+			slog.Warn("GM控制台认证失败", "addr", c.addr)
+			// 拖慢猜 token 的速度
+			time.Sleep(time.Second)
+			c.println("token 错误")
+		}
+	}
+	if c.operator == "" {
+		_ = c.w.Flush()
+		return
+	}
+	c.ctx = WithSource(context.Background(), SourceConsole, c.addr)
+	slog.Info("GM控制台登录", "operator", c.operator, "addr", c.addr)
+	defer slog.Info("GM控制台退出", "operator", c.operator, "addr", c.addr)
+	c.println("欢迎 " + c.operator + "，输入 help 查看命令，tab 补全")
+	for {
+		line, err := c.readLine(c.operator+"> ", true)
+		if err != nil {
+			_ = c.w.Flush()
+			return
+		}
+		if err := c.exec(line); err == errQuit {
+			c.println("bye")
+			_ = c.w.Flush()
+			return
+		} else if err != nil {
+			c.println("错误: " + err.Error())
+		}
+	}
+}
+
+// exec 执行一行命令
+func (c *console) exec(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	c.remember(line)
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return errUnknownCommand(args[0])
+	}
+	if len(args)-1 < cmd.minArgs {
+		return errUsage(cmd)
+	}
+	return cmd.run(c, args[1:])
+}
+
+// remember 记到历史里，和上一条一样的不重复记
+func (c *console) remember(line string) {
+	if n := len(c.history); n > 0 && c.history[n-1] == line {
+		return
+	}
+	c.history = append(c.history, line)
+	if len(c.history) > maxHistory {
+		c.history = c.history[1:]
+	}
+}
+
+// readLine 读一行，echo 为 false 时不回显，用来输入 token
+func (c *console) readLine(prompt string, echo bool) (string, error) {
+	c.prompt = prompt
+	c.print(prompt)
+	var line []rune
+	hist := len(c.history) // 正在看第几条历史，等于 len 时是新输入的这一行
+	for {
+		if err := c.w.Flush(); err != nil {
+			return "", err
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(consoleIdleTimeout))
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c.skipLF {
+			c.skipLF = false
+			if b == '\n' || b == 0 {
+				continue
+			}
+		}
+		switch {
+		case b == telIAC:
+			if err := c.skipCommand(); err != nil {
+				return "", err
+			}
+		case b == '\r' || b == '\n':
+			c.skipLF = b == '\r'
+			c.print("\r\n")
+			return string(line), nil
+		case b == keyCtrlC:
+			c.print("^C\r\n")
+			return "", nil
+		case b == keyCtrlD:
+			if len(line) == 0 {
+				c.print("\r\n")
+				return "", errQuit
+			}
+		case b == keyBackspace || b == keyDelete:
+			if len(line) > 0 {
+				if echo {
+					c.erase(line[len(line)-1:])
+				}
+				line = line[:len(line)-1]
+			}
+		case b == keyCtrlU:
+			if echo {
+				c.erase(line)
+			}
+			line = line[:0]
+		case b == keyTab:
+			if echo {
+				line = c.complete(line)
+			}
+		case b == keyEsc:
+			key, err := c.readEscape()
+			if err != nil {
+				return "", err
+			}
+			if !echo || (key != 'A' && key != 'B') {
+				continue
+			}
+			// 上下键翻历史
+			if key == 'A' && hist > 0 {
+				hist--
+			} else if key == 'B' && hist < len(c.history) {
+				hist++
+			} else {
+				continue
+			}
+			c.erase(line)
+			line = line[:0]
+			if hist < len(c.history) {
+				line = append(line, []rune(c.history[hist])...)
+			}
+			c.print(string(line))
+		case b < 0x20:
+			// 其他控制字符忽略
+		default:
+			// 多字节的 utf-8 字符整个读出来
+			_ = c.r.UnreadByte()
+			r, _, err := c.r.ReadRune()
+			if err != nil {
+				return "", err
+			}
+			if len(line) >= maxLineLen {
+				continue
+			}
+			line = append(line, r)
+			if echo {
+				c.print(string(r))
+			}
+		}
+	}
+}
+
+// skipCommand 跳过 IAC 开头的 telnet 协商，客户端的回复不用处理
+func (c *console) skipCommand() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case telWILL, telWONT, telDO, telDONT:
+		_, err = c.r.ReadByte()
+	case telSB:
+		// 子协商一直到 IAC SE
+		var prev byte
+		for {
+			if b, err = c.r.ReadByte(); err != nil || (prev == telIAC && b == telSE) {
+				break
+			}
+			prev = b
+		}
+	}
+	return err
+}
+
+// readEscape 读完一个 ESC [ 开头的控制序列，返回最后一个字节，方向键上是 A、下是 B
+func (c *console) readEscape() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0, err
+	}
+	for {
+		if b, err = c.r.ReadByte(); err != nil {
+			return 0, err
+		}
+		// 参数字节是 0x30-0x3f，后面一个字节结束
+		if b < 0x30 || b > 0x3f {
+			return b, nil
+		}
+	}
+}
+
+// complete tab 补全最后一个词：有唯一的候选时补全，多个时补到公共前缀，还不能继续补就列出来
+func (c *console) complete(line []rune) []rune {
+	s := string(line)
+	words := strings.Fields(s)
+	if len(words) == 0 || strings.HasSuffix(s, " ") {
+		words = append(words, "")
+	}
+	prefix := words[len(words)-1]
+	var candidates []string
+	for _, cand := range nextWords(words[:len(words)-1]) {
+		if strings.HasPrefix(cand, prefix) {
+			candidates = append(candidates, cand)
+		}
+	}
+	if len(candidates) == 0 {
+		c.print("\a")
+		return line
+	}
+	sort.Strings(candidates)
+	common := candidates[0]
+	for _, cand := range candidates[1:] {
+		for !strings.HasPrefix(cand, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	}
+	if len(common) > len(prefix) {
+		add := common[len(prefix):]
+		c.print(add)
+		return append(line, []rune(add)...)
+	}
+	c.print("\r\n" + strings.Join(candidates, "  ") + "\r\n" + c.prompt + s)
+	return line
+}
+
+// nextWords 已经输入了 words 之后，下一个词的所有候选
+func nextWords(words []string) []string {
+	if len(words) == 0 {
+		return completeCommands(0)
+	}
+	cmd := findCommand(words[0])
+	if cmd == nil || cmd.complete == nil {
+		return nil
+	}
+	return cmd.complete(len(words) - 1)
+}
+
+// erase 从行尾擦掉这些字符，中文占两列
+func (c *console) erase(runes []rune) {
+	n := 0
+	for _, r := range runes {
+		n += runeWidth(r)
+	}
+	c.print(strings.Repeat("\b \b", n))
+}
+
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana) ||
+		(r >= 0x3000 && r <= 0x303f) || (r >= 0xff01 && r <= 0xff60) {
+		return 2
+	}
+	return 1
+}
+
+// print 输出到客户端，telnet 里换行要 \r\n
+func (c *console) print(s string) {
+	_, _ = c.w.WriteString(s)
+}
+
+// println 输出一行或者多行
+func (c *console) println(s string) {
+	c.print(strings.ReplaceAll(s, "\n", "\r\n") + "\r\n")
+}
@@ -0,0 +1,338 @@
+package gm
+
+/**
+ * 运维操作：查看在线会话和房间、踢人、封禁账号和 IP、发系统公告、开关停服维护、发道具、改等级
+ * 管理接口和 GM 控制台调用这里，每个操作都带上操作人记日志，并写一条操作记录
+ * 会话列表只看本节点；按账号踢人和修改账号状态时通过 redis 通知所有节点，其他节点上在线的会话也会断开
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gameserver/game"
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/ratelimit"
+	"gameserver/session"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSessionNotFound 会话不存在或者已经断开
+	ErrSessionNotFound = errors.New("会话不存在")
+	// ErrBadAccid 账号ID必须大于 0
+	ErrBadAccid = errors.New("账号ID错误")
+	// ErrBadIP IP 格式错误
+	ErrBadIP = errors.New("IP格式错误")
+	// ErrBadDuration 时长必须大于 0
+	ErrBadDuration = errors.New("时长必须大于0")
+	// ErrEmptyNotice 公告内容为空
+	ErrEmptyNotice = errors.New("公告内容为空")
+	// ErrBadItem 道具ID为空
+	ErrBadItem = errors.New("道具ID错误")
+	// ErrBadCount 数量必须大于 0
+	ErrBadCount = errors.New("数量必须大于0")
+	// ErrBadLevel 等级必须大于 0
+	ErrBadLevel = errors.New("等级必须大于0")
+)
+
+// node 本节点的名字，收到自己发出的踢人通知时跳过
+var node = nodeName()
+
+// 多久检查一次在线会话的 token 有没有被作废
+const revokedCheckInterval = 30 * time.Second
+
+var (
+	mu      sync.RWMutex
+	router  *session.Router
+	sources []func() []session.Session
+)
+
+// Setup 绑定命令路由，发公告时通过它找到所有已登录的会话
+func Setup(r *session.Router) {
+	mu.Lock()
+	defer mu.Unlock()
+	router = r
+}
+
+// AddSessions 添加会话来源，比如 tcp 服务器的所有连接、websocket 连接中心
+func AddSessions(f func() []session.Session) {
+	mu.Lock()
+	defer mu.Unlock()
+	sources = append(sources, f)
+}
+
+// SessionInfo 一个在线会话
+type SessionInfo struct {
+	ID        int64   `json:"id"`
+	Accid     int64   `json:"accid"`
+	Authed    bool    `json:"authed"`
+	Transport string  `json:"transport"`
+	IP        string  `json:"ip"`
+	RTT       float64 `json:"rtt_ms"`         // 往返时间，毫秒，拿不到时为 0
+	Room      uint32  `json:"room,omitempty"` // 所在房间
+}
+
+// all 所有来源的会话
+func all() []session.Session {
+	mu.RLock()
+	list := append([]func() []session.Session(nil), sources...)
+	mu.RUnlock()
+	var sessions []session.Session
+	for _, f := range list {
+		sessions = append(sessions, f()...)
+	}
+	return sessions
+}
+
+// Sessions 本节点所有会话，包括还没认证的，按会话ID排序
+func Sessions() []SessionInfo {
+	sessions := all()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		info := SessionInfo{
+			ID:        s.ID(),
+			Accid:     s.Accid(),
+			Authed:    s.Authed(),
+			Transport: s.Transport(),
+			IP:        s.ClientIP(),
+			RTT:       float64(session.RTT(s).Microseconds()) / 1000,
+		}
+		if room := game.RoomOf(s); room != nil {
+			info.Room = room.ID
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Kick 按会话ID踢下线
+func Kick(ctx context.Context, id int64, reason string, operator string) error {
+	for _, s := range all() {
+		if s.ID() == id {
+			kick(s, protocol.NewErrorPacket(protocol.ERR_KICKED, reason))
+			audit(ctx, operator, "kick", "session:"+strconv.FormatInt(id, 10), fmt.Sprintf("accid=%d reason=%s", s.Accid(), reason), nil)
+			return nil
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// KickAccount 把账号在所有节点上的会话踢下线，返回本节点踢掉的数量
+func KickAccount(ctx context.Context, accid int64, reason string, operator string) (int, error) {
+	if accid <= 0 {
+		return 0, ErrBadAccid
+	}
+	n := kickAccount(ctx, accid, protocol.ERR_KICKED, reason, 0)
+	audit(ctx, operator, "kick", accidTarget(accid), fmt.Sprintf("reason=%s kicked=%d", reason, n), nil)
+	return n, nil
+}
+
+// BanIP 封禁 IP 一段时间，并把本节点上从这个 IP 来的会话断开，返回断开的数量
+func BanIP(ctx context.Context, ip string, d time.Duration, reason string, operator string) (int, error) {
+	if net.ParseIP(ip) == nil {
+		return 0, ErrBadIP
+	}
+	if d <= 0 {
+		return 0, ErrBadDuration
+	}
+	ratelimit.Bans.Ban(ip, d)
+	n := kickWhere(func(s session.Session) bool { return s.ClientIP() == ip }, protocol.NewErrorPacket(protocol.ERR_KICKED, reason))
+	audit(ctx, operator, "ban_ip", "ip:"+ip, fmt.Sprintf("duration=%s reason=%s kicked=%d", d, reason, n), nil)
+	return n, nil
+}
+
+// UnbanIP 提前解封 IP
+func UnbanIP(ctx context.Context, ip string, operator string) error {
+	if net.ParseIP(ip) == nil {
+		return ErrBadIP
+	}
+	ratelimit.Bans.Unban(ip)
+	audit(ctx, operator, "unban_ip", "ip:"+ip, "", nil)
+	return nil
+}
+
+// Notice 给本节点所有已登录的玩家发系统公告，返回发送的人数
+func Notice(ctx context.Context, text string, operator string) (int, error) {
+	if text == "" {
+		return 0, ErrEmptyNotice
+	}
+	mu.RLock()
+	r := router
+	mu.RUnlock()
+	if r == nil {
+		return 0, nil
+	}
+	n := len(r.Online())
+	r.Broadcast(protocol.NewNoticePacket(text))
+	audit(ctx, operator, "notice", "", fmt.Sprintf("sent=%d text=%s", n, text), nil)
+	return n, nil
+}
+
+// StartMaintenance after 之后停服，维护 d 这么久，所有节点都会读到
+func StartMaintenance(ctx context.Context, after time.Duration, d time.Duration, reason string, operator string) (*model.Maintenance, error) {
+	if d <= 0 {
+		return nil, ErrBadDuration
+	}
+	shutdown := time.Now().Add(after)
+	m := &model.Maintenance{Reason: reason, Shutdown: shutdown, Until: shutdown.Add(d)}
+	err := model.SetMaintenance(ctx, m)
+	audit(ctx, operator, "maintenance", "", fmt.Sprintf("shutdown=%s until=%s reason=%s", m.Shutdown.Format("2006-01-02 15:04:05"), m.Until.Format("2006-01-02 15:04:05"), reason), err)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StopMaintenance 取消或者提前结束维护
+func StopMaintenance(ctx context.Context, operator string) error {
+	err := model.ClearMaintenance(ctx)
+	audit(ctx, operator, "maintenance_stop", "", "", err)
+	return err
+}
+
+// GiveItem 给玩家发 n 个道具，不在线也可以发，返回发完之后的数量
+func GiveItem(ctx context.Context, accid int64, item string, n int64, operator string) (int64, error) {
+	if accid <= 0 {
+		return 0, ErrBadAccid
+	}
+	if item == "" {
+		return 0, ErrBadItem
+	}
+	if n <= 0 {
+		return 0, ErrBadCount
+	}
+	total, err := model.AddItem(ctx, accid, item, n)
+	audit(ctx, operator, "give", accidTarget(accid), fmt.Sprintf("item=%s count=%d total=%d", item, n, total), err)
+	return total, err
+}
+
+// SetLevel 修改玩家等级
+func SetLevel(ctx context.Context, accid int64, level int, operator string) error {
+	if accid <= 0 {
+		return ErrBadAccid
+	}
+	if level <= 0 {
+		return ErrBadLevel
+	}
+	old, err := model.GetLevel(ctx, accid)
+	if err == nil {
+		err = model.SetLevel(ctx, accid, level)
+	}
+	audit(ctx, operator, "setlevel", accidTarget(accid), fmt.Sprintf("level=%d old=%d", level, old), err)
+	return err
+}
+
+// Rooms 本节点所有房间
+func Rooms() []game.RoomInfo {
+	return game.Rooms.List()
+}
+
+// nodeName 主机名加进程号，平滑重启时新旧进程也能区分开
+func nodeName() string {
+	host, _ := os.Hostname()
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// accidTarget 操作记录里的账号对象
+func accidTarget(accid int64) string {
+	return "accid:" + strconv.FormatInt(accid, 10)
+}
+
+// kickAccount 踢掉本节点上账号的所有会话，再通知其他节点，返回本节点踢掉的数量
+// code 是错误包的子命令，until 是停封的解封时间
+func kickAccount(ctx context.Context, accid int64, code uint32, reason string, until int64) int {
+	n := kickWhere(func(s session.Session) bool { return s.Accid() == accid }, kickPacket(code, reason, until))
+	if err := model.PublishKick(ctx, &model.Kick{Node: node, Accid: accid, Code: code, Reason: reason, Until: until}); err != nil {
+		slog.Error("通知其他节点踢人失败", "accid", accid, "err", err)
+	}
+	return n
+}
+
+// WatchKicks 处理其他节点发来的踢人通知，一般用 go 启动
+func WatchKicks() {
+	model.SubscribeKicks(func(k *model.Kick) {
+		if k.Node == node {
+			return
+		}
+		match := func(s session.Session) bool {
+			return s.Accid() == k.Accid && (k.Token == "" || session.Token(s) == k.Token)
+		}
+		if n := kickWhere(match, kickPacket(k.Code, k.Reason, k.Until)); n > 0 {
+			slog.Info("按其他节点的通知踢人", "node", k.Node, "accid", k.Accid, "code", k.Code, "kicked", n)
+		}
+	})
+}
+
+// WatchRevokedTokens 定期检查在线会话的 token，已经作废的踢下线，一般用 go 启动
+// 作废时已经通过 PublishKick 通知过了，这里补上订阅断开期间漏掉的
+func WatchRevokedTokens() {
+	ticker := time.NewTicker(revokedCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		kickRevoked()
+	}
+}
+
+// kickRevoked 把 token 已经作废的会话踢下线，返回踢掉的数量
+func kickRevoked() int {
+	var tokens []string
+	for _, s := range all() {
+		if t := session.Token(s); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == 0 {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	revoked, err := model.RevokedTokens(ctx, tokens)
+	if err != nil {
+		slog.Error("检查作废的token失败", "err", err)
+		return 0
+	}
+	if len(revoked) == 0 {
+		return 0
+	}
+	n := kickWhere(func(s session.Session) bool { return revoked[session.Token(s)] }, protocol.NewErrorPacket(protocol.ERR_KICKED, "token revoked"))
+	slog.Info("踢掉token已作废的会话", "kicked", n)
+	return n
+}
+
+// kickPacket 踢人前发给客户端的错误包
+func kickPacket(code uint32, reason string, until int64) *protocol.Packet {
+	if code == protocol.ERR_BANNED {
+		return protocol.NewBannedPacket(reason, until)
+	}
+	return protocol.NewErrorPacket(code, reason)
+}
+
+// kickWhere 给满足条件的会话发一个包然后断开，返回断开的数量
+func kickWhere(match func(s session.Session) bool, p *protocol.Packet) int {
+	n := 0
+	for _, s := range all() {
+		if match(s) {
+			cp := *p
+			kick(s, &cp)
+			n++
+		}
+	}
+	return n
+}
+
+// kick 发完通知再断开，tcp 的关闭会等正在发送的数据，放到后台做
+func kick(s session.Session, p *protocol.Packet) {
+	go func() {
+		_ = s.Send(p)
+		_ = s.Close()
+	}()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"gameserver/metrics"
+	"gameserver/model"
+	"gameserver/utils"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// 清理游客时每批删多少个
+const guestCleanBatch = 100
+
+// 签游客密钥的服务器密钥，启动时按 -guest-key 或者 GUEST_KEY 设置，没有设置时不开放游客登录
+var guestKey []byte
+
+// 游客登录，第一次不带 secret，服务器创建游客并返回 secret，之后带着 secret 登录
+type GuestC struct {
+	DeviceID string `form:"device_id" binding:"required,max=64"`
+	Secret   string `form:"secret" binding:"omitempty,len=64,hexadecimal"`
+}
+
+// 游客绑定正式账号
+type GuestBindC struct {
+	DeviceID string `form:"device_id" binding:"required,max=64"`
+	Secret   string `form:"secret" binding:"required,len=64,hexadecimal"`
+	Account  string `form:"account" binding:"required,len=11"`
+	Password string `form:"password" binding:"required,min=6,nefield=Account"`
+}
+
+// 游客登录成功后返回的数据，客户端要把 Account 和 Secret 存在本地
+type GuestData struct {
+	*LoginData
+	Account string
+	Secret  string
+}
+
+// 游客登录，设备第一次登录时创建游客账号
+func GuestFunc(c *gin.Context) {
+	var guestc GuestC
+	if err := c.ShouldBind(&guestc); err != nil {
+		metrics.Login("http", 101)
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	var accinfo model.Account
+	if guestc.Secret == "" {
+		var err error
+		accinfo, err = model.CreateGuest(ctx, guestc.DeviceID)
+		if err == model.ErrGuestExists {
+			// 设备上已经有游客，没有 secret 不能登录，防止拿别人的设备号登录
+			metrics.Login("http", 114)
+			ReturnJson(c, 200, 114, "guest exists, secret required", "")
+			return
+		}
+		if err != nil {
+			slog.Error("创建游客失败", "device_id", guestc.DeviceID, "err", err)
+			metrics.Login("http", 106)
+			ReturnJson(c, 200, 106, "login error", "")
+			return
+		}
+		slog.Info("创建游客", "accid", accinfo.Accid, "account", accinfo.Account, "ip", c.ClientIP())
+	} else {
+		var ok bool
+		if accinfo, ok = findGuest(c, guestc.DeviceID, guestc.Secret); !ok {
+			return
+		}
+		if err := model.TouchGuest(ctx, accinfo.Accid); err != nil {
+			slog.Error("更新游客登录时间失败", "accid", accinfo.Accid, "err", err)
+		}
+		if refuseStatus(c, accinfo) {
+			return
+		}
+	}
+	data, ok := loginSuccess(c, accinfo)
+	if !ok {
+		return
+	}
+	metrics.Login("http", 0)
+	ReturnJson(c, 200, 200, "success", GuestData{
+		LoginData: data,
+		Account:   accinfo.Account,
+		Secret:    guestSecret(accinfo.Accid, guestc.DeviceID),
+	})
+}
+
+// 游客绑定正式账号，accid 不变，游戏数据都保留，绑定后用新账号登录
+func GuestBindFunc(c *gin.Context) {
+	var bindc GuestBindC
+	if err := c.ShouldBind(&bindc); err != nil || model.ReservedName(bindc.Account) {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	accinfo, ok := findGuest(c, bindc.DeviceID, bindc.Secret)
+	if !ok {
+		return
+	}
+	if refuseStatus(c, accinfo) {
+		return
+	}
+	exists, err := model.GetAccountInfo(ctx, bindc.Account)
+	if err != nil {
+		ReturnJson(c, 200, 103, "get account error", "")
+		return
+	}
+	if len(exists) > 0 {
+		ReturnJson(c, 200, 102, "account is exists", "")
+		return
+	}
+	password := utils.GetMd5String([]byte(bindc.Password))
+	switch err := model.BindGuest(ctx, accinfo.Accid, bindc.Account, password); err {
+	case nil:
+	case model.ErrAccountExists:
+		ReturnJson(c, 200, 102, "account is exists", "")
+		return
+	case model.ErrNotGuest:
+		ReturnJson(c, 200, 116, "guest already bound", "")
+		return
+	default:
+		slog.Error("游客绑定账号失败", "accid", accinfo.Accid, "err", err)
+		ReturnJson(c, 200, 103, "bind account error", "")
+		return
+	}
+	slog.Info("游客绑定账号", "accid", accinfo.Accid, "guest", accinfo.Account, "account", bindc.Account, "ip", c.ClientIP())
+	// 游客的 token 按旧账号名保存，账号名改了之后就用不了了，按新账号重新发
+	accinfo.Account = bindc.Account
+	accinfo.Password = password
+	accinfo.Guest = 0
+	data, ok := loginSuccess(c, accinfo)
+	if !ok {
+		return
+	}
+	ReturnJson(c, 200, 200, "success", data)
+}
+
+// findGuest 按设备查询游客并校验 secret，失败时已经返回了错误
+func findGuest(c *gin.Context, deviceID string, secret string) (model.Account, bool) {
+	accinfo, err := model.GetGuestByDevice(c.Request.Context(), deviceID)
+	if err == model.ErrAccountNotFound {
+		metrics.Login("http", 102)
+		ReturnJson(c, 200, 102, "guest is not exists", "")
+		return model.Account{}, false
+	}
+	if err != nil {
+		slog.Error("查询游客失败", "device_id", deviceID, "err", err)
+		metrics.Login("http", 103)
+		ReturnJson(c, 200, 103, "get account error", "")
+		return model.Account{}, false
+	}
+	if !hmac.Equal([]byte(guestSecret(accinfo.Accid, deviceID)), []byte(secret)) {
+		slog.Warn("游客secret错误", "accid", accinfo.Accid, "ip", c.ClientIP())
+		metrics.Login("http", 115)
+		ReturnJson(c, 200, 115, "secret error", "")
+		return model.Account{}, false
+	}
+	return accinfo, true
+}
+
+// guestSecret 游客的密钥，用服务器密钥对 accid 和设备号签名，不用存数据库
+// 换了服务器密钥之后所有游客都要重新创建，不要随便换
+func guestSecret(accid int, deviceID string) string {
+	mac := hmac.New(sha256.New, guestKey)
+	mac.Write([]byte("guest:" + strconv.Itoa(accid) + ":" + deviceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cleanGuests 定期删掉超过 expire 没有登录、一直没有绑定的游客，连同 redis 里的游戏数据
+func cleanGuests(expire time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		n, err := cleanStaleGuests(ctx, time.Now().Add(-expire))
+		cancel()
+		if err != nil {
+			slog.Error("清理游客失败", "deleted", n, "err", err)
+		} else if n > 0 {
+			slog.Info("清理游客", "deleted", n)
+		}
+		<-ticker.C
+	}
+}
+
+// cleanStaleGuests 分批删除，返回删掉的数量
+func cleanStaleGuests(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	for {
+		guests, err := model.DeleteStaleGuests(ctx, before, guestCleanBatch)
+		if err != nil {
+			return n, err
+		}
+		for _, g := range guests {
+			if err := model.DeletePlayer(ctx, int64(g.Accid), g.Account); err != nil {
+				slog.Error("删除游客数据失败", "accid", g.Accid, "err", err)
+			}
+		}
+		n += len(guests)
+		if len(guests) < guestCleanBatch {
+			return n, nil
+		}
+	}
+}
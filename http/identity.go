@@ -0,0 +1,172 @@
+package main
+
+import (
+	"gameserver/identity"
+	"gameserver/metrics"
+	"gameserver/model"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+)
+
+// 第三方登录
+type IdentityLoginC struct {
+	Provider string `form:"provider" binding:"required,max=32"`
+	IdToken  string `form:"id_token" binding:"required"`
+}
+
+// 已登录的账号绑定第三方账号，account 和 token 是登录时拿到的
+type IdentityLinkC struct {
+	Account  string `form:"account" binding:"required,len=11"`
+	Token    string `form:"token" binding:"required"`
+	Provider string `form:"provider" binding:"required,max=32"`
+	IdToken  string `form:"id_token" binding:"required"`
+}
+
+// 解绑第三方账号
+type IdentityUnlinkC struct {
+	Account  string `form:"account" binding:"required,len=11"`
+	Token    string `form:"token" binding:"required"`
+	Provider string `form:"provider" binding:"required,max=32"`
+}
+
+// 第三方登录成功后返回的数据，Created 表示这次登录新建了账号
+type IdentityData struct {
+	*LoginData
+	Account string
+	Created bool
+}
+
+// 用平台的 token 登录，第一次登录时创建账号
+func IdentityLoginFunc(c *gin.Context) {
+	var loginc IdentityLoginC
+	if err := c.ShouldBind(&loginc); err != nil {
+		metrics.Login("http", 101)
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	id, ok := verifyIdentity(c, loginc.Provider, loginc.IdToken)
+	if !ok {
+		return
+	}
+	var accinfo model.Account
+	created := false
+	link, err := model.GetIdentity(ctx, id.Provider, id.Subject)
+	if err == model.ErrIdentityNotFound {
+		accinfo, err = model.CreateIdentityAccount(ctx, id.Provider, id.Subject)
+		if err == nil {
+			created = true
+			slog.Info("第三方登录创建账号", "accid", accinfo.Accid, "provider", id.Provider, "subject", id.Subject, "email", id.Email, "ip", c.ClientIP())
+		} else if err == model.ErrIdentityLinked {
+			// 同一个平台账号并发第一次登录，另一个请求已经建好了
+			link, err = model.GetIdentity(ctx, id.Provider, id.Subject)
+		}
+	}
+	if err == nil && !created {
+		accinfo, err = model.GetAccountByAccid(ctx, int64(link.Accid))
+	}
+	if err != nil {
+		slog.Error("第三方登录查询账号失败", "provider", id.Provider, "subject", id.Subject, "err", err)
+		metrics.Login("http", 103)
+		ReturnJson(c, 200, 103, "get account error", "")
+		return
+	}
+	if refuseStatus(c, accinfo) {
+		return
+	}
+	data, ok := loginSuccess(c, accinfo)
+	if !ok {
+		return
+	}
+	metrics.Login("http", 0)
+	ReturnJson(c, 200, 200, "success", IdentityData{
+		LoginData: data,
+		Account:   accinfo.Account,
+		Created:   created,
+	})
+}
+
+// 已登录的账号绑定第三方账号，游客绑定后就不会被清理了
+func IdentityLinkFunc(c *gin.Context) {
+	var linkc IdentityLinkC
+	if err := c.ShouldBind(&linkc); err != nil {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	accinfo, ok := authAccount(c, linkc.Account, linkc.Token)
+	if !ok || refuseStatus(c, accinfo) {
+		return
+	}
+	id, ok := verifyIdentity(c, linkc.Provider, linkc.IdToken)
+	if !ok {
+		return
+	}
+	switch err := model.LinkIdentity(c.Request.Context(), accinfo.Accid, id.Provider, id.Subject); err {
+	case nil:
+	case model.ErrIdentityLinked, model.ErrProviderLinked:
+		ReturnJson(c, 200, 119, "identity already linked", "")
+		return
+	default:
+		slog.Error("绑定第三方账号失败", "accid", accinfo.Accid, "provider", id.Provider, "err", err)
+		ReturnJson(c, 200, 103, "link identity error", "")
+		return
+	}
+	slog.Info("绑定第三方账号", "accid", accinfo.Accid, "provider", id.Provider, "subject", id.Subject, "email", id.Email, "ip", c.ClientIP())
+	ReturnJson(c, 200, 200, "success", "")
+}
+
+// 解绑第三方账号，没有密码的账号不能解绑最后一个
+func IdentityUnlinkFunc(c *gin.Context) {
+	var unlinkc IdentityUnlinkC
+	if err := c.ShouldBind(&unlinkc); err != nil {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	accinfo, ok := authAccount(c, unlinkc.Account, unlinkc.Token)
+	if !ok || refuseStatus(c, accinfo) {
+		return
+	}
+	switch err := model.UnlinkIdentity(c.Request.Context(), accinfo.Accid, unlinkc.Provider); err {
+	case nil:
+	case model.ErrIdentityNotFound:
+		ReturnJson(c, 200, 120, "identity not linked", "")
+		return
+	case model.ErrLastIdentity:
+		ReturnJson(c, 200, 121, "last login method", "")
+		return
+	default:
+		slog.Error("解绑第三方账号失败", "accid", accinfo.Accid, "provider", unlinkc.Provider, "err", err)
+		ReturnJson(c, 200, 103, "unlink identity error", "")
+		return
+	}
+	slog.Info("解绑第三方账号", "accid", accinfo.Accid, "provider", unlinkc.Provider, "ip", c.ClientIP())
+	ReturnJson(c, 200, 200, "success", "")
+}
+
+// verifyIdentity 用配置的平台校验 token，失败时已经返回了错误
+func verifyIdentity(c *gin.Context, provider string, token string) (*identity.Identity, bool) {
+	id, err := identity.Verify(c.Request.Context(), provider, token)
+	if err == identity.ErrUnknownProvider {
+		metrics.Login("http", 101)
+		ReturnJson(c, 200, 101, "params error", "")
+		return nil, false
+	}
+	if err != nil {
+		slog.Warn("第三方token校验失败", "provider", provider, "ip", c.ClientIP(), "err", err)
+		metrics.Login("http", 118)
+		ReturnJson(c, 200, 118, "identity token error", "")
+		return nil, false
+	}
+	return id, true
+}
+
+// authAccount 校验登录时发的 token，失败时已经返回了错误
+// 不检查账号状态，封禁的账号也要能退出登录，其他操作由调用方用 refuseStatus 检查
+func authAccount(c *gin.Context, account string, token string) (model.Account, bool) {
+	accinfo, err := model.VerifyToken(c.Request.Context(), account, token)
+	if err != nil {
+		ReturnJson(c, 200, 117, "token error", "")
+		return model.Account{}, false
+	}
+	return accinfo, true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"gameserver/model"
+	"gameserver/protocol"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"time"
+)
+
+// 登录 token 的有效期，启动时按 -token-ttl 设置
+var tokenTTL = 7 * 24 * time.Hour
+
+// 退出登录，all 为 true 时所有设备都退出
+type LogoutC struct {
+	Account string `form:"account" binding:"required,len=11"`
+	Token   string `form:"token" binding:"required"`
+	All     bool   `form:"all"`
+}
+
+// 退出登录：作废 token，通知游戏服务器把用这个 token 连着的会话踢下线
+func LogoutFunc(c *gin.Context) {
+	var logoutc LogoutC
+	if err := c.ShouldBind(&logoutc); err != nil {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	accinfo, ok := authAccount(c, logoutc.Account, logoutc.Token)
+	if !ok {
+		return
+	}
+	kick := &model.Kick{Node: "login", Accid: int64(accinfo.Accid), Code: protocol.ERR_KICKED, Reason: "logout"}
+	n := 0
+	var err error
+	if logoutc.All {
+		n, err = model.RevokeAllTokens(ctx, accinfo.Account)
+	} else {
+		var revoked bool
+		revoked, err = model.RevokeToken(ctx, accinfo.Account, logoutc.Token)
+		if revoked {
+			n = 1
+		}
+		// 只踢用这个 token 连着的会话，其他设备不受影响
+		kick.Token = logoutc.Token
+	}
+	if err != nil {
+		slog.Error("作废token失败", "accid", accinfo.Accid, "all", logoutc.All, "err", err)
+		ReturnJson(c, 200, 106, "logout error", "")
+		return
+	}
+	slog.Info("退出登录", "accid", accinfo.Accid, "all", logoutc.All, "revoked", n, "ip", c.ClientIP())
+	// token 已经作废了，通知失败的游戏服务器会按作废列表定期检查
+	if err := model.PublishKick(ctx, kick); err != nil {
+		slog.Error("通知游戏服务器踢人失败", "accid", accinfo.Accid, "err", err)
+	}
+	ReturnJson(c, 200, 200, "success", gin.H{"revoked": n})
+}
@@ -1,11 +1,28 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
+	"gameserver/admin"
+	"gameserver/identity"
+	"gameserver/ipfilter"
+	"gameserver/logger"
+	"gameserver/metrics"
 	"gameserver/model"
+	"gameserver/notify"
+	"gameserver/ratelimit"
+	"gameserver/tracing"
 	"gameserver/utils"
 	"github.com/gin-gonic/gin"
-	"strconv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -13,7 +30,7 @@ import (
 type RegisterC struct {
 	Account  string `form:"account" binding:"required,len=11"`
 	Password string `form:"password" binding:"required,min=6,nefield=Account"`
-	Sex      int    `gorm:"default:1" form:"sex" :"min=1,max=2"`
+	Sex      int    `gorm:"default:1" form:"sex"`
 }
 
 type LoginC struct {
@@ -21,37 +38,200 @@ type LoginC struct {
 	Password string `form:"password" binding:"required,min=6,nefield=Account"`
 }
 
+// -limit-config 指定的限速和黑白名单配置，字段和游戏服务器配置文件里的一样，可以直接用同一个文件
+type limitConfig struct {
+	RateLimit ratelimit.Config `yaml:"rate-limit"`
+	IPFilter  ipfilter.Config  `yaml:"ip-filter"`
+}
+
 // go的http服务器，用于玩家登录，获取jwt
 func main() {
-	r := gin.Default()
+	trusted := flag.String("trusted-proxies", "", "反向代理的网段，逗号分隔，从这些地址来的请求按 X-Forwarded-For/X-Real-IP 取客户端 IP")
+	logCfg := logger.DefaultConfig()
+	flag.StringVar(&logCfg.Level, "log-level", logCfg.Level, "日志级别：debug、info、warn、error")
+	flag.StringVar(&logCfg.Format, "log-format", logCfg.Format, "日志格式：json、text")
+	pprof := flag.Bool("pprof", false, "开启 /debug/pprof/，只允许本机访问")
+	traceCfg := tracing.DefaultConfig()
+	flag.StringVar(&traceCfg.Exporter, "trace-exporter", traceCfg.Exporter, "调用链导出方式：stdout、otlp，为空不开启")
+	flag.StringVar(&traceCfg.Endpoint, "trace-endpoint", traceCfg.Endpoint, "otlp collector 地址，默认 http://127.0.0.1:4318")
+	flag.Float64Var(&traceCfg.Ratio, "trace-ratio", traceCfg.Ratio, "调用链采样比例 0-1")
+	notifySpec := flag.String("notifier", "", "必填，找回密码验证码的发送方式：短信、邮件服务商注册的名字；log 写日志、file:<路径> 写文件，验证码是明文，只用于开发环境")
+	guestSecretKey := flag.String("guest-key", os.Getenv("GUEST_KEY"), "签游客密钥的服务器密钥，默认取环境变量 GUEST_KEY，为空不开放游客登录")
+	identityConfig := flag.String("identity-config", "", "第三方登录的配置文件，格式见 identity.example.yaml，为空不开放第三方登录")
+	flag.DurationVar(&tokenTTL, "token-ttl", tokenTTL, "登录 token 的有效期")
+	guestExpire := flag.Duration("guest-expire", 30*24*time.Hour, "游客多久没有登录又没有绑定账号就删掉，0 不清理")
+	limitFile := flag.String("limit-config", "", "限速和黑白名单的配置文件（yaml），用里面的 rate-limit 和 ip-filter，不指定时使用默认配置")
+	flag.Parse()
+	if err := logger.Setup(logCfg); err != nil {
+		slog.Error("日志配置错误", "err", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := tracing.Setup(traceCfg, "login")
+	if err != nil {
+		slog.Error("调用链追踪配置错误", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing()
+	if tokenTTL < time.Minute {
+		slog.Error("token 有效期不能小于 1 分钟", "ttl", tokenTTL)
+		os.Exit(1)
+	}
+	// 没有默认值，防止线上忘了配置，把验证码明文写进日志
+	if *notifySpec == "" {
+		slog.Error("没有配置找回密码验证码的发送方式，用 -notifier 指定")
+		os.Exit(1)
+	}
+	if notifier, err = notify.New(*notifySpec); err != nil {
+		slog.Error("通知方式配置错误", "err", err)
+		os.Exit(1)
+	}
+	if notify.Insecure(*notifySpec) {
+		slog.Warn("验证码会明文写出来，只能用于开发环境", "notifier", *notifySpec)
+	}
+	if *identityConfig != "" {
+		if err := identity.Load(*identityConfig); err != nil {
+			slog.Error("第三方登录配置错误", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("第三方登录", "providers", identity.Names())
+	}
+
+	// 请求日志由 MiddleWare 记录，不用 gin 自带的文本日志
+	r := gin.New()
+	r.Use(gin.Recovery())
+	// 默认信任所有代理，任何人都能用 X-Forwarded-For 伪造 IP 绕过限速和封禁
+	var proxies []string
+	if *trusted != "" {
+		proxies = strings.Split(*trusted, ",")
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		slog.Error("反向代理配置错误", "err", err)
+		os.Exit(1)
+	}
+	if err := loadLimits(*limitFile); err != nil {
+		slog.Error("限速配置错误", "file", *limitFile, "err", err)
+		os.Exit(1)
+	}
+	// 游戏服务器封禁的 IP 登录服务器也拒绝
+	ratelimit.Bans.UseStore(model.IPBanStore{}, 5*time.Second)
+
+	// 健康检查、指标和 pprof 在限速中间件之前注册，负载均衡和监控的请求不受限速影响
+	admin.AddCheck("mysql", model.PingMySQL)
+	admin.AddCheck("redis", model.PingRedis)
+	adminHandler, err := admin.Handler(admin.Config{Pprof: *pprof})
+	if err != nil {
+		slog.Error("管理接口配置错误", "err", err)
+		os.Exit(1)
+	}
+	r.GET("/healthz", gin.WrapH(adminHandler))
+	r.GET("/readyz", gin.WrapH(adminHandler))
+	r.GET("/metrics", gin.WrapH(adminHandler))
+	r.Any("/debug/pprof/*path", gin.WrapH(adminHandler))
 
 	// 注册中间件
+	r.Use(Tracing())
 	r.Use(MiddleWare())
+	r.Use(RateLimit())
 	r.GET("/check_account", CheckAccountFunc)
 	r.GET("/register", RegisterFunc)
 	r.GET("/login", LoginFunc)
-	r.GET("/get_token", GetTokenFunc)
+	r.GET("/server_status", ServerStatusFunc)
+	r.POST("/change_password", ChangePasswordFunc)
+	r.POST("/reset_password/code", ResetCodeFunc)
+	r.POST("/reset_password", ResetPasswordFunc)
+	v1 := r.Group("/api/v1")
+	v1.POST("/logout", LogoutFunc)
+	if *guestSecretKey != "" {
+		guestKey = []byte(*guestSecretKey)
+		v1.POST("/guest", GuestFunc)
+		v1.POST("/guest/bind", GuestBindFunc)
+		if *guestExpire > 0 {
+			go cleanGuests(*guestExpire)
+		}
+	} else {
+		slog.Warn("没有设置游客密钥，不开放游客登录")
+	}
+	if *identityConfig != "" {
+		v1.POST("/identity/login", IdentityLoginFunc)
+		v1.POST("/identity/link", IdentityLinkFunc)
+		v1.POST("/identity/unlink", IdentityUnlinkFunc)
+	}
 
-	r.Run(":8080")
+	if err := r.Run(":8080"); err != nil {
+		slog.Error("http服务器退出", "err", err)
+	}
 }
 
 // 定义中间件
 func MiddleWare() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 打印访问来源信息
-		fp := c.FullPath()
-		fmt.Println(fp)
+		// 记录访问来源和结果，参数里有密码，只记路径
+		start := time.Now()
+		c.Next()
+		slog.Info("http请求", "path", c.FullPath(), "ip", c.ClientIP(), "status", c.Writer.Status(), "latency", time.Since(start),
+			"trace_id", tracing.TraceID(c.Request.Context()))
+	}
+}
+
+// 每个请求一个 span，请求头带了 traceparent 时接在客户端的调用链后面
+// 处理函数查数据库、redis 时传 c.Request.Context()，调用都挂在这个 span 下面
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracing.Start(tracing.ExtractHTTP(c.Request), "HTTP "+c.Request.Method+" "+c.FullPath(),
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.route", c.FullPath()),
+			attribute.String("client.address", c.ClientIP()),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
 		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
 	}
 }
 
+// 按 IP 过滤和限速，和游戏服务器共用同一套黑白名单、封禁和限速
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, reason := ipfilter.Check(c.ClientIP()); !ok {
+			if reason == ipfilter.ReasonDenied || reason == ipfilter.ReasonNotAllowed {
+				ReturnJson(c, 403, 403, reason, "")
+				c.Abort()
+				return
+			}
+			ReturnJson(c, 429, 429, reason, "")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// loadLimits 读取限速和黑白名单配置并生效，path 为空时使用默认配置
+func loadLimits(path string) error {
+	cfg := limitConfig{RateLimit: ratelimit.DefaultConfig()}
+	if path != "" {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(bs, &cfg); err != nil {
+			return err
+		}
+	}
+	ratelimit.Setup(cfg.RateLimit)
+	return ipfilter.Setup(cfg.IPFilter)
+}
+
 // 统一返回json数据
 func ReturnJson(c *gin.Context, httpcode int, code int, msg string, data interface{}) {
-	fmt.Println("返回数据", gin.H{
-		"code": code,
-		"msg":  msg,
-		"data": data,
-	})
+	// data 里可能有 token，不记录
+	slog.Debug("返回数据", "path", c.FullPath(), "code", code, "msg", msg)
+	// 业务错误码也记在 span 上，登录失败的调用链能按 code 筛出来
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.Int("code", code))
 	c.JSON(httpcode, gin.H{
 		"code": code,
 		"msg":  msg,
@@ -72,8 +252,8 @@ func CheckAccountFunc(c *gin.Context) {
 		ReturnJson(c, 200, 101, "account is null", data)
 	} else {
 		// 从数据库查询是否存在相通的account，这里可以进行缓存
-		fmt.Println("account：", account)
-		accountinfo, err := model.GetAccountInfo(account)
+		slog.Debug("检查账号", "account", account)
+		accountinfo, err := model.GetAccountInfo(c.Request.Context(), account)
 		// 如果没有查到
 		if err != nil {
 			ReturnJson(c, 200, 102, "mysql select error", "")
@@ -90,12 +270,14 @@ func CheckAccountFunc(c *gin.Context) {
 
 func RegisterFunc(c *gin.Context) {
 	var registerc RegisterC
-	if err := c.ShouldBindQuery(&registerc); err != nil {
+	// 游客、第三方登录的账号名不能注册
+	if err := c.ShouldBindQuery(&registerc); err != nil || model.ReservedName(registerc.Account) {
 		ReturnJson(c, 200, 101, "params error", "")
 		return
 	}
 	// 判断是否注册过了
-	accinfo, err := model.GetAccountInfo(registerc.Account)
+	ctx := c.Request.Context()
+	accinfo, err := model.GetAccountInfo(ctx, registerc.Account)
 	if err == nil {
 		if len(accinfo) > 0 {
 			ReturnJson(c, 200, 102, "account is exists", "")
@@ -112,8 +294,8 @@ func RegisterFunc(c *gin.Context) {
 	account.Password = utils.GetMd5String([]byte(registerc.Password)) // md5加密
 	account.Sex = registerc.Sex
 	account.Sign_time = time.Now().Format("2006:01:02 15:04:05")
-	fmt.Println("account信息：", account)
-	lastid, err := model.InsertAccount(account)
+	slog.Info("注册账号", "account", account)
+	lastid, err := model.InsertAccount(ctx, account)
 	if err != nil {
 		ReturnJson(c, 200, 103, "mysql insert error", "")
 	} else {
@@ -125,76 +307,124 @@ func LoginFunc(c *gin.Context) {
 	// 获取参数，进行判断
 	var loginc LoginC
 	if err := c.ShouldBindQuery(&loginc); err != nil {
+		metrics.Login("http", 101)
 		ReturnJson(c, 200, 101, "params error", "")
 		return
 	}
 	// 判断是否注册过了
-	accinfo, err := model.GetAccountInfo(loginc.Account)
+	ctx := c.Request.Context()
+	accinfo, err := model.GetAccountInfo(ctx, loginc.Account)
 	if err == nil {
 		if accinfo == nil {
+			metrics.Login("http", 102)
 			ReturnJson(c, 200, 102, "account is not register", "")
 			return
 		}
 	} else {
+		metrics.Login("http", 103)
 		ReturnJson(c, 200, 103, "get account error", "")
 		return
 	}
 
 	// 判断密码
 	if utils.GetMd5String([]byte(loginc.Password)) != accinfo[0].Password {
+		metrics.Login("http", 104)
 		ReturnJson(c, 200, 104, "password error", "")
 		return
 	}
 
+	if refuseStatus(c, accinfo[0]) {
+		return
+	}
+	data, ok := loginSuccess(c, accinfo[0])
+	if !ok {
+		return
+	}
+	metrics.Login("http", 0)
+	ReturnJson(c, 200, 200, "success", data)
+}
+
+// 登录成功后返回的 token 和游戏服务器信息
+type LoginData struct {
+	Host         string
+	Port         string
+	Accid        int
+	Token        string
+	TokenExpires int64 // token 的过期时间，unix 秒
+	Maintenance  *model.Maintenance
+}
+
+// 封禁、停封、待注销的账号不发 token，停封时带上解封时间，永久封禁时 until 为 0，已经返回错误时返回 true
+func refuseStatus(c *gin.Context, accinfo model.Account) bool {
+	switch accinfo.CurrentStatus() {
+	case model.AccountSuspended:
+		metrics.Login("http", 107)
+		ReturnJson(c, 200, 107, "account banned", gin.H{"reason": accinfo.Status_reason, "until": accinfo.Status_until})
+		return true
+	case model.AccountBanned:
+		metrics.Login("http", 107)
+		ReturnJson(c, 200, 107, "account banned", gin.H{"reason": accinfo.Status_reason, "until": 0})
+		return true
+	case model.AccountPendingDeletion:
+		metrics.Login("http", 108)
+		ReturnJson(c, 200, 108, "account pending deletion", gin.H{"reason": accinfo.Status_reason})
+		return true
+	}
+	return false
+}
+
+// 登录成功：写登录日志，生成 token，返回要连接的游戏服务器，失败时已经返回了错误
+func loginSuccess(c *gin.Context, accinfo model.Account) (*LoginData, bool) {
+	ctx := c.Request.Context()
 	// 登录成功写入日志
+	slog.Info("登录成功", "accid", accinfo.Accid, "ip", c.ClientIP())
 	var logininfo model.AccountLogin
-	logininfo.Accid = accinfo[0].Accid
+	logininfo.Accid = accinfo.Accid
 	logininfo.Login_time = time.Now().Format("2006:01:02 15:04:05")
-	_, err = model.InsertLogin(logininfo)
-
-	// 判断是否登录过了，有token
-	var tokenname = "token_" + accinfo[0].Account
-	//_, rerr := model.GetRedisString(tokenname)
-	//if rerr != false {
-	//	ReturnJson(c, 200, 105, "login repeat", "")
-	//	return
-	//}
-
-	// 登录成功连接redis，生成一个token保存起来
-	// 用accid和当前时间生成token
-	var token = accinfo[0].Account + strconv.Itoa(int(time.Now().Unix()))
-	result := model.SetRedis(tokenname, token)
-	if result == false {
-		fmt.Println("token 设置失败")
+	_, _ = model.InsertLogin(ctx, logininfo)
+
+	// 每次登录发一个新 token，之前设备上的 token 继续有效
+	token, err := model.IssueToken(ctx, accinfo.Account, tokenTTL)
+	if err != nil {
+		slog.Error("token 设置失败", "accid", accinfo.Accid, "err", err)
+		metrics.Login("http", 106)
 		ReturnJson(c, 200, 106, "login error", "")
-		return
+		return nil, false
 	}
 
 	// 根据分服或者其他的，返回当前请求账号需要连接的TCP服务器信息
+	// 区服在维护时带上维护信息，客户端直接提示，不用连上去再被拒绝
+	return &LoginData{
+		Host:         "127.0.0.1",
+		Port:         "20001",
+		Accid:        accinfo.Accid,
+		Token:        token,
+		TokenExpires: time.Now().Add(tokenTTL).Unix(),
+		Maintenance:  maintenance(ctx),
+	}, true
+}
+
+// 区服状态，客户端在选服界面展示
+func ServerStatusFunc(c *gin.Context) {
 	var data = struct {
-		Host  string
-		Port  string
-		Accid int
+		Status      string
+		Maintenance *model.Maintenance
 	}{
-		Host:  "127.0.0.1",
-		Port:  "20001",
-		Accid: accinfo[0].Accid,
+		Status:      "normal",
+		Maintenance: maintenance(c.Request.Context()),
+	}
+	if data.Maintenance != nil {
+		data.Status = "maintenance"
 	}
 	ReturnJson(c, 200, 200, "success", data)
 }
 
-func GetTokenFunc(c *gin.Context) {
-	account := c.Query("account")
-	if account == "" {
-		ReturnJson(c, 200, 101, "account is null", "")
-	} else {
-		// 从redis查询token
-		var tokenname = "token_" + account
-		result, err := model.GetRedisString(tokenname)
-		if err == false {
-			ReturnJson(c, 200, 102, "get token error", "")
-		} else {
-			ReturnJson(c, 200, 200, "success", result)
-		}
+// 读取和游戏服务器同一份维护状态，读取失败时当作正常
+func maintenance(ctx context.Context) *model.Maintenance {
+	m, err := model.GetMaintenance(ctx)
+	if err != nil {
+		slog.Error("读取维护状态失败", "err", err)
+		return nil
 	}
+	return m
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"gameserver/model"
+	"gameserver/notify"
+	"gameserver/protocol"
+	"gameserver/utils"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"math/big"
+	"time"
+)
+
+// 找回密码的验证码
+const (
+	resetCodeTTL      = 10 * time.Minute // 有效期
+	resetCodeCooldown = time.Minute      // 同一个账号多久能再发一次
+	resetCodeAttempts = 5                // 同一个验证码最多试几次
+	resetFailLimit    = 10               // 同一个账号在 resetFailWindow 内最多输错几次，换了验证码也累计
+	resetFailWindow   = time.Hour
+)
+
+// 发验证码的方式，启动时按 -notifier 创建
+var notifier notify.Notifier
+
+// 修改密码
+type ChangePasswordC struct {
+	Account     string `form:"account" binding:"required,len=11"`
+	OldPassword string `form:"old_password" binding:"required,min=6"`
+	NewPassword string `form:"new_password" binding:"required,min=6,nefield=Account,nefield=OldPassword"`
+}
+
+// 申请找回密码的验证码
+type ResetCodeC struct {
+	Account string `form:"account" binding:"required,len=11"`
+}
+
+// 用验证码重设密码
+type ResetPasswordC struct {
+	Account     string `form:"account" binding:"required,len=11"`
+	Code        string `form:"code" binding:"required,len=6,numeric"`
+	NewPassword string `form:"new_password" binding:"required,min=6,nefield=Account"`
+}
+
+// 用旧密码改新密码，改完之后旧的 token 作废，在线的会话踢下线，要重新登录
+func ChangePasswordFunc(c *gin.Context) {
+	var changec ChangePasswordC
+	if err := c.ShouldBind(&changec); err != nil {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	accinfo, ok := findAccount(c, changec.Account)
+	if !ok {
+		return
+	}
+	if utils.GetMd5String([]byte(changec.OldPassword)) != accinfo.Password {
+		ReturnJson(c, 200, 104, "password error", "")
+		return
+	}
+	// 和登录一样，密码对了之后再检查状态，不给猜密码的人透露账号状态
+	if refuseStatus(c, accinfo) {
+		return
+	}
+	if !setPassword(c, accinfo, changec.NewPassword, "change") {
+		return
+	}
+	ReturnJson(c, 200, 200, "success", "")
+}
+
+// 给账号绑定的手机发找回密码的验证码
+func ResetCodeFunc(c *gin.Context) {
+	var codec ResetCodeC
+	// 游客和第三方登录的账号名不是手机号，不能找回密码
+	if err := c.ShouldBind(&codec); err != nil || model.ReservedName(codec.Account) {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	accinfo, ok := findAccount(c, codec.Account)
+	if !ok {
+		return
+	}
+	code, err := newResetCode()
+	if err != nil {
+		slog.Error("生成验证码失败", "err", err)
+		ReturnJson(c, 200, 111, "send code error", "")
+		return
+	}
+	if err := model.SaveResetCode(ctx, accinfo.Account, code, resetCodeTTL, resetCodeCooldown, resetFailLimit); err != nil {
+		if err == model.ErrCodeTooFrequent {
+			ReturnJson(c, 200, 110, "code too frequent", gin.H{"retry_after": int(resetCodeCooldown.Seconds())})
+			return
+		}
+		if err == model.ErrCodeLocked {
+			ReturnJson(c, 200, 122, "too many code errors", "")
+			return
+		}
+		slog.Error("保存验证码失败", "accid", accinfo.Accid, "err", err)
+		ReturnJson(c, 200, 111, "send code error", "")
+		return
+	}
+	err = notifier.Notify(ctx, &notify.Message{
+		To:      accinfo.Account,
+		Subject: "找回密码",
+		Text:    fmt.Sprintf("验证码 %s，%d 分钟内有效，不要告诉别人", code, int(resetCodeTTL.Minutes())),
+	})
+	if err != nil {
+		slog.Error("发送验证码失败", "accid", accinfo.Accid, "err", err)
+		ReturnJson(c, 200, 111, "send code error", "")
+		return
+	}
+	slog.Info("发送找回密码验证码", "accid", accinfo.Accid, "ip", c.ClientIP())
+	ReturnJson(c, 200, 200, "success", gin.H{"expires_in": int(resetCodeTTL.Seconds())})
+}
+
+// 用验证码重设密码，和修改密码一样作废 token 并踢下线
+func ResetPasswordFunc(c *gin.Context) {
+	var resetc ResetPasswordC
+	if err := c.ShouldBind(&resetc); err != nil || model.ReservedName(resetc.Account) {
+		ReturnJson(c, 200, 101, "params error", "")
+		return
+	}
+	ctx := c.Request.Context()
+	accinfo, ok := findAccount(c, resetc.Account)
+	if !ok {
+		return
+	}
+	if err := model.CheckResetCode(ctx, accinfo.Account, resetc.Code, resetCodeAttempts, resetFailLimit, resetFailWindow); err != nil {
+		slog.Warn("找回密码验证码错误", "accid", accinfo.Accid, "ip", c.ClientIP(), "err", err)
+		switch err {
+		case model.ErrCodeWrong:
+			ReturnJson(c, 200, 112, "code error", "")
+		case model.ErrCodeExpired:
+			ReturnJson(c, 200, 113, "code expired", "")
+		case model.ErrCodeLocked:
+			ReturnJson(c, 200, 122, "too many code errors", "")
+		default:
+			ReturnJson(c, 200, 111, "check code error", "")
+		}
+		return
+	}
+	if !setPassword(c, accinfo, resetc.NewPassword, "reset") {
+		return
+	}
+	ReturnJson(c, 200, 200, "success", "")
+}
+
+// findAccount 按账号查询，查不到时已经返回了错误
+func findAccount(c *gin.Context, account string) (model.Account, bool) {
+	accinfo, err := model.GetAccountInfo(c.Request.Context(), account)
+	if err != nil {
+		ReturnJson(c, 200, 103, "get account error", "")
+		return model.Account{}, false
+	}
+	if len(accinfo) == 0 {
+		ReturnJson(c, 200, 102, "account is not register", "")
+		return model.Account{}, false
+	}
+	return accinfo[0], true
+}
+
+// setPassword 保存新密码，作废 token，通知游戏服务器把在线的会话踢下线，失败时已经返回了错误
+func setPassword(c *gin.Context, accinfo model.Account, password string, how string) bool {
+	ctx := c.Request.Context()
+	if err := model.UpdatePassword(ctx, accinfo.Accid, utils.GetMd5String([]byte(password))); err != nil {
+		slog.Error("修改密码失败", "accid", accinfo.Accid, "err", err)
+		ReturnJson(c, 200, 109, "update password error", "")
+		return false
+	}
+	slog.Info("修改密码", "accid", accinfo.Accid, "how", how, "ip", c.ClientIP())
+	// 密码已经改了，后面失败只记日志
+	if _, err := model.RevokeAllTokens(ctx, accinfo.Account); err != nil {
+		slog.Error("作废token失败", "accid", accinfo.Accid, "err", err)
+	}
+	kick := &model.Kick{Node: "login", Accid: int64(accinfo.Accid), Code: protocol.ERR_KICKED, Reason: "password changed"}
+	if err := model.PublishKick(ctx, kick); err != nil {
+		slog.Error("通知游戏服务器踢人失败", "accid", accinfo.Accid, "err", err)
+	}
+	return true
+}
+
+// newResetCode 6 位数字验证码
+func newResetCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
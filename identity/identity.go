@@ -0,0 +1,151 @@
+package identity
+
+/**
+ * 第三方登录：客户端在平台上登录拿到 token，交给登录服务器，由对应的 Provider 校验并换成平台上的用户 ID
+ * 每个平台是配置文件里的一项，type 选实现，其余参数交给实现自己解析，支持 oidc 的平台只要加配置
+ * 不是 oidc 的平台实现一个 Provider，用 Register 注册后在配置里按 type 选
+ *
+ *	providers:
+ *	  - name: google
+ *	    type: oidc
+ *	    issuer: https://accounts.google.com
+ *	    client_id: xxx.apps.googleusercontent.com
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Identity 校验通过后的平台用户
+type Identity struct {
+	Provider string // 配置里的平台名
+	Subject  string // 平台上的用户 ID，同一个平台里唯一且不会变
+	Email    string // 平台给了才有，只用来记日志
+	Name     string
+}
+
+// Provider 校验客户端交上来的平台 token，实现要能并发调用
+type Provider interface {
+	Verify(ctx context.Context, token string) (*Identity, error)
+}
+
+// ProviderConfig 配置文件里的一个平台，除了 name、type 以外的参数都放在 Params 里
+type ProviderConfig struct {
+	Name   string            `yaml:"name"`
+	Type   string            `yaml:"type"`
+	Params map[string]string `yaml:",inline"`
+}
+
+// Config 第三方登录的配置文件
+type Config struct {
+	Providers []ProviderConfig `yaml:"providers"`
+}
+
+// Factory 按配置创建 Provider
+type Factory func(cfg ProviderConfig) (Provider, error)
+
+// ErrUnknownProvider 没有配置这个平台
+var ErrUnknownProvider = errors.New("不支持的登录平台")
+
+// 平台名会存进数据库，只能用小写字母、数字、下划线和减号
+var validName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{
+		"oidc": newOIDCProvider,
+	}
+	providers = map[string]Provider{}
+)
+
+// Register 注册一种平台实现，在 init 里调用
+func Register(typ string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[typ] = f
+}
+
+// Load 读取配置文件并创建所有平台，替换之前加载的
+func Load(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(bs, &cfg); err != nil {
+		return err
+	}
+	return Setup(cfg)
+}
+
+// Setup 按配置创建所有平台，有一个配置错误时都不生效
+func Setup(cfg Config) error {
+	created := make(map[string]Provider, len(cfg.Providers))
+	for _, pc := range cfg.Providers {
+		if !validName.MatchString(pc.Name) {
+			return fmt.Errorf("登录平台名 %q 只能用小写字母、数字、下划线和减号", pc.Name)
+		}
+		if _, ok := created[pc.Name]; ok {
+			return fmt.Errorf("登录平台 %s 重复配置", pc.Name)
+		}
+		mu.RLock()
+		f, ok := factories[pc.Type]
+		types := make([]string, 0, len(factories))
+		for t := range factories {
+			types = append(types, t)
+		}
+		mu.RUnlock()
+		if !ok {
+			sort.Strings(types)
+			return fmt.Errorf("登录平台 %s 的类型 %q 不支持，可以用 %s", pc.Name, pc.Type, strings.Join(types, "、"))
+		}
+		p, err := f(pc)
+		if err != nil {
+			return fmt.Errorf("登录平台 %s 配置错误：%w", pc.Name, err)
+		}
+		created[pc.Name] = p
+	}
+	mu.Lock()
+	providers = created
+	mu.Unlock()
+	return nil
+}
+
+// Names 已经配置的平台名
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Verify 用配置里的平台校验 token，没有这个平台时返回 ErrUnknownProvider
+func Verify(ctx context.Context, provider string, token string) (*Identity, error) {
+	mu.RLock()
+	p, ok := providers[provider]
+	mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	id, err := p.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if id.Subject == "" {
+		return nil, errors.New("平台没有返回用户 ID")
+	}
+	id.Provider = provider
+	return id, nil
+}
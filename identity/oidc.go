@@ -0,0 +1,414 @@
+package identity
+
+/**
+ * 通用的 OpenID Connect 平台：客户端交上来 id_token，按 issuer 的 discovery 文档取公钥校验签名和声明
+ *
+ *	issuer     必填，id_token 里的 iss 要和它一样
+ *	client_id  必填，我们在平台上的应用 ID，id_token 的 aud 要包含其中一个，多个用逗号分隔
+ *	jwks_uri   选填，不走 discovery 直接从这里取公钥
+ */
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLeeway         = time.Minute      // 校验时间时允许平台和我们的时钟差
+	oidcKeysTTL        = time.Hour        // 公钥缓存多久，平台轮换公钥后最晚这么久能取到
+	oidcRefreshLimit   = 10 * time.Second // 最快多久重新取一次公钥，不管上次成功没有，防止被伪造的 kid 或者平台故障刷
+	oidcHTTPTimeout    = 10 * time.Second
+	oidcMaxTokenLength = 16 << 10
+	oidcMaxBodyLength  = 1 << 20
+)
+
+var (
+	errTokenFormat   = errors.New("id_token 格式错误")
+	errTokenAlg      = errors.New("id_token 签名算法不支持")
+	errTokenKey      = errors.New("id_token 的公钥找不到")
+	errTokenSign     = errors.New("id_token 签名错误")
+	errTokenIssuer   = errors.New("id_token 签发方不对")
+	errTokenAudience = errors.New("id_token 不是发给我们的")
+	errTokenExpired  = errors.New("id_token 已过期")
+)
+
+// 支持的签名算法，不支持 none 和 HS*，HS* 要和平台共享密钥，公钥校验用不了
+// curve 是 EC 签名要求的曲线位数，RSA 为 0
+var oidcAlgs = map[string]struct {
+	hash  crypto.Hash
+	curve int
+}{
+	"RS256": {crypto.SHA256, 0},
+	"RS384": {crypto.SHA384, 0},
+	"RS512": {crypto.SHA512, 0},
+	"ES256": {crypto.SHA256, 256},
+	"ES384": {crypto.SHA384, 384},
+	"ES512": {crypto.SHA512, 521},
+}
+
+// OIDCProvider 通用的 OpenID Connect 平台
+type OIDCProvider struct {
+	issuer    string
+	clientIDs []string
+	jwksURI   string
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // kid -> 公钥
+	fetchedAt time.Time                   // 上次取成功的时间
+	triedAt   time.Time                   // 上次开始取的时间，失败了也记，按它限制频率
+	fetchErr  error                       // 上次取失败的原因，成功后清空
+	fetching  chan struct{}               // 正在取公钥时不为空，取完后关闭
+}
+
+func newOIDCProvider(cfg ProviderConfig) (Provider, error) {
+	return NewOIDCProvider(cfg.Params["issuer"], strings.Split(cfg.Params["client_id"], ","), cfg.Params["jwks_uri"])
+}
+
+// NewOIDCProvider issuer 和 clientIDs 必填，jwksURI 为空时从 discovery 文档里取
+// 创建时不访问平台，第一次校验时才取公钥，平台暂时连不上不影响启动
+func NewOIDCProvider(issuer string, clientIDs []string, jwksURI string) (*OIDCProvider, error) {
+	if issuer == "" {
+		return nil, errors.New("没有配置 issuer")
+	}
+	p := &OIDCProvider{
+		issuer:  issuer,
+		jwksURI: jwksURI,
+		client:  &http.Client{Timeout: oidcHTTPTimeout},
+	}
+	for _, id := range clientIDs {
+		if id = strings.TrimSpace(id); id != "" {
+			p.clientIDs = append(p.clientIDs, id)
+		}
+	}
+	if len(p.clientIDs) == 0 {
+		return nil, errors.New("没有配置 client_id")
+	}
+	return p, nil
+}
+
+// oidcHeader id_token 的头
+type oidcHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// oidcClaims 用到的 id_token 声明
+type oidcClaims struct {
+	Issuer    string       `json:"iss"`
+	Subject   string       `json:"sub"`
+	Audience  oidcAudience `json:"aud"`
+	Expires   float64      `json:"exp"`
+	NotBefore float64      `json:"nbf"`
+	Email     string       `json:"email"`
+	Name      string       `json:"name"`
+}
+
+// oidcAudience aud 可以是字符串也可以是数组
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// Verify 校验 id_token 的签名、签发方、接收方和有效期
+func (p *OIDCProvider) Verify(ctx context.Context, token string) (*Identity, error) {
+	if len(token) > oidcMaxTokenLength {
+		return nil, errTokenFormat
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenFormat
+	}
+	var header oidcHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenFormat
+	}
+	alg, ok := oidcAlgs[header.Alg]
+	if !ok {
+		return nil, errTokenAlg
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenFormat
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(key, alg.hash, alg.curve, h.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenFormat
+	}
+	if claims.Issuer != p.issuer {
+		return nil, errTokenIssuer
+	}
+	if !p.audienceOK(claims.Audience) {
+		return nil, errTokenAudience
+	}
+	now := time.Now()
+	if claims.Expires == 0 || now.After(unixTime(claims.Expires).Add(oidcLeeway)) {
+		return nil, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(oidcLeeway).Before(unixTime(claims.NotBefore)) {
+		return nil, errTokenExpired
+	}
+	return &Identity{Subject: claims.Subject, Email: claims.Email, Name: claims.Name}, nil
+}
+
+func (p *OIDCProvider) audienceOK(aud oidcAudience) bool {
+	for _, a := range aud {
+		for _, id := range p.clientIDs {
+			if a == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key 按 kid 取公钥，缓存过期或者遇到不认识的 kid 时重新取
+// kid 为空时只有平台只有一个公钥才能用
+// 同一时间只有一个请求去平台取，其他请求等它的结果，不持有锁，取失败了在 oidcRefreshLimit 之内不再重试
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	if k := pickKey(p.keys, kid); k != nil && time.Since(p.fetchedAt) <= oidcKeysTTL {
+		p.mu.Unlock()
+		return k, nil
+	}
+	wait := p.fetching
+	if wait == nil && time.Since(p.triedAt) > oidcRefreshLimit {
+		wait = make(chan struct{})
+		p.fetching = wait
+		p.triedAt = time.Now()
+		go p.refresh(wait)
+	}
+	p.mu.Unlock()
+
+	if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 平台暂时连不上时继续用旧的公钥
+	if k := pickKey(p.keys, kid); k != nil {
+		return k, nil
+	}
+	if p.fetchErr != nil {
+		return nil, p.fetchErr
+	}
+	return nil, errTokenKey
+}
+
+// refresh 取一次公钥，不跟着某个请求的 ctx，请求取消了其他等待的请求还能拿到结果
+func (p *OIDCProvider) refresh(done chan struct{}) {
+	keys, err := p.fetchKeys(context.Background())
+	p.mu.Lock()
+	if err == nil {
+		p.keys = keys
+		p.fetchedAt = time.Now()
+	}
+	p.fetchErr = err
+	p.fetching = nil
+	p.mu.Unlock()
+	close(done)
+}
+
+func pickKey(keys map[string]crypto.PublicKey, kid string) crypto.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k
+		}
+	}
+	return keys[kid]
+}
+
+// fetchKeys 取平台的公钥，没有配置 jwks_uri 时先取 discovery 文档
+func (p *OIDCProvider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	uri := p.jwksURI
+	if uri == "" {
+		var doc struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := p.getJSON(ctx, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+			return nil, err
+		}
+		if doc.Issuer != p.issuer {
+			return nil, fmt.Errorf("discovery 文档的 issuer %q 和配置的不一样", doc.Issuer)
+		}
+		if doc.JWKSURI == "" {
+			return nil, errors.New("discovery 文档里没有 jwks_uri")
+		}
+		uri = doc.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, uri, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		// 加密用的公钥和解析不了的跳过
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("平台没有可用的公钥")
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("请求 %s 返回 %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBodyLength)).Decode(v)
+}
+
+// jwk 平台公钥，只支持 RSA 和 EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA 公钥的 e 不对")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("不支持的曲线 %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC 公钥不在曲线上")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("不支持的公钥类型 %s", k.Kty)
+}
+
+// verifySignature 公钥类型要和 alg 对得上，防止拿 RSA 公钥去验 EC 签名之类的混淆
+func verifySignature(key crypto.PublicKey, hash crypto.Hash, curve int, digest []byte, sig []byte) error {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if curve == 0 && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if curve == pub.Curve.Params().BitSize && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errTokenSign
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		return nil, errors.New("公钥参数为空")
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+func unixTime(f float64) time.Time {
+	return time.Unix(int64(f), 0)
+}
@@ -0,0 +1,309 @@
+package identity
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testClientID = "game-client"
+
+// testIssuer 用 httptest 模拟的平台，提供 discovery 文档和公钥
+type testIssuer struct {
+	srv      *httptest.Server
+	mu       sync.Mutex
+	keys     map[string]crypto.Signer // kid -> 私钥，公钥发布在 jwks 里
+	fail     bool                     // jwks 返回 500
+	jwksHits int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	ti := &testIssuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   ti.srv.URL,
+			"jwks_uri": ti.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.jwksHits, 1)
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		if ti.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var set []map[string]string
+		for kid, k := range ti.keys {
+			set = append(set, publicJWK(kid, k.Public()))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	})
+	ti.srv = httptest.NewServer(mux)
+	t.Cleanup(ti.srv.Close)
+	return ti
+}
+
+func (ti *testIssuer) setKeys(keys map[string]crypto.Signer) {
+	ti.mu.Lock()
+	ti.keys = keys
+	ti.mu.Unlock()
+}
+
+func (ti *testIssuer) setFail(fail bool) {
+	ti.mu.Lock()
+	ti.fail = fail
+	ti.mu.Unlock()
+}
+
+func (ti *testIssuer) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+	p, err := NewOIDCProvider(ti.srv.URL, []string{"other", testClientID}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// claims 默认有效的声明
+func (ti *testIssuer) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   ti.srv.URL,
+		"sub":   "user-1",
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"email": "user@example.com",
+	}
+}
+
+func publicJWK(kid string, pub crypto.PublicKey) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": enc(k.N.Bytes()), "e": enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name, "x": enc(k.X.FillBytes(make([]byte, size))), "y": enc(k.Y.FillBytes(make([]byte, size)))}
+	}
+	panic("不支持的公钥")
+}
+
+// signToken 按 alg 签一个 id_token，key 为 nil 时签名为空
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	input := enc(header) + "." + enc(body)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	return input + "." + enc(sig)
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func ecKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestOIDCVerify(t *testing.T) {
+	ti := newTestIssuer(t)
+	rk, ek, other := rsaKey(t), ecKey(t), rsaKey(t)
+	ti.setKeys(map[string]crypto.Signer{"rsa": rk, "ec": ek})
+	p := ti.provider(t)
+	ctx := context.Background()
+
+	claims := func(edit func(c map[string]interface{})) map[string]interface{} {
+		c := ti.claims()
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	// HS256 用 RSA 公钥当共享密钥签名，公钥是公开的，谁都能签
+	hsToken := func() string {
+		enc := base64.RawURLEncoding.EncodeToString
+		header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+		body, _ := json.Marshal(claims(nil))
+		input := enc(header) + "." + enc(body)
+		mac := hmac.New(sha256.New, rk.PublicKey.N.Bytes())
+		mac.Write([]byte(input))
+		return input + "." + enc(mac.Sum(nil))
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", signToken(t, "RS256", "rsa", rk, claims(nil)), nil},
+		{"ES256", signToken(t, "ES256", "ec", ek, claims(nil)), nil},
+		{"aud 数组", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["aud"] = []string{"x", testClientID} })), nil},
+		{"时钟差之内", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() })), nil},
+		{"错误的私钥", signToken(t, "RS256", "rsa", other, claims(nil)), errTokenSign},
+		{"alg none", signToken(t, "none", "rsa", nil, claims(nil)), errTokenAlg},
+		{"alg HS256", hsToken(), errTokenAlg},
+		{"RSA 公钥配 ES256", signToken(t, "ES256", "rsa", ek, claims(nil)), errTokenSign},
+		{"EC 公钥配 RS256", signToken(t, "RS256", "ec", rk, claims(nil)), errTokenSign},
+		{"iss 不对", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), errTokenIssuer},
+		{"aud 不对", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["aud"] = "someone-else" })), errTokenAudience},
+		{"没有 aud", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { delete(c, "aud") })), errTokenAudience},
+		{"已过期", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() })), errTokenExpired},
+		{"没有 exp", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { delete(c, "exp") })), errTokenExpired},
+		{"还没生效", signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(5 * time.Minute).Unix() })), errTokenExpired},
+		{"格式错误", "abc.def", errTokenFormat},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id, err := p.Verify(ctx, c.token)
+			if err != c.err {
+				t.Fatalf("返回 %v，应该是 %v", err, c.err)
+			}
+			if err == nil && (id.Subject == "" || id.Email != "user@example.com") {
+				t.Fatalf("用户信息不对：%+v", id)
+			}
+		})
+	}
+	// 签名之后改声明，签名就对不上了
+	tok := strings.Split(signToken(t, "RS256", "rsa", rk, claims(nil)), ".")
+	forged := strings.Split(signToken(t, "RS256", "rsa", rk, claims(func(c map[string]interface{}) { c["sub"] = "admin" })), ".")
+	tampered := tok[0] + "." + forged[1] + "." + tok[2]
+	if _, err := p.Verify(ctx, tampered); err != errTokenSign {
+		t.Fatalf("篡改声明后返回 %v", err)
+	}
+	// 所有用例只取了一次公钥
+	if n := atomic.LoadInt32(&ti.jwksHits); n != 1 {
+		t.Fatalf("取了 %d 次公钥", n)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	ti := newTestIssuer(t)
+	old, rotated := rsaKey(t), rsaKey(t)
+	ti.setKeys(map[string]crypto.Signer{"old": old})
+	p := ti.provider(t)
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, signToken(t, "RS256", "old", old, ti.claims())); err != nil {
+		t.Fatal(err)
+	}
+	ti.setKeys(map[string]crypto.Signer{"new": rotated})
+	newToken := signToken(t, "RS256", "new", rotated, ti.claims())
+
+	// 刚取过公钥，不认识的 kid 不会马上重新取，防止伪造的 kid 刷平台
+	if _, err := p.Verify(ctx, newToken); err != errTokenKey {
+		t.Fatalf("刚取过公钥时返回 %v", err)
+	}
+	if n := atomic.LoadInt32(&ti.jwksHits); n != 1 {
+		t.Fatalf("取了 %d 次公钥", n)
+	}
+
+	// 过了限制时间，遇到轮换后的 kid 重新取
+	p.mu.Lock()
+	p.triedAt = time.Now().Add(-oidcRefreshLimit - time.Second)
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, newToken); err != nil {
+		t.Fatalf("公钥轮换后返回 %v", err)
+	}
+	if n := atomic.LoadInt32(&ti.jwksHits); n != 2 {
+		t.Fatalf("取了 %d 次公钥", n)
+	}
+
+	// 轮换后仍然不存在的 kid
+	p.mu.Lock()
+	p.triedAt = time.Now().Add(-oidcRefreshLimit - time.Second)
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, signToken(t, "RS256", "unknown", rotated, ti.claims())); err != errTokenKey {
+		t.Fatalf("不存在的 kid 返回 %v", err)
+	}
+}
+
+func TestOIDCFetchFailure(t *testing.T) {
+	ti := newTestIssuer(t)
+	k := rsaKey(t)
+	ti.setKeys(map[string]crypto.Signer{"k": k})
+	p := ti.provider(t)
+	ctx := context.Background()
+	token := signToken(t, "RS256", "k", k, ti.claims())
+	if _, err := p.Verify(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缓存过期后平台出错，继续用旧的公钥
+	ti.setFail(true)
+	p.mu.Lock()
+	p.fetchedAt = time.Now().Add(-oidcKeysTTL - time.Second)
+	p.triedAt = p.fetchedAt
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, token); err != nil {
+		t.Fatalf("平台出错时没有用旧公钥：%v", err)
+	}
+	hits := atomic.LoadInt32(&ti.jwksHits)
+
+	// 失败之后限制时间内并发的请求都不会再去取
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Verify(ctx, token); err != nil {
+				t.Errorf("平台出错时没有用旧公钥：%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&ti.jwksHits); n != hits {
+		t.Fatalf("取失败后又取了 %d 次", n-hits)
+	}
+
+	// 从来没取成功过时返回取公钥的错误
+	fresh := ti.provider(t)
+	if _, err := fresh.Verify(ctx, token); err == nil || err == errTokenKey {
+		t.Fatalf("平台出错时返回 %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gameserver/model"
+	"log"
+	"net"
+	"time"
+)
+
+// IP 临时封禁工具，写入 redis 后所有游戏服务器和登录服务器几秒内生效
+//
+//	go run ./ipban -ban 1.2.3.4 -duration 1h   封禁1小时
+//	go run ./ipban -unban 1.2.3.4              解除封禁
+//	go run ./ipban                             查看所有封禁
+func main() {
+	ban := flag.String("ban", "", "要封禁的 IP")
+	unban := flag.String("unban", "", "要解除封禁的 IP")
+	duration := flag.Duration("duration", time.Hour, "封禁时长")
+	flag.Parse()
+
+	store := model.IPBanStore{}
+	switch {
+	case *ban != "":
+		if net.ParseIP(*ban) == nil {
+			log.Fatalln("IP格式错误", *ban)
+		}
+		until := time.Now().Add(*duration)
+		if err := store.Ban(*ban, until); err != nil {
+			log.Fatalln("封禁失败，", err)
+		}
+		fmt.Println("已封禁", *ban, "到", until.Format("2006-01-02 15:04:05"))
+	case *unban != "":
+		if err := store.Unban(*unban); err != nil {
+			log.Fatalln("解除封禁失败，", err)
+		}
+		fmt.Println("已解除封禁", *unban)
+	default:
+		bans, err := store.List()
+		if err != nil {
+			log.Fatalln("读取封禁列表失败，", err)
+		}
+		if len(bans) == 0 {
+			fmt.Println("没有封禁")
+			return
+		}
+		for ip, until := range bans {
+			fmt.Println(ip, "封禁到", until.Format("2006-01-02 15:04:05"))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package ipfilter
+
+/**
+ * 连接过滤：在为新连接启动处理协程之前检查来源 IP
+ * 依次检查网段黑名单、白名单、临时封禁、新连接频率和单个 IP 的并发连接数，被拒绝的按原因计数
+ */
+
+import (
+	"gameserver/ratelimit"
+	"net"
+	"sync"
+)
+
+// Config 连接过滤配置
+type Config struct {
+	Allow    []string `yaml:"allow"`      // 只允许这些网段（CIDR 或者单个 IP），为空时不限制
+	Deny     []string `yaml:"deny"`       // 拒绝这些网段，优先于 allow
+	MaxPerIP int      `yaml:"max-per-ip"` // 单个 IP 的最大并发连接数，0 表示不限制
+}
+
+// 拒绝原因，和 ratelimit 的原因一起计数
+const (
+	ReasonDenied     = "deny_list"     // 在黑名单网段里
+	ReasonNotAllowed = "not_allowed"   // 不在白名单网段里
+	ReasonConnLimit  = "ip_conn_limit" // 单个 IP 的连接数超过上限
+	ReasonBadAddr    = "bad_addr"      // 解析不出 IP
+)
+
+// Filter 连接过滤器，可以在多个goroutine里使用
+type Filter struct {
+	allow    Nets
+	deny     Nets
+	maxPerIP int
+
+	mu    sync.Mutex
+	conns map[string]int // IP -> 当前连接数
+}
+
+// 进程内 tcp、udp、websocket 共用的过滤器，没有配置时只检查封禁和频率
+var (
+	mu      sync.RWMutex
+	current = &Filter{conns: make(map[string]int)}
+)
+
+// New 按配置创建过滤器
+func New(cfg Config) (*Filter, error) {
+	f := &Filter{maxPerIP: cfg.MaxPerIP, conns: make(map[string]int)}
+	var err error
+	if f.allow, err = ParseNets(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = ParseNets(cfg.Deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Setup 使用新的配置，启动时调用
+func Setup(cfg Config) error {
+	f, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	current = f
+	mu.Unlock()
+	return nil
+}
+
+// Default 进程内共用的过滤器
+func Default() *Filter {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Accept 用共用的过滤器检查新连接
+func Accept(ip string) (release func(), reason string) {
+	return Default().Accept(ip)
+}
+
+// Check 用共用的过滤器检查一个 IP，不占用连接数，http 请求使用
+func Check(ip string) (ok bool, reason string) {
+	return Default().Check(ip)
+}
+
+// Check 检查网段、封禁和频率，不占用连接数
+func (f *Filter) Check(ip string) (bool, string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		ratelimit.Count(ReasonBadAddr)
+		return false, ReasonBadAddr
+	}
+	if f.deny.Contains(parsed) {
+		ratelimit.Count(ReasonDenied)
+		return false, ReasonDenied
+	}
+	if len(f.allow) > 0 && !f.allow.Contains(parsed) {
+		ratelimit.Count(ReasonNotAllowed)
+		return false, ReasonNotAllowed
+	}
+	return ratelimit.AllowIP(ip)
+}
+
+// Accept 检查新连接，通过时返回 release，连接结束后必须调用一次；被拒绝时 release 为 nil
+func (f *Filter) Accept(ip string) (release func(), reason string) {
+	if ok, reason := f.Check(ip); !ok {
+		return nil, reason
+	}
+	f.mu.Lock()
+	if f.maxPerIP > 0 && f.conns[ip] >= f.maxPerIP {
+		f.mu.Unlock()
+		ratelimit.Count(ReasonConnLimit)
+		return nil, ReasonConnLimit
+	}
+	f.conns[ip]++
+	f.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			if f.conns[ip]--; f.conns[ip] <= 0 {
+				delete(f.conns, ip)
+			}
+			f.mu.Unlock()
+		})
+	}, ""
+}
+
+// Conns 单个 IP 当前的连接数
+func (f *Filter) Conns(ip string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns[ip]
+}
@@ -0,0 +1,89 @@
+package ipfilter
+
+/**
+ * 网段列表和经过代理时的真实 IP
+ */
+
+import (
+	"errors"
+	"gameserver/ratelimit"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Nets 网段列表，配置里可以写 CIDR 或者单个 IP
+type Nets []*net.IPNet
+
+// ParseNets 解析网段列表，单个 IP 当作 /32 或者 /128
+func ParseNets(list []string) (Nets, error) {
+	nets := make(Nets, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("IP格式错误: " + s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains ip 是否在任意一个网段里
+func (n Nets) Contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr 和 Contains 一样，参数是 host:port 或者 IP 字符串
+func (n Nets) ContainsAddr(addr string) bool {
+	ip := net.ParseIP(ratelimit.Host(addr))
+	return ip != nil && n.Contains(ip)
+}
+
+// ForwardedIP 请求的真实客户端 IP
+// 只有直接连过来的是受信任的代理时，才看 X-Forwarded-For 和 X-Real-IP，不然谁都可以伪造
+// X-Forwarded-For 从右往左跳过受信任的代理，第一个不受信任的就是客户端
+func ForwardedIP(req *http.Request, trusted Nets) string {
+	ip := ratelimit.Host(req.RemoteAddr)
+	if len(trusted) == 0 || !trusted.ContainsAddr(ip) {
+		return ip
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop.String()
+			if !trusted.Contains(hop) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if real := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); real != nil {
+		return real.String()
+	}
+	return ip
+}
@@ -0,0 +1,91 @@
+package logger
+
+/**
+ * 结构化日志：基于 log/slog，支持级别、JSON 输出、热点日志采样和敏感字段脱敏
+ * Setup 之后直接用 slog 的函数记日志，标准库 log 的输出也会经过这里，按 info 级别记录
+ */
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config 日志配置
+type Config struct {
+	Level    string         `yaml:"level"`    // debug、info、warn、error，默认 info
+	Format   string         `yaml:"format"`   // json 或者 text，默认 json
+	Sampling SamplingConfig `yaml:"sampling"` // 同一条日志太多时只记录一部分
+}
+
+// SamplingConfig 采样配置，按级别和消息计数，error 级别不采样
+type SamplingConfig struct {
+	Tick       time.Duration `yaml:"tick"`       // 计数周期，0 表示不采样
+	Initial    int           `yaml:"initial"`    // 每个周期里同一条日志先记录这么多条
+	Thereafter int           `yaml:"thereafter"` // 之后每这么多条记录一条，0 表示这个周期里不再记录
+}
+
+// 这些字段的值不会出现在日志里，按字段名包含判断，不区分大小写
+var secretKeys = []string{"password", "passwd", "token", "secret", "authorization", "cookie"}
+
+// Redacted 脱敏后的值
+const Redacted = "***"
+
+// DefaultConfig 默认配置：info 级别，JSON 输出，同一条日志每秒最多 100 条，之后每 100 条记一条
+func DefaultConfig() Config {
+	return Config{
+		Level:  "info",
+		Format: "json",
+		Sampling: SamplingConfig{
+			Tick:       time.Second,
+			Initial:    100,
+			Thereafter: 100,
+		},
+	}
+}
+
+// Setup 按配置设置默认的日志，启动时调用
+func Setup(cfg Config) error {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return errors.New("日志级别错误: " + cfg.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return errors.New("日志格式错误: " + cfg.Format)
+	}
+	if cfg.Sampling.Tick > 0 {
+		h = newSampler(h, cfg.Sampling)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// redact 敏感字段的值替换掉
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if Secret(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// Secret 字段名是不是密码、token 这类敏感信息
+func Secret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sampler 同一条日志在一个周期里先记录 Initial 条，之后每 Thereafter 条记录一条
+// 每个包、每个连接都会走到的热点日志，出问题时不会把磁盘写满
+type sampler struct {
+	slog.Handler
+	cfg    SamplingConfig
+	counts *sync.Map // 级别+消息 -> *counter，With 派生出来的 handler 共用
+}
+
+type counter struct {
+	mu   sync.Mutex
+	tick int64
+	n    int
+}
+
+func newSampler(h slog.Handler, cfg SamplingConfig) *sampler {
+	return &sampler{Handler: h, cfg: cfg, counts: &sync.Map{}}
+}
+
+// Handle error 级别总是记录
+func (s *sampler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelError && !s.allow(r) {
+		return nil
+	}
+	return s.Handler.Handle(ctx, r)
+}
+
+func (s *sampler) allow(r slog.Record) bool {
+	key := r.Level.String() + r.Message
+	v, ok := s.counts.Load(key)
+	if !ok {
+		v, _ = s.counts.LoadOrStore(key, &counter{})
+	}
+	c := v.(*counter)
+	tick := r.Time.UnixNano() / int64(s.cfg.Tick)
+	if r.Time.IsZero() {
+		tick = time.Now().UnixNano() / int64(s.cfg.Tick)
+	}
+	c.mu.Lock()
+	if c.tick != tick {
+		c.tick = tick
+		c.n = 0
+	}
+	c.n++
+	n := c.n
+	c.mu.Unlock()
+	if n <= s.cfg.Initial {
+		return true
+	}
+	return s.cfg.Thereafter > 0 && (n-s.cfg.Initial)%s.cfg.Thereafter == 0
+}
+
+func (s *sampler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampler{Handler: s.Handler.WithAttrs(attrs), cfg: s.cfg, counts: s.counts}
+}
+
+func (s *sampler) WithGroup(name string) slog.Handler {
+	return &sampler{Handler: s.Handler.WithGroup(name), cfg: s.cfg, counts: s.counts}
+}
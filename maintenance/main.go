@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gameserver/model"
+	"log"
+	"time"
+)
+
+// 停服维护工具，写入 redis 后游戏服务器和登录服务器会自动读取
+//
+//	go run ./maintenance -after 10m -duration 2h -reason "版本更新"   10分钟后停服，维护2小时
+//	go run ./maintenance -cancel                                     取消或者提前结束维护
+//	go run ./maintenance                                             查看当前状态
+func main() {
+	after := flag.Duration("after", 0, "多久之后停服，在这之前给在线玩家倒计时")
+	duration := flag.Duration("duration", 0, "维护时长，从停服时间开始算")
+	reason := flag.String("reason", "", "维护原因，展示给玩家")
+	cancel := flag.Bool("cancel", false, "取消或者提前结束维护")
+	flag.Parse()
+	ctx := context.Background()
+
+	switch {
+	case *cancel:
+		if err := model.ClearMaintenance(ctx); err != nil {
+			log.Fatalln("取消维护失败，", err)
+		}
+		fmt.Println("维护已取消")
+	case *duration > 0:
+		shutdown := time.Now().Add(*after)
+		m := &model.Maintenance{
+			Reason:   *reason,
+			Shutdown: shutdown,
+			Until:    shutdown.Add(*duration),
+		}
+		if err := model.SetMaintenance(ctx, m); err != nil {
+			log.Fatalln("设置维护失败，", err)
+		}
+		fmt.Println("维护已发布，停服时间", m.Shutdown.Format("2006-01-02 15:04:05"), "预计结束", m.Until.Format("2006-01-02 15:04:05"))
+	default:
+		m, err := model.GetMaintenance(ctx)
+		if err != nil {
+			log.Fatalln("读取维护状态失败，", err)
+		}
+		if m == nil {
+			fmt.Println("没有维护")
+			return
+		}
+		fmt.Println("维护原因", m.Reason, "停服时间", m.Shutdown.Format("2006-01-02 15:04:05"), "预计结束", m.Until.Format("2006-01-02 15:04:05"))
+	}
+}
@@ -0,0 +1,131 @@
+package metrics
+
+/**
+ * Prometheus 指标，每个服务器进程在 /metrics 上暴露
+ * 计数类的指标在这里定义，由各个包直接更新；连接池、队列长度这类现成的数字在采集时读取
+ */
+
+import (
+	"gameserver/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// 所有指标的前缀
+const namespace = "gameserver"
+
+// 没有注册处理函数的命令都记在这个标签下，避免客户端乱发命令号把指标撑爆
+const UnknownCmd = "unknown"
+
+var (
+	// Sessions 当前连接数
+	Sessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sessions",
+		Help:      "当前连接数",
+	}, []string{"transport"})
+
+	// Accepts 通过过滤开始处理的连接数，被拒绝的按原因记在 rejected_total 里
+	Accepts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accepts_total",
+		Help:      "接受的连接数",
+	}, []string{"transport"})
+
+	// PacketsIn 收到的包
+	PacketsIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_in_total",
+		Help:      "收到的包，按主命令",
+	}, []string{"transport", "cmd"})
+
+	// PacketsOut 发出的包
+	PacketsOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_out_total",
+		Help:      "发出的包，按主命令",
+	}, []string{"transport", "cmd"})
+
+	// DecodeErrors 解包失败的次数
+	DecodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_errors_total",
+		Help:      "解包失败的次数",
+	}, []string{"transport"})
+
+	// HandlerSeconds 处理函数的耗时，不包括在工作协程池里排队的时间
+	HandlerSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_seconds",
+		Help:      "命令处理函数的耗时",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 15), // 0.5ms ~ 8s
+	}, []string{"cmd"})
+
+	// Logins 登录结果，code 为 0 表示成功
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "登录结果，code 为 0 表示成功",
+	}, []string{"server", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(rejectCollector{})
+}
+
+// Cmd 命令号转成标签
+func Cmd(cmd uint32) string {
+	return strconv.FormatUint(uint64(cmd), 10)
+}
+
+// Login 记录一次登录结果
+func Login(server string, code int) {
+	Logins.WithLabelValues(server, strconv.Itoa(code)).Inc()
+}
+
+// GaugeFunc 注册一个采集时读取的指标，同名的只注册第一次
+func GaugeFunc(name, help string, f func() float64) {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f)
+	if err := prometheus.Register(g); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			slog.Error("注册指标失败", "name", name, "err", err)
+		}
+	}
+}
+
+// Register 注册其他的采集器，比如数据库连接池，同一个采集器只注册第一次
+func Register(c prometheus.Collector) {
+	if err := prometheus.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			slog.Error("注册指标失败", "err", err)
+		}
+	}
+}
+
+// Handler /metrics 的处理函数
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// rejectCollector 被拒绝的连接、请求和消息，直接读 ratelimit 里按原因的计数
+type rejectCollector struct{}
+
+var rejectDesc = prometheus.NewDesc(namespace+"_rejected_total", "被拒绝的连接、请求和消息，按原因", []string{"reason"}, nil)
+
+func (rejectCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rejectDesc
+}
+
+func (rejectCollector) Collect(ch chan<- prometheus.Metric) {
+	for reason, n := range ratelimit.Stats() {
+		ch <- prometheus.MustNewConstMetric(rejectDesc, prometheus.CounterValue, float64(n), reason)
+	}
+}
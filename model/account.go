@@ -1,11 +1,17 @@
 package model
 
 import (
+	"context"
 	"fmt"
+	"gameserver/metrics"
+	"gameserver/tracing"
 	"gameserver/utils"
 	"github.com/davecgh/go-spew/spew"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 )
 
 // 定义表名-常量
@@ -14,6 +20,9 @@ const TABLE_ACCOUNT_LOGIN = "account_login"
 
 var Db *sqlx.DB
 
+// 查询账号时的字段
+const accountColumns = "accid,account,password,sex,sign_time,status,status_reason,status_operator,status_until,guest"
+
 // 账号表结构
 type Account struct {
 	Accid     int    `db:"accid"`
@@ -21,6 +30,27 @@ type Account struct {
 	Password  string `db:"password"`
 	Sex       int    `db:"sex"`
 	Sign_time string `db:"sign_time"`
+
+	// 账号状态，见 accstatus.go
+	Status          string `db:"status"`
+	Status_reason   string `db:"status_reason"`
+	Status_operator string `db:"status_operator"`
+	Status_until    int64  `db:"status_until"`
+
+	// 游客，见 guest.go
+	Guest int `db:"guest"`
+}
+
+// LogValue 记日志时不带密码
+func (a Account) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("accid", a.Accid),
+		slog.String("account", a.Account),
+		slog.Int("sex", a.Sex),
+		slog.String("sign_time", a.Sign_time),
+		slog.String("status", a.Status),
+		slog.Bool("guest", a.Guest == 1),
+	)
 }
 
 // 账号登录表结构
@@ -32,18 +62,23 @@ type AccountLogin struct {
 
 func init() {
 	var err error
-	Db, err = sqlx.Connect("mysql", "jerry:jerry123@tcp(42.193.50.38:3306)/snake?charset=utf8")
+	// tcp 和 websocket 服务器也会引用 model，加上连接超时，数据库连不上时不会卡住启动
+	Db, err = sqlx.Connect("mysql", "jerry:jerry123@tcp(42.193.50.38:3306)/snake?charset=utf8&timeout=5s")
 	if err != nil {
 		// 数据库连接失败
-		fmt.Println("open mysql failed,", err)
+		slog.Error("连接mysql失败", "err", err)
 		return
 	}
 	Db.SetMaxOpenConns(100) // 设置数据库连接池的最大连接数
 	Db.SetMaxIdleConns(50)  // 设置最大空闲连接数
+	// 连接池的使用情况：打开、使用中、空闲的连接数和等待次数
+	metrics.Register(collectors.NewDBStatsCollector(Db.DB, "snake"))
 }
 
 // 获取账号信息
-func GetAccountInfo(acc string) ([]Account, error) {
+func GetAccountInfo(ctx context.Context, acc string) (account []Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccountInfo", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
 	var where []string
 	if acc != "" {
 		where = append(where, spew.Sprintf("account='%s'", acc))
@@ -53,25 +88,26 @@ func GetAccountInfo(acc string) ([]Account, error) {
 		wheres = "where " + utils.GetWheres(where)
 	}
 
-	var account []Account
-	err := Db.Select(&account, fmt.Sprintf("select accid,account,password,sex,sign_time from %s %s", TABLE_ACCOUNT, wheres))
+	err = Db.SelectContext(ctx, &account, fmt.Sprintf("select %s from %s %s", accountColumns, TABLE_ACCOUNT, wheres))
 	return account, err
 }
 
 // 注册账号，写入
-func InsertAccount(accinfo Account) (int64, error) {
-	conn, err := Db.Begin()
+func InsertAccount(ctx context.Context, accinfo Account) (id int64, err error) {
+	ctx, span := startSpan(ctx, "InsertAccount", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	conn, err := Db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 
 	// 当前时间
-	r, err := conn.Exec("insert into account(accid, account, password, sex, sign_time)values(null, ?, ?, ?, ?)", accinfo.Account, accinfo.Password, accinfo.Sex, accinfo.Sign_time)
+	r, err := conn.ExecContext(ctx, "insert into account(accid, account, password, sex, sign_time)values(null, ?, ?, ?, ?)", accinfo.Account, accinfo.Password, accinfo.Sex, accinfo.Sign_time)
 	if err != nil {
 		conn.Rollback()
 		return 0, err
 	}
-	id, err := r.LastInsertId()
+	id, err = r.LastInsertId()
 	if err != nil {
 		conn.Rollback()
 		return 0, err
@@ -82,19 +118,21 @@ func InsertAccount(accinfo Account) (int64, error) {
 }
 
 // 账号登录
-func InsertLogin(logininfo AccountLogin) (int64, error) {
-	conn, err := Db.Begin()
+func InsertLogin(ctx context.Context, logininfo AccountLogin) (id int64, err error) {
+	ctx, span := startSpan(ctx, "InsertLogin", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_LOGIN))
+	defer func() { tracing.End(span, err) }()
+	conn, err := Db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 
 	// 当前时间
-	r, err := conn.Exec("insert into account_login(id, accid, login_time)values(null, ?, ?)", logininfo.Accid, logininfo.Login_time)
+	r, err := conn.ExecContext(ctx, "insert into account_login(id, accid, login_time)values(null, ?, ?)", logininfo.Accid, logininfo.Login_time)
 	if err != nil {
 		conn.Rollback()
 		return 0, err
 	}
-	id, err := r.LastInsertId()
+	id, err = r.LastInsertId()
 	if err != nil {
 		conn.Rollback()
 		return 0, err
@@ -103,3 +141,14 @@ func InsertLogin(logininfo AccountLogin) (int64, error) {
 
 	return id, nil
 }
+
+// 修改密码，password 是加密之后的
+func UpdatePassword(ctx context.Context, accid int, password string) (err error) {
+	ctx, span := startSpan(ctx, "UpdatePassword", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	_, err = Db.ExecContext(ctx, "update account set password=? where accid=?", password, accid)
+	return err
+}
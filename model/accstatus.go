@@ -0,0 +1,144 @@
+package model
+
+/**
+ * 账号状态：正常、停封到某个时间、永久封禁、待注销，每次修改都记一条历史
+ * 登录服务器和游戏服务器登录时检查，修改时在线的会话由 GM 操作通过 PublishKick 踢下线
+ *
+ *	alter table account
+ *	  add column status          varchar(20)  not null default 'active',
+ *	  add column status_reason   varchar(255) not null default '',
+ *	  add column status_operator varchar(64)  not null default '',
+ *	  add column status_until    bigint       not null default 0;  -- 停封的解封时间，unix 秒
+ *
+ *	create table account_status_log (
+ *	  id         bigint unsigned not null auto_increment primary key,
+ *	  accid      int          not null,
+ *	  status     varchar(20)  not null,
+ *	  reason     varchar(255) not null,
+ *	  operator   varchar(64)  not null,
+ *	  until      bigint       not null,
+ *	  created_at datetime     not null,
+ *	  key idx_accid (accid, id)
+ *	) default charset=utf8mb4;
+ */
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gameserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+// 定义表名-常量
+const TABLE_ACCOUNT_STATUS_LOG = "account_status_log"
+
+// 账号状态
+const (
+	AccountActive          = "active"           // 正常
+	AccountSuspended       = "suspended"        // 停封，到 status_until 自动恢复
+	AccountBanned          = "banned"           // 永久封禁
+	AccountPendingDeletion = "pending_deletion" // 待注销，恢复之前不能登录
+)
+
+var (
+	// ErrAccountNotFound 账号不存在
+	ErrAccountNotFound = errors.New("账号不存在")
+	// ErrBadStatus 不认识的账号状态
+	ErrBadStatus = errors.New("账号状态错误")
+)
+
+// AccountStatusLog 账号状态修改历史表结构
+type AccountStatusLog struct {
+	Id         int64  `db:"id" json:"id"`
+	Accid      int    `db:"accid" json:"accid"`
+	Status     string `db:"status" json:"status"`
+	Reason     string `db:"reason" json:"reason"`
+	Operator   string `db:"operator" json:"operator"`
+	Until      int64  `db:"until" json:"until,omitempty"` // 停封的解封时间，unix 秒
+	Created_at string `db:"created_at" json:"created_at"`
+}
+
+// CurrentStatus 账号现在的状态，停封到期后就是正常，不用等人去改
+func (a Account) CurrentStatus() string {
+	if a.Status == "" || (a.Status == AccountSuspended && a.Status_until <= time.Now().Unix()) {
+		return AccountActive
+	}
+	return a.Status
+}
+
+// ValidAccountStatus 是不是认识的状态
+func ValidAccountStatus(status string) bool {
+	switch status {
+	case AccountActive, AccountSuspended, AccountBanned, AccountPendingDeletion:
+		return true
+	}
+	return false
+}
+
+// GetAccountByAccid 按账号ID查账号，不存在时返回 ErrAccountNotFound
+func GetAccountByAccid(ctx context.Context, accid int64) (account Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccountByAccid", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT), attribute.Int64("accid", accid))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return Account{}, ErrNoMySQL
+	}
+	err = Db.GetContext(ctx, &account, fmt.Sprintf("select %s from %s where accid=?", accountColumns, TABLE_ACCOUNT), accid)
+	if err == sql.ErrNoRows {
+		return Account{}, ErrAccountNotFound
+	}
+	return account, err
+}
+
+// SetAccountStatus 修改账号状态，同时记一条历史，l.Accid 不存在时返回 ErrAccountNotFound
+func SetAccountStatus(ctx context.Context, l AccountStatusLog) (err error) {
+	ctx, span := startSpan(ctx, "SetAccountStatus", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT), attribute.Int("accid", l.Accid))
+	defer func() { tracing.End(span, err) }()
+	if !ValidAccountStatus(l.Status) {
+		return ErrBadStatus
+	}
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	conn, err := Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.Rollback()
+		}
+	}()
+
+	// 状态没变时 update 的影响行数是 0，先锁住这一行确认账号存在
+	var accid int
+	if err = conn.GetContext(ctx, &accid, "select accid from account where accid=? for update", l.Accid); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrAccountNotFound
+		}
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "update account set status=?, status_reason=?, status_operator=?, status_until=? where accid=?", l.Status, l.Reason, l.Operator, l.Until, l.Accid); err != nil {
+		return err
+	}
+	if l.Created_at == "" {
+		l.Created_at = time.Now().Format("2006-01-02 15:04:05")
+	}
+	if _, err = conn.ExecContext(ctx, "insert into account_status_log(accid, status, reason, operator, until, created_at)values(?, ?, ?, ?, ?, ?)", l.Accid, l.Status, l.Reason, l.Operator, l.Until, l.Created_at); err != nil {
+		return err
+	}
+	return conn.Commit()
+}
+
+// GetAccountStatusLog 账号最近 limit 次状态修改，按时间倒序
+func GetAccountStatusLog(ctx context.Context, accid int64, limit int) (logs []AccountStatusLog, err error) {
+	ctx, span := startSpan(ctx, "GetAccountStatusLog", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_STATUS_LOG), attribute.Int64("accid", accid))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return nil, ErrNoMySQL
+	}
+	err = Db.SelectContext(ctx, &logs, "select id,accid,status,reason,operator,until,created_at from account_status_log where accid=? order by id desc limit ?", accid, limit)
+	return logs, err
+}
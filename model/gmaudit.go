@@ -0,0 +1,76 @@
+package model
+
+/**
+ * GM 操作记录，管理接口和 GM 控制台的每一次操作都写一条，成功失败都记
+ *
+ *	create table gm_audit (
+ *	  id         bigint unsigned not null auto_increment primary key,
+ *	  operator   varchar(64)   not null,
+ *	  source     varchar(16)   not null,  -- api、console
+ *	  addr       varchar(64)   not null,  -- 操作人的地址
+ *	  action     varchar(32)   not null,
+ *	  target     varchar(64)   not null,  -- 账号ID、会话ID、IP 这类操作对象
+ *	  detail     varchar(1024) not null,
+ *	  result     varchar(255)  not null,  -- ok 或者错误信息
+ *	  created_at datetime      not null,
+ *	  key idx_operator (operator, created_at),
+ *	  key idx_target (target, created_at)
+ *	) default charset=utf8mb4;
+ */
+
+import (
+	"context"
+	"errors"
+	"gameserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 定义表名-常量
+const TABLE_GM_AUDIT = "gm_audit"
+
+// GMAudit GM 操作记录表结构
+type GMAudit struct {
+	Id         int64  `db:"id" json:"id"`
+	Operator   string `db:"operator" json:"operator"`
+	Source     string `db:"source" json:"source"`
+	Addr       string `db:"addr" json:"addr"`
+	Action     string `db:"action" json:"action"`
+	Target     string `db:"target" json:"target"`
+	Detail     string `db:"detail" json:"detail"`
+	Result     string `db:"result" json:"result"`
+	Created_at string `db:"created_at" json:"created_at"`
+}
+
+// ErrNoMySQL 启动时没有连上 mysql
+var ErrNoMySQL = errors.New("mysql未连接")
+
+// InsertGMAudit 写一条操作记录
+func InsertGMAudit(ctx context.Context, a GMAudit) (err error) {
+	ctx, span := startSpan(ctx, "InsertGMAudit", dbMySQL, attribute.String("db.sql.table", TABLE_GM_AUDIT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	_, err = Db.ExecContext(ctx, "insert into gm_audit(operator, source, addr, action, target, detail, result, created_at)values(?, ?, ?, ?, ?, ?, ?, ?)",
+		a.Operator, a.Source, a.Addr, a.Action, a.Target, a.Detail, a.Result, a.Created_at)
+	return err
+}
+
+// GetGMAudits 最近的 limit 条操作记录，target 不为空时只查这个对象的，按时间倒序
+func GetGMAudits(ctx context.Context, target string, limit int) (audits []GMAudit, err error) {
+	ctx, span := startSpan(ctx, "GetGMAudits", dbMySQL, attribute.String("db.sql.table", TABLE_GM_AUDIT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return nil, ErrNoMySQL
+	}
+	query := "select id,operator,source,addr,action,target,detail,result,created_at from gm_audit"
+	args := []interface{}{}
+	if target != "" {
+		query += " where target=?"
+		args = append(args, target)
+	}
+	query += " order by id desc limit ?"
+	args = append(args, limit)
+	err = Db.SelectContext(ctx, &audits, query, args...)
+	return audits, err
+}
@@ -0,0 +1,208 @@
+package model
+
+/**
+ * 游客账号：按设备创建，账号名是 g 开头的 11 位随机字符串，不会和手机号重复，没有密码
+ * 绑定正式账号时改账号名和密码，accid 不变，等级、背包这些按 accid 保存的数据都保留
+ * 长时间没有登录又没有绑定的游客定期删掉
+ *
+ *	alter table account
+ *	  add column guest      tinyint     not null default 0,  -- 1 是游客，绑定后改成 0
+ *	  add column device_id  varchar(64) null,                -- 游客的设备，绑定后清空，同一台设备可以再建游客
+ *	  add column guest_seen datetime    null,                -- 游客最后一次登录的时间
+ *	  add unique key uk_device (device_id),
+ *	  add key idx_guest (guest, guest_seen);
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gameserver/tracing"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+)
+
+// 自动生成的账号名：前缀加随机字符，和手机号一样 11 位
+const (
+	guestPrefix  = "g"
+	nameAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	nameLen      = 11
+)
+
+// mysql 唯一键冲突的错误码
+const errDuplicateEntry = 1062
+
+var (
+	// ErrGuestExists 这台设备已经有游客账号
+	ErrGuestExists = errors.New("设备已经有游客账号")
+	// ErrAccountExists 账号名已经被用了
+	ErrAccountExists = errors.New("账号已存在")
+	// ErrNotGuest 不是游客或者已经绑定过了
+	ErrNotGuest = errors.New("不是游客账号")
+)
+
+// ReservedName 是不是游客、第三方登录自动生成的账号名，这些名字不能注册也不能绑定
+func ReservedName(account string) bool {
+	return strings.HasPrefix(account, guestPrefix) || strings.HasPrefix(account, identityPrefix)
+}
+
+// randomName 随机生成账号名
+func randomName(prefix string) (string, error) {
+	b := make([]byte, nameLen-len(prefix))
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = nameAlphabet[int(b[i])%len(nameAlphabet)]
+	}
+	return prefix + string(b), nil
+}
+
+// duplicateKey 唯一键冲突时返回冲突的键名
+func duplicateKey(err error) (string, bool) {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) || me.Number != errDuplicateEntry {
+		return "", false
+	}
+	// Duplicate entry 'xxx' for key 'account.uk_device'
+	key := me.Message[strings.LastIndex(me.Message, " ")+1:]
+	return strings.Trim(key, "'"), true
+}
+
+// CreateGuest 给设备创建游客账号，设备已经有游客时返回 ErrGuestExists
+func CreateGuest(ctx context.Context, deviceID string) (account Account, err error) {
+	ctx, span := startSpan(ctx, "CreateGuest", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return Account{}, ErrNoMySQL
+	}
+	now := time.Now()
+	account = Account{
+		Sex:       1,
+		Sign_time: now.Format("2006:01:02 15:04:05"),
+		Status:    AccountActive,
+		Guest:     1,
+	}
+	// 账号名重复的概率很小，重试几次
+	for i := 0; i < 3; i++ {
+		if account.Account, err = randomName(guestPrefix); err != nil {
+			return Account{}, err
+		}
+		var r sql.Result
+		r, err = Db.ExecContext(ctx, "insert into account(accid, account, password, sex, sign_time, guest, device_id, guest_seen)values(null, ?, '', ?, ?, 1, ?, ?)",
+			account.Account, account.Sex, account.Sign_time, deviceID, now.Format("2006-01-02 15:04:05"))
+		if key, dup := duplicateKey(err); dup {
+			if strings.HasSuffix(key, "uk_device") {
+				return Account{}, ErrGuestExists
+			}
+			continue
+		}
+		if err != nil {
+			return Account{}, err
+		}
+		var id int64
+		if id, err = r.LastInsertId(); err != nil {
+			return Account{}, err
+		}
+		account.Accid = int(id)
+		return account, nil
+	}
+	return Account{}, ErrAccountExists
+}
+
+// GetGuestByDevice 设备上还没有绑定的游客账号，没有时返回 ErrAccountNotFound
+func GetGuestByDevice(ctx context.Context, deviceID string) (account Account, err error) {
+	ctx, span := startSpan(ctx, "GetGuestByDevice", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return Account{}, ErrNoMySQL
+	}
+	err = Db.GetContext(ctx, &account, fmt.Sprintf("select %s from %s where device_id=? and guest=1", accountColumns, TABLE_ACCOUNT), deviceID)
+	if err == sql.ErrNoRows {
+		return Account{}, ErrAccountNotFound
+	}
+	return account, err
+}
+
+// TouchGuest 记下游客这次登录的时间，清理时按它判断
+func TouchGuest(ctx context.Context, accid int) (err error) {
+	ctx, span := startSpan(ctx, "TouchGuest", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	_, err = Db.ExecContext(ctx, "update account set guest_seen=? where accid=? and guest=1", time.Now().Format("2006-01-02 15:04:05"), accid)
+	return err
+}
+
+// BindGuest 游客绑定正式账号，password 是加密之后的
+// 账号名被占用时返回 ErrAccountExists，不是游客时返回 ErrNotGuest
+func BindGuest(ctx context.Context, accid int, account string, password string) (err error) {
+	ctx, span := startSpan(ctx, "BindGuest", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	r, err := Db.ExecContext(ctx, "update account set account=?, password=?, guest=0, device_id=null, guest_seen=null where accid=? and guest=1", account, password, accid)
+	if _, dup := duplicateKey(err); dup {
+		return ErrAccountExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotGuest
+	}
+	return nil
+}
+
+// DeleteStaleGuests 删掉 before 之前最后一次登录、一直没有绑定的游客，一次最多 limit 个，返回删掉的账号
+// 登录记录一起删，redis 里的数据由调用的地方清理
+func DeleteStaleGuests(ctx context.Context, before time.Time, limit int) (accounts []Account, err error) {
+	ctx, span := startSpan(ctx, "DeleteStaleGuests", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return nil, ErrNoMySQL
+	}
+	conn, err := Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Rollback()
+		}
+	}()
+	// 锁住要删的行，删之前游客刚好登录或者绑定的要等这边删完
+	err = conn.SelectContext(ctx, &accounts, fmt.Sprintf("select %s from %s where guest=1 and guest_seen<? limit ? for update", accountColumns, TABLE_ACCOUNT),
+		before.Format("2006-01-02 15:04:05"), limit)
+	if err != nil || len(accounts) == 0 {
+		conn.Rollback()
+		return nil, err
+	}
+	ids := make([]int, 0, len(accounts))
+	for _, a := range accounts {
+		ids = append(ids, a.Accid)
+	}
+	for _, table := range []string{TABLE_ACCOUNT, TABLE_ACCOUNT_LOGIN} {
+		var query string
+		var args []interface{}
+		if query, args, err = sqlx.In(fmt.Sprintf("delete from %s where accid in (?)", table), ids); err != nil {
+			return nil, err
+		}
+		if _, err = conn.ExecContext(ctx, query, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.Commit(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
@@ -0,0 +1,231 @@
+package model
+
+/**
+ * 第三方账号：平台上的用户 ID 绑定到 accid，一个平台账号只能绑一个 accid，一个 accid 每个平台只能绑一个
+ * 第三方第一次登录时自动创建账号，账号名是 p 开头的随机字符串，没有密码
+ * 游客绑定第三方账号后就不算游客了，不会被清理
+ *
+ *	create table account_identity (
+ *	  id         bigint unsigned not null auto_increment primary key,
+ *	  provider   varchar(32)  not null,  -- 配置里的平台名
+ *	  subject    varchar(255) not null,  -- 平台上的用户 ID，oidc 的 sub
+ *	  accid      int          not null,
+ *	  created_at datetime     not null,
+ *	  unique key uk_subject (provider, subject),
+ *	  unique key uk_accid (accid, provider)
+ *	) default charset=utf8mb4;
+ */
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gameserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+)
+
+// 定义表名-常量
+const TABLE_ACCOUNT_IDENTITY = "account_identity"
+
+// 第三方登录自动创建的账号名前缀
+const identityPrefix = "p"
+
+var (
+	// ErrIdentityNotFound 没有绑定这个第三方账号
+	ErrIdentityNotFound = errors.New("没有绑定第三方账号")
+	// ErrIdentityLinked 第三方账号已经绑定了别的账号
+	ErrIdentityLinked = errors.New("第三方账号已经绑定")
+	// ErrProviderLinked 账号已经绑定了这个平台的另一个账号
+	ErrProviderLinked = errors.New("已经绑定了这个平台")
+	// ErrLastIdentity 没有密码的账号不能解绑最后一个第三方账号，不然就登录不了了
+	ErrLastIdentity = errors.New("不能解绑最后一种登录方式")
+)
+
+// AccountIdentity 第三方账号绑定表结构
+type AccountIdentity struct {
+	Id         int64  `db:"id" json:"-"`
+	Provider   string `db:"provider" json:"provider"`
+	Subject    string `db:"subject" json:"subject"`
+	Accid      int    `db:"accid" json:"accid"`
+	Created_at string `db:"created_at" json:"created_at"`
+}
+
+// GetIdentity 按平台和平台上的用户 ID 查询绑定，没有时返回 ErrIdentityNotFound
+func GetIdentity(ctx context.Context, provider string, subject string) (identity AccountIdentity, err error) {
+	ctx, span := startSpan(ctx, "GetIdentity", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_IDENTITY), attribute.String("provider", provider))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return AccountIdentity{}, ErrNoMySQL
+	}
+	err = Db.GetContext(ctx, &identity, "select id,provider,subject,accid,created_at from account_identity where provider=? and subject=?", provider, subject)
+	if err == sql.ErrNoRows {
+		return AccountIdentity{}, ErrIdentityNotFound
+	}
+	return identity, err
+}
+
+// GetIdentities 账号绑定的所有第三方账号
+func GetIdentities(ctx context.Context, accid int) (identities []AccountIdentity, err error) {
+	ctx, span := startSpan(ctx, "GetIdentities", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_IDENTITY), attribute.Int("accid", accid))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return nil, ErrNoMySQL
+	}
+	err = Db.SelectContext(ctx, &identities, "select id,provider,subject,accid,created_at from account_identity where accid=? order by id", accid)
+	return identities, err
+}
+
+// CreateIdentityAccount 第三方账号第一次登录，创建账号并绑定
+// 同一个第三方账号并发登录时只有一个能创建成功，其余的返回 ErrIdentityLinked，重新查询绑定就行
+func CreateIdentityAccount(ctx context.Context, provider string, subject string) (account Account, err error) {
+	ctx, span := startSpan(ctx, "CreateIdentityAccount", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_IDENTITY), attribute.String("provider", provider))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return Account{}, ErrNoMySQL
+	}
+	conn, err := Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Account{}, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Rollback()
+		}
+	}()
+	now := time.Now()
+	account = Account{
+		Sex:       1,
+		Sign_time: now.Format("2006:01:02 15:04:05"),
+		Status:    AccountActive,
+	}
+	// 账号名重复的概率很小，重试几次
+	var r sql.Result
+	for i := 0; i < 3; i++ {
+		if account.Account, err = randomName(identityPrefix); err != nil {
+			return Account{}, err
+		}
+		r, err = conn.ExecContext(ctx, "insert into account(accid, account, password, sex, sign_time)values(null, ?, '', ?, ?)",
+			account.Account, account.Sex, account.Sign_time)
+		if _, dup := duplicateKey(err); !dup {
+			break
+		}
+	}
+	if _, dup := duplicateKey(err); dup {
+		return Account{}, ErrAccountExists
+	}
+	if err != nil {
+		return Account{}, err
+	}
+	var id int64
+	if id, err = r.LastInsertId(); err != nil {
+		return Account{}, err
+	}
+	account.Accid = int(id)
+	_, err = conn.ExecContext(ctx, "insert into account_identity(provider, subject, accid, created_at)values(?, ?, ?, ?)",
+		provider, subject, account.Accid, now.Format("2006-01-02 15:04:05"))
+	if _, dup := duplicateKey(err); dup {
+		err = ErrIdentityLinked
+	}
+	if err != nil {
+		return Account{}, err
+	}
+	if err = conn.Commit(); err != nil {
+		return Account{}, err
+	}
+	return account, nil
+}
+
+// LinkIdentity 已有账号绑定第三方账号，游客绑定后转成正式账号
+// 第三方账号已经绑定时返回 ErrIdentityLinked，这个平台已经绑定了别的账号时返回 ErrProviderLinked
+func LinkIdentity(ctx context.Context, accid int, provider string, subject string) (err error) {
+	ctx, span := startSpan(ctx, "LinkIdentity", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_IDENTITY), attribute.Int("accid", accid))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	conn, err := Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.Rollback()
+		}
+	}()
+	// 锁住账号，游客清理要等绑定完
+	var guest int
+	if err = conn.GetContext(ctx, &guest, "select guest from account where accid=? for update", accid); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrAccountNotFound
+		}
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "insert into account_identity(provider, subject, accid, created_at)values(?, ?, ?, ?)",
+		provider, subject, accid, time.Now().Format("2006-01-02 15:04:05"))
+	if key, dup := duplicateKey(err); dup {
+		if strings.HasSuffix(key, "uk_accid") {
+			return ErrProviderLinked
+		}
+		return ErrIdentityLinked
+	}
+	if err != nil {
+		return err
+	}
+	if guest == 1 {
+		if _, err = conn.ExecContext(ctx, "update account set guest=0, device_id=null, guest_seen=null where accid=?", accid); err != nil {
+			return err
+		}
+	}
+	return conn.Commit()
+}
+
+// UnlinkIdentity 解绑账号在这个平台上的第三方账号
+// 没有绑定时返回 ErrIdentityNotFound，没有密码又只剩这一个时返回 ErrLastIdentity
+func UnlinkIdentity(ctx context.Context, accid int, provider string) (err error) {
+	ctx, span := startSpan(ctx, "UnlinkIdentity", dbMySQL, attribute.String("db.sql.table", TABLE_ACCOUNT_IDENTITY), attribute.Int("accid", accid))
+	defer func() { tracing.End(span, err) }()
+	if Db == nil {
+		return ErrNoMySQL
+	}
+	conn, err := Db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.Rollback()
+		}
+	}()
+	// 锁住账号，并发解绑时不会把登录方式全解掉
+	var password string
+	if err = conn.GetContext(ctx, &password, "select password from account where accid=? for update", accid); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrAccountNotFound
+		}
+		return err
+	}
+	if password == "" {
+		var n int
+		if err = conn.GetContext(ctx, &n, fmt.Sprintf("select count(*) from %s where accid=? and provider<>?", TABLE_ACCOUNT_IDENTITY), accid, provider); err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrLastIdentity
+		}
+	}
+	r, err := conn.ExecContext(ctx, "delete from account_identity where accid=? and provider=?", accid, provider)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if n, err = r.RowsAffected(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdentityNotFound
+	}
+	return conn.Commit()
+}
@@ -0,0 +1,56 @@
+package model
+
+/**
+ * IP 临时封禁，保存在 redis 的有序集合里，分数是解封时间，所有节点共享
+ */
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// 封禁列表在 redis 里的 key
+const ipBanKey = "ipbans"
+
+// IPBanStore 实现 ratelimit.BanStore
+type IPBanStore struct{}
+
+// Ban 封禁到 until
+func (IPBanStore) Ban(ip string, until time.Time) error {
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("ZADD", ipBanKey, until.Unix(), ip)
+	return err
+}
+
+// Unban 解除封禁
+func (IPBanStore) Unban(ip string) error {
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("ZREM", ipBanKey, ip)
+	return err
+}
+
+// List 所有还没到期的封禁，顺便清理已经到期的
+func (IPBanStore) List() (map[string]time.Time, error) {
+	c := pool.Get()
+	defer c.Close()
+	now := time.Now().Unix()
+	if _, err := c.Do("ZREMRANGEBYSCORE", ipBanKey, "-inf", now); err != nil {
+		return nil, err
+	}
+	values, err := redis.Strings(c.Do("ZRANGE", ipBanKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	bans := make(map[string]time.Time, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		until, err := strconv.ParseInt(values[i+1], 10, 64)
+		if err != nil {
+			continue
+		}
+		bans[values[i]] = time.Unix(until, 0)
+	}
+	return bans, nil
+}
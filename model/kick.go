@@ -0,0 +1,76 @@
+package model
+
+/**
+ * 跨节点踢人：GM 在一个节点上封禁账号，通过 redis 发布，所有节点上这个账号的会话都断开
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+// 踢人消息的频道
+const kickChannel = "kick"
+
+// 订阅断开后隔多久重连
+const resubscribeDelay = 3 * time.Second
+
+// Kick 一条踢人消息，收到的节点给账号的会话发一个错误包然后断开
+type Kick struct {
+	Node   string `json:"node"` // 发布的节点，它自己已经踢过了
+	Accid  int64  `json:"accid"`
+	Code   uint32 `json:"code"` // 错误包的子命令
+	Reason string `json:"reason"`
+	Until  int64  `json:"until,omitempty"` // 停封的解封时间，unix 秒
+	Token  string `json:"token,omitempty"` // 不为空时只踢用这个 token 认证的会话
+}
+
+// PublishKick 通知所有节点
+func PublishKick(ctx context.Context, k *Kick) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, span := startSpan(ctx, "PublishKick", dbRedis, attribute.Int64("accid", k.Accid))
+	c := pool.Get()
+	defer c.Close()
+	_, err = c.Do("PUBLISH", kickChannel, data)
+	tracing.End(span, err)
+	return err
+}
+
+// SubscribeKicks 一直订阅踢人消息，断开后自动重连，一般用 go 启动
+func SubscribeKicks(f func(k *Kick)) {
+	for {
+		if err := subscribeKicks(f); err != nil {
+			slog.Error("订阅踢人消息失败", "err", err)
+		}
+		time.Sleep(resubscribeDelay)
+	}
+}
+
+func subscribeKicks(f func(k *Kick)) error {
+	c := redis.PubSubConn{Conn: pool.Get()}
+	defer c.Close()
+	if err := c.Subscribe(kickChannel); err != nil {
+		return err
+	}
+	for {
+		switch v := c.Receive().(type) {
+		case redis.Message:
+			var k Kick
+			if err := json.Unmarshal(v.Data, &k); err != nil {
+				slog.Warn("踢人消息格式错误", "err", err)
+				continue
+			}
+			f(&k)
+		case error:
+			return v
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package model
+
+/**
+ * 停服维护状态，保存在 redis 里，游戏服务器按它拒绝登录、倒计时和停服，登录服务器按它标记区服状态
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// 维护状态在 redis 里的 key
+const maintenanceKey = "maintenance"
+
+// Maintenance 一次停服维护
+type Maintenance struct {
+	Reason   string    `json:"reason"`   // 维护原因，展示给玩家
+	Shutdown time.Time `json:"shutdown"` // 停服时间，在这之前倒计时，之后开始断开玩家
+	Until    time.Time `json:"until"`    // 预计维护结束时间
+}
+
+// GetMaintenance 当前的维护状态，没有维护时返回 nil
+func GetMaintenance(ctx context.Context) (*Maintenance, error) {
+	_, span := startSpan(ctx, "GetMaintenance", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	data, err := redis.Bytes(c.Do("GET", maintenanceKey))
+	endRedis(span, err)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Maintenance
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance 开始维护，到预计结束时间后自动失效，提前结束用 ClearMaintenance
+func SetMaintenance(ctx context.Context, m *Maintenance) error {
+	if !m.Until.After(m.Shutdown) || !m.Until.After(time.Now()) {
+		return errors.New("维护结束时间必须晚于停服时间和当前时间")
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, span := startSpan(ctx, "SetMaintenance", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	_, err = c.Do("SET", maintenanceKey, data, "EX", int64(time.Until(m.Until).Seconds())+1)
+	tracing.End(span, err)
+	return err
+}
+
+// ClearMaintenance 取消或者结束维护
+func ClearMaintenance(ctx context.Context) error {
+	_, span := startSpan(ctx, "ClearMaintenance", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", maintenanceKey)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"errors"
+)
+
+// PingMySQL 检查数据库是否可用，就绪检查使用
+// 就绪检查每隔几秒就会调用，不记录 span
+func PingMySQL() error {
+	if Db == nil {
+		return errors.New("mysql未连接")
+	}
+	return Db.Ping()
+}
+
+// PingRedis 检查 redis 是否可用，就绪检查使用
+func PingRedis() error {
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("PING")
+	return err
+}
@@ -0,0 +1,77 @@
+package model
+
+/**
+ * 玩家数据：等级和背包，保存在 redis 的 hash 里，所有节点共享
+ *
+ *	player_<accid>  level -> 等级
+ *	bag_<accid>     道具ID -> 数量
+ */
+
+import (
+	"context"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+)
+
+func playerKey(accid int64) string {
+	return "player_" + strconv.FormatInt(accid, 10)
+}
+
+func bagKey(accid int64) string {
+	return "bag_" + strconv.FormatInt(accid, 10)
+}
+
+// SetLevel 设置玩家等级
+func SetLevel(ctx context.Context, accid int64, level int) error {
+	_, span := startSpan(ctx, "SetLevel", dbRedis, attribute.Int64("accid", accid))
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("HSET", playerKey(accid), "level", level)
+	tracing.End(span, err)
+	return err
+}
+
+// GetLevel 玩家等级，没有设置过时返回 0
+func GetLevel(ctx context.Context, accid int64) (int, error) {
+	_, span := startSpan(ctx, "GetLevel", dbRedis, attribute.Int64("accid", accid))
+	c := pool.Get()
+	defer c.Close()
+	level, err := redis.Int(c.Do("HGET", playerKey(accid), "level"))
+	endRedis(span, err)
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return level, err
+}
+
+// AddItem 给玩家加 n 个道具，n 为负数时扣除，返回加完之后的数量
+func AddItem(ctx context.Context, accid int64, item string, n int64) (int64, error) {
+	_, span := startSpan(ctx, "AddItem", dbRedis, attribute.Int64("accid", accid), attribute.String("item", item))
+	c := pool.Get()
+	defer c.Close()
+	total, err := redis.Int64(c.Do("HINCRBY", bagKey(accid), item, n))
+	tracing.End(span, err)
+	return total, err
+}
+
+// GetItems 玩家背包里的所有道具
+func GetItems(ctx context.Context, accid int64) (map[string]int64, error) {
+	_, span := startSpan(ctx, "GetItems", dbRedis, attribute.Int64("accid", accid))
+	c := pool.Get()
+	defer c.Close()
+	items, err := redis.Int64Map(c.Do("HGETALL", bagKey(accid)))
+	tracing.End(span, err)
+	return items, err
+}
+
+// DeletePlayer 删掉玩家的等级、背包和 token，删除游客账号时用
+func DeletePlayer(ctx context.Context, accid int64, account string) error {
+	_, span := startSpan(ctx, "DeletePlayer", dbRedis, attribute.Int64("accid", accid))
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", playerKey(accid), bagKey(accid), TokenKey(account))
+	tracing.End(span, err)
+	return err
+}
@@ -1,8 +1,11 @@
 package model
 
 import (
-	"fmt"
+	"context"
+	"gameserver/metrics"
 	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 )
 
 // 连接池的使用
@@ -19,42 +22,55 @@ func init() {
 			return redis.Dial("tcp", "42.193.50.38:9001", setpass)
 		},
 	}
+	metrics.GaugeFunc("redis_pool_active", "redis 连接池的连接数，包括空闲的", func() float64 {
+		return float64(pool.ActiveCount())
+	})
+	metrics.GaugeFunc("redis_pool_idle", "redis 连接池的空闲连接数", func() float64 {
+		return float64(pool.IdleCount())
+	})
 }
 
-func SetRedis(name string, value interface{}) bool {
+func SetRedis(ctx context.Context, name string, value interface{}) bool {
+	_, span := startSpan(ctx, "SetRedis", dbRedis, attribute.String("db.redis.key", name))
 	// 从连接池中取出一个链接
 	c := pool.Get()
 	defer c.Close() // 应用程序必须关闭返回的连接：回收方法是activeConn中的Close
-	fmt.Println(name, value)
+	// 值可能是 token，不记录
+	slog.Debug("写入redis", "key", name)
 	_, err := c.Do("Set", name, value)
+	endRedis(span, err)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("写入redis失败", "key", name, "err", err)
 		return false
 	}
 
 	return true
 }
 
-func GetRedisInt(name string) (int, bool) {
+func GetRedisInt(ctx context.Context, name string) (int, bool) {
+	_, span := startSpan(ctx, "GetRedisInt", dbRedis, attribute.String("db.redis.key", name))
 	c := pool.Get()
 	defer c.Close()
 
 	value, err := redis.Int(c.Do("Get", name))
+	endRedis(span, err)
 	if err != nil {
-		fmt.Println(err)
+		slog.Debug("读取redis失败", "key", name, "err", err)
 		return 0, false
 	}
 
 	return value, true
 }
 
-func GetRedisString(name string) (string, bool) {
+func GetRedisString(ctx context.Context, name string) (string, bool) {
+	_, span := startSpan(ctx, "GetRedisString", dbRedis, attribute.String("db.redis.key", name))
 	c := pool.Get()
 	defer c.Close()
 
 	value, err := redis.String(c.Do("Get", name))
+	endRedis(span, err)
 	if err != nil {
-		fmt.Println(err)
+		slog.Debug("读取redis失败", "key", name, "err", err)
 		return "", false
 	}
 
@@ -0,0 +1,132 @@
+package model
+
+/**
+ * 找回密码的验证码，保存在 redis 里，过期自动失效，只能用一次，输错太多次作废
+ *
+ *	resetcode_<account>       code -> 验证码的 sha256，attempts -> 已经校验了几次
+ *	resetcode_sent_<account>  发送冷却，存在时不能再发
+ *	resetcode_fail_<account>  一段时间内输错的总次数，换了验证码也累计，到上限后这段时间内不能再发和校验
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var (
+	// ErrCodeTooFrequent 冷却时间内重复申请验证码
+	ErrCodeTooFrequent = errors.New("验证码发送太频繁")
+	// ErrCodeExpired 没有申请过、已经过期、已经用过或者输错太多次作废了
+	ErrCodeExpired = errors.New("验证码已失效")
+	// ErrCodeWrong 验证码错误，还可以再试
+	ErrCodeWrong = errors.New("验证码错误")
+	// ErrCodeLocked 账号输错太多次，一段时间内不能找回密码
+	ErrCodeLocked = errors.New("验证码错误次数太多")
+)
+
+// 校验验证码，返回 1 正确，0 错误，-1 不存在，-2 次数用完，-3 账号输错太多次
+// 计数和比较放在一个脚本里，并发校验时不会多试
+// KEYS resetcode_<account>、resetcode_fail_<account>，ARGV 验证码、单个验证码次数、账号次数、账号计数的时间窗口毫秒
+var checkCodeScript = redis.NewScript(2, `
+if tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[3]) then
+	redis.call('DEL', KEYS[1])
+	return -3
+end
+local code = redis.call('HGET', KEYS[1], 'code')
+if not code then
+	return -1
+end
+local n = redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+if code == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return 1
+end
+local fails = redis.call('INCR', KEYS[2])
+if fails == 1 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[4])
+end
+if n >= tonumber(ARGV[2]) or fails >= tonumber(ARGV[3]) then
+	redis.call('DEL', KEYS[1])
+	return -2
+end
+return 0
+`)
+
+func resetCodeKey(account string) string {
+	return "resetcode_" + account
+}
+
+func resetCodeSentKey(account string) string {
+	return "resetcode_sent_" + account
+}
+
+func resetCodeFailKey(account string) string {
+	return "resetcode_fail_" + account
+}
+
+// hashCode redis 里不存验证码原文
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveResetCode 保存验证码，有效期 ttl，之前的验证码作废；cooldown 内重复申请返回 ErrCodeTooFrequent
+// 账号输错的次数到了 maxFails 时返回 ErrCodeLocked，发了也不能用
+func SaveResetCode(ctx context.Context, account string, code string, ttl time.Duration, cooldown time.Duration, maxFails int) error {
+	_, span := startSpan(ctx, "SaveResetCode", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	fails, err := redis.Int(c.Do("GET", resetCodeFailKey(account)))
+	if err != nil && err != redis.ErrNil {
+		tracing.End(span, err)
+		return err
+	}
+	if fails >= maxFails {
+		endRedis(span, nil)
+		return ErrCodeLocked
+	}
+	ok, err := redis.String(c.Do("SET", resetCodeSentKey(account), 1, "PX", cooldown.Milliseconds(), "NX"))
+	if err == redis.ErrNil {
+		endRedis(span, err)
+		return ErrCodeTooFrequent
+	}
+	if err != nil || ok != "OK" {
+		tracing.End(span, err)
+		return err
+	}
+	key := resetCodeKey(account)
+	_ = c.Send("MULTI")
+	_ = c.Send("DEL", key)
+	_ = c.Send("HSET", key, "code", hashCode(code), "attempts", 0)
+	_ = c.Send("PEXPIRE", key, ttl.Milliseconds())
+	_, err = c.Do("EXEC")
+	tracing.End(span, err)
+	return err
+}
+
+// CheckResetCode 校验验证码，正确时删掉，同一个验证码最多试 maxAttempts 次
+// 同一个账号 window 内一共输错 maxFails 次后返回 ErrCodeLocked，防止不停换验证码来试
+func CheckResetCode(ctx context.Context, account string, code string, maxAttempts int, maxFails int, window time.Duration) error {
+	_, span := startSpan(ctx, "CheckResetCode", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	r, err := redis.Int(checkCodeScript.Do(c, resetCodeKey(account), resetCodeFailKey(account), hashCode(code), maxAttempts, maxFails, window.Milliseconds()))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	switch r {
+	case 1:
+		return nil
+	case 0:
+		return ErrCodeWrong
+	case -3:
+		return ErrCodeLocked
+	}
+	return ErrCodeExpired
+}
@@ -0,0 +1,210 @@
+package model
+
+/**
+ * 登录 token：http 登录成功时发放，tcp、udp、websocket 认证时校验
+ * 每次登录发一个新的随机 token，token 本身就是 jti，同一个账号多台设备可以同时登录，每个都有有效期
+ * 作废的 token 记在作废列表里，保留到本来的过期时间，游戏服务器按它把还连着的会话踢下线
+ *
+ *	token_<account>  hash，jti -> 过期时间 unix 秒，整个 key 跟着最后发的 token 过期
+ *	revoked_<jti>    已经作废的 token
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+// 同一个账号最多同时有多少个 token，超过时最早过期的那个作废
+const maxAccountTokens = 20
+
+// 查询作废列表时每次 MGET 多少个
+const revokedBatch = 500
+
+// 作废列表 key 的前缀，脚本里拼 key 用
+const revokedPrefix = "revoked_"
+
+// 发 token，顺便删掉过期的，超过上限时作废最早过期的
+// KEYS[1] token_<account>，ARGV jti、当前时间、有效期秒数、上限、作废列表前缀
+var issueTokenScript = redis.NewScript(1, `
+local now = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local all = redis.call('HGETALL', KEYS[1])
+local oldest, oldestExp, n = nil, nil, 0
+for i = 1, #all, 2 do
+	local exp = tonumber(all[i+1])
+	if exp <= now then
+		redis.call('HDEL', KEYS[1], all[i])
+	else
+		n = n + 1
+		if not oldestExp or exp < oldestExp then
+			oldest, oldestExp = all[i], exp
+		end
+	end
+end
+if n >= tonumber(ARGV[4]) then
+	redis.call('HDEL', KEYS[1], oldest)
+	redis.call('SET', ARGV[5] .. oldest, 1, 'EX', oldestExp - now)
+end
+redis.call('HSET', KEYS[1], ARGV[1], now + ttl)
+if redis.call('TTL', KEYS[1]) < ttl then
+	redis.call('EXPIRE', KEYS[1], ttl)
+end
+return n
+`)
+
+// 作废 token，ARGV[1] 为空时作废账号所有的 token，返回作废的数量
+// KEYS[1] token_<account>，ARGV jti、当前时间、作废列表前缀
+var revokeTokenScript = redis.NewScript(1, `
+local now = tonumber(ARGV[2])
+local all
+if ARGV[1] == '' then
+	all = redis.call('HGETALL', KEYS[1])
+else
+	local exp = redis.call('HGET', KEYS[1], ARGV[1])
+	if not exp then
+		return 0
+	end
+	all = {ARGV[1], exp}
+end
+for i = 1, #all, 2 do
+	redis.call('HDEL', KEYS[1], all[i])
+	local ttl = tonumber(all[i+1]) - now
+	if ttl > 0 then
+		redis.call('SET', ARGV[3] .. all[i], 1, 'EX', ttl)
+	end
+end
+return #all / 2
+`)
+
+// TokenKey 账号的 token 在 redis 里的 key
+func TokenKey(account string) string {
+	return "token_" + account
+}
+
+func revokedKey(jti string) string {
+	return revokedPrefix + jti
+}
+
+// IssueToken 登录成功后给账号发一个新 token，ttl 之后过期
+func IssueToken(ctx context.Context, account string, ttl time.Duration) (string, error) {
+	_, span := startSpan(ctx, "IssueToken", dbRedis)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		tracing.End(span, err)
+		return "", err
+	}
+	jti := hex.EncodeToString(b)
+	c := pool.Get()
+	defer c.Close()
+	_, err := issueTokenScript.Do(c, TokenKey(account), jti, time.Now().Unix(), int64(ttl.Seconds()), maxAccountTokens, revokedPrefix)
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+	return jti, nil
+}
+
+// VerifyToken 校验 http 登录时发放的 token，成功时返回账号信息
+// tcp、udp、websocket 的认证都走这里
+func VerifyToken(ctx context.Context, account string, token string) (accinfo Account, err error) {
+	ctx, span := tracing.Start(ctx, "model.VerifyToken")
+	defer func() { tracing.End(span, err) }()
+	if account == "" || token == "" {
+		return Account{}, errors.New("account or token is empty")
+	}
+	expires, err := tokenExpires(ctx, account, token)
+	if err != nil {
+		return Account{}, err
+	}
+	if expires <= time.Now().Unix() {
+		return Account{}, errors.New("token error")
+	}
+	list, err := GetAccountInfo(ctx, account)
+	if err != nil {
+		return Account{}, err
+	}
+	if len(list) == 0 {
+		return Account{}, errors.New("account is not register")
+	}
+	return list[0], nil
+}
+
+// 上下文里保存校验 token 时读到的账号的 key
+type accountKey struct{}
+
+// WithAccount 把校验 token 时读到的账号带到登录检查里，检查账号状态时不用再查一次
+func WithAccount(ctx context.Context, a Account) context.Context {
+	return context.WithValue(ctx, accountKey{}, a)
+}
+
+// AccountFrom WithAccount 带过来的账号，没有时 ok 为 false
+func AccountFrom(ctx context.Context) (a Account, ok bool) {
+	a, ok = ctx.Value(accountKey{}).(Account)
+	return a, ok
+}
+
+// tokenExpires token 的过期时间，没有发过或者已经作废时返回 0
+func tokenExpires(ctx context.Context, account string, token string) (int64, error) {
+	_, span := startSpan(ctx, "TokenExpires", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	expires, err := redis.Int64(c.Do("HGET", TokenKey(account), token))
+	endRedis(span, err)
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return expires, err
+}
+
+// RevokeToken 作废账号的一个 token，返回它是不是还有效
+// 已经连上游戏服务器的会话要另外用 PublishKick 踢下线，漏掉的游戏服务器会按作废列表定期检查
+func RevokeToken(ctx context.Context, account string, token string) (bool, error) {
+	_, span := startSpan(ctx, "RevokeToken", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	n, err := redis.Int(revokeTokenScript.Do(c, TokenKey(account), token, time.Now().Unix(), revokedPrefix))
+	tracing.End(span, err)
+	return n > 0, err
+}
+
+// RevokeAllTokens 作废账号所有的 token，返回作废的数量，在线的会话同样要另外踢下线
+func RevokeAllTokens(ctx context.Context, account string) (int, error) {
+	_, span := startSpan(ctx, "RevokeAllTokens", dbRedis)
+	c := pool.Get()
+	defer c.Close()
+	n, err := redis.Int(revokeTokenScript.Do(c, TokenKey(account), "", time.Now().Unix(), revokedPrefix))
+	tracing.End(span, err)
+	return n, err
+}
+
+// RevokedTokens 在作废列表里的 token
+func RevokedTokens(ctx context.Context, tokens []string) (revoked map[string]bool, err error) {
+	_, span := startSpan(ctx, "RevokedTokens", dbRedis, attribute.Int("tokens", len(tokens)))
+	defer func() { tracing.End(span, err) }()
+	c := pool.Get()
+	defer c.Close()
+	revoked = make(map[string]bool)
+	for start := 0; start < len(tokens); start += revokedBatch {
+		batch := tokens[start:min(start+revokedBatch, len(tokens))]
+		args := make([]interface{}, len(batch))
+		for i, t := range batch {
+			args[i] = revokedKey(t)
+		}
+		values, err := redis.Strings(c.Do("MGET", args...))
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v != "" {
+				revoked[batch[i]] = true
+			}
+		}
+	}
+	return revoked, nil
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"context"
+	"gameserver/tracing"
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 数据库类型，记在 span 上
+const (
+	dbMySQL = "mysql"
+	dbRedis = "redis"
+)
+
+// startSpan 每个 mysql、redis 调用一个 span，名字用函数名，登录慢的时候能直接看出是哪一步
+// 只记录请求里的调用，维护状态、封禁列表这类后台定时读取没有上层调用链，不单独产生一条
+func startSpan(ctx context.Context, name string, system string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracing.Start(ctx, "model."+name, append(attrs, attribute.String("db.system", system))...)
+}
+
+// endRedis 结束 redis 调用的 span，key 不存在不算错误
+func endRedis(span trace.Span, err error) {
+	if err == redis.ErrNil {
+		span.SetAttributes(attribute.Bool("db.redis.nil", true))
+		err = nil
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,109 @@
+package notify
+
+/**
+ * 给玩家发通知，目前用来发找回密码的验证码
+ * 短信、邮件服务商各实现一个 Notifier，用 Register 注册后在启动参数里按名字选
+ * 自带的 log 和 file 只给开发环境用，验证码会明文写出来
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message 一条通知
+type Message struct {
+	To      string // 手机号或者邮箱，现在账号就是手机号
+	Subject string // 邮件标题，短信不用
+	Text    string
+}
+
+// Notifier 发送通知，实现要能并发调用
+type Notifier interface {
+	Notify(ctx context.Context, m *Message) error
+}
+
+// Factory 按参数创建 Notifier，参数是 "名字:参数" 里冒号后面的部分
+type Factory func(arg string) (Notifier, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{
+		"log":  func(arg string) (Notifier, error) { return LogNotifier{}, nil },
+		"file": newFileNotifier,
+	}
+)
+
+// Register 注册一种 Notifier，短信、邮件的实现在 init 里调用
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = f
+}
+
+// New 按 "名字" 或者 "名字:参数" 创建，比如 log、file:/tmp/notify.log
+func New(spec string) (Notifier, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	mu.RLock()
+	f, ok := factories[name]
+	names := make([]string, 0, len(factories))
+	for n := range factories {
+		names = append(names, n)
+	}
+	mu.RUnlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, errors.New("不支持的通知方式 " + name + "，可以用 " + strings.Join(names, "、"))
+	}
+	return f(arg)
+}
+
+// Insecure 是不是自带的 log、file 这种把验证码明文写出来的方式
+func Insecure(spec string) bool {
+	name, _, _ := strings.Cut(spec, ":")
+	return name == "log" || name == "file"
+}
+
+// LogNotifier 把通知写到日志里，开发环境用
+type LogNotifier struct{}
+
+// Notify 写一条 info 日志
+func (LogNotifier) Notify(ctx context.Context, m *Message) error {
+	slog.Info("发送通知", "to", m.To, "subject", m.Subject, "text", m.Text)
+	return nil
+}
+
+// FileNotifier 把通知追加到文件里，开发环境和自动化测试用
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newFileNotifier(path string) (Notifier, error) {
+	if path == "" {
+		return nil, errors.New("file 通知要指定文件，比如 file:/tmp/notify.log")
+	}
+	return &FileNotifier{path: path}, nil
+}
+
+// Notify 每条通知一行
+func (n *FileNotifier) Notify(ctx context.Context, m *Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\t%s\n", time.Now().Format("2006-01-02 15:04:05"), m.To, m.Subject, m.Text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
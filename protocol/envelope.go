@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Envelope websocket 文本消息使用的 JSON 信封，和二进制包一一对应
+// 消息体本身是 JSON 时直接嵌入，否则以 base64 字符串传输并设置 b64
+type Envelope struct {
+	Cmd   uint32          `json:"cmd"`
+	Sub   uint32          `json:"sub"`
+	Seq   uint32          `json:"seq,omitempty"`
+	Accid int64           `json:"accid,omitempty"`
+	Body  json.RawMessage `json:"body,omitempty"`
+	B64   bool            `json:"b64,omitempty"`
+	Trace string          `json:"traceparent,omitempty"` // 调用链上下文，W3C traceparent 格式
+}
+
+// DecodeEnvelope 把 JSON 信封解析成包
+func DecodeEnvelope(data []byte) (*Packet, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	p := &Packet{Version: CurrentVersion, Accid: env.Accid, Cmd: env.Cmd, SubCmd: env.Sub, Seq: env.Seq, Trace: env.Trace}
+	if len(env.Body) > 0 {
+		if env.B64 {
+			var str string
+			if err := json.Unmarshal(env.Body, &str); err != nil {
+				return nil, err
+			}
+			body, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return nil, err
+			}
+			p.Body = body
+		} else {
+			p.Body = []byte(env.Body)
+		}
+	}
+	if len(p.Body) > MaxBodyLen {
+		return nil, ErrBodyTooLarge
+	}
+	return p, nil
+}
+
+// EncodeEnvelope 把包编码成 JSON 信封
+func EncodeEnvelope(p *Packet) ([]byte, error) {
+	env := Envelope{Cmd: p.Cmd, Sub: p.SubCmd, Seq: p.Seq, Accid: p.Accid}
+	if len(p.Body) > 0 {
+		if json.Valid(p.Body) {
+			env.Body = p.Body
+		} else {
+			str, _ := json.Marshal(base64.StdEncoding.EncodeToString(p.Body))
+			env.Body = str
+			env.B64 = true
+		}
+	}
+	return json.Marshal(env)
+}
@@ -0,0 +1,145 @@
+package protocol
+
+/**
+ * HELLO 握手：在 LOGIN_AUTH 之前，客户端和服务器协商协议版本、消息体编码、压缩和加密方式
+ */
+
+import (
+	"encoding/json"
+)
+
+// 定义主命令常量
+const (
+	HELLO       = 1000 // 握手，协商协议版本、编码、压缩、加密
+	LOGIN_AUTH  = 1001 // 登录验证
+	SIGN_DAY    = 1002 // 每日签到
+	ROOM_JOIN   = 2001 // 加入房间，子命令是房间ID，0 表示新建
+	ROOM_LEAVE  = 2002 // 离开房间
+	ROOM_SYNC   = 2003 // 房间内同步，消息体原样转发给同房间的其他玩家
+	ROOM_STATE  = 2004 // 房间成员变化通知
+	ERROR       = 9000 // 错误通知，子命令是错误码
+	RECONNECT   = 9001 // 服务器要求客户端断开后重连，比如平滑重启
+	MAINTENANCE = 9002 // 停服维护通知，倒计时、拒绝登录、维护开始断开
+	NOTICE      = 9003 // 系统公告，运维通过管理接口发布
+)
+
+// 消息体编码
+const (
+	CodecBinary = "binary"
+	CodecJSON   = "json"
+)
+
+// 压缩方式
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+)
+
+// 加密方式
+const (
+	EncryptNone = "none"
+)
+
+// 服务器支持的选项，按服务器的优先级排列
+var (
+	SupportedCodecs   = []string{CodecBinary, CodecJSON}
+	SupportedCompress = []string{CompressNone, CompressGzip}
+	SupportedEncrypt  = []string{EncryptNone}
+)
+
+// 错误包的子命令
+const (
+	ERR_UPGRADE        = 1  // 客户端协议版本过旧，需要升级
+	ERR_PROTOCOL       = 2  // 协议错误
+	ERR_HELLO_REQUIRED = 3  // v2 及以后的客户端必须先 HELLO
+	ERR_NEGOTIATE      = 4  // 没有双方都支持的选项
+	ERR_AUTH           = 5  // 未认证
+	ERR_ROOM           = 6  // 房间不存在或者已满
+	ERR_BUSY           = 7  // 服务器繁忙，消息没有处理，客户端稍后重试
+	ERR_RATE_LIMIT     = 8  // 发送太快，超过限速的消息被丢弃
+	ERR_KICKED         = 9  // 被管理员踢下线
+	ERR_BANNED         = 11 // 账号被封禁，消息里带原因和解封时间，永久封禁时没有解封时间；跳过 10，v1 按 \n 分包，包头里不能出现 0x0a
+	ERR_DELETING       = 12 // 账号待注销，联系客服恢复之前不能登录
+)
+
+// Hello 客户端发来的 HELLO 消息体，各列表按客户端的优先级排列
+type Hello struct {
+	Version  uint8    `json:"version"`
+	Codecs   []string `json:"codecs"`
+	Compress []string `json:"compress"`
+	Encrypt  []string `json:"encrypt"`
+}
+
+// HelloAck 服务器回复的协商结果
+type HelloAck struct {
+	Version  uint8  `json:"version"`
+	Codec    string `json:"codec"`
+	Compress string `json:"compress"`
+	Encrypt  string `json:"encrypt"`
+}
+
+// ErrorBody 错误包的消息体
+type ErrorBody struct {
+	Code       uint32 `json:"code"`
+	Msg        string `json:"msg"`
+	MinVersion uint8  `json:"min_version,omitempty"`
+	MaxVersion uint8  `json:"max_version,omitempty"`
+	Until      int64  `json:"until,omitempty"` // 封禁的解封时间，unix 秒
+}
+
+// Negotiate 根据客户端的 HELLO 选出双方都支持的选项，失败时返回错误包的子命令
+func Negotiate(hello *Hello) (*HelloAck, uint32) {
+	if hello.Version < MinVersion {
+		return nil, ERR_UPGRADE
+	}
+	ack := &HelloAck{Version: hello.Version}
+	if ack.Version > CurrentVersion {
+		ack.Version = CurrentVersion
+	}
+	var ok1, ok2, ok3 bool
+	ack.Codec, ok1 = pick(hello.Codecs, SupportedCodecs, CodecBinary)
+	ack.Compress, ok2 = pick(hello.Compress, SupportedCompress, CompressNone)
+	ack.Encrypt, ok3 = pick(hello.Encrypt, SupportedEncrypt, EncryptNone)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, ERR_NEGOTIATE
+	}
+	return ack, 0
+}
+
+// pick 选出客户端列表中第一个服务器也支持的选项，客户端没有给列表时用默认值
+func pick(client []string, server []string, def string) (string, bool) {
+	if len(client) == 0 {
+		return def, true
+	}
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// NewErrorPacket 创建错误包，错误包的格式在所有版本中保持不变，老客户端也能看懂
+func NewErrorPacket(code uint32, msg string) *Packet {
+	body, _ := json.Marshal(ErrorBody{
+		Code:       code,
+		Msg:        msg,
+		MinVersion: MinVersion,
+		MaxVersion: CurrentVersion,
+	})
+	return &Packet{Cmd: ERROR, SubCmd: code, Body: body}
+}
+
+// NewBannedPacket 创建账号封禁的错误包，msg 是封禁原因，until 是停封的解封时间（unix 秒），永久封禁时为 0
+func NewBannedPacket(reason string, until int64) *Packet {
+	body, _ := json.Marshal(ErrorBody{
+		Code:       ERR_BANNED,
+		Msg:        reason,
+		MinVersion: MinVersion,
+		MaxVersion: CurrentVersion,
+		Until:      until,
+	})
+	return &Packet{Cmd: ERROR, SubCmd: ERR_BANNED, Body: body}
+}
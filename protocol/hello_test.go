@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		name  string
+		hello Hello
+		ack   HelloAck
+		code  uint32
+	}{
+		{"默认值", Hello{Version: CurrentVersion},
+			HelloAck{Version: CurrentVersion, Codec: CodecBinary, Compress: CompressNone, Encrypt: EncryptNone}, 0},
+		{"按客户端的优先级", Hello{Version: CurrentVersion, Codecs: []string{"msgpack", CodecJSON, CodecBinary}, Compress: []string{CompressGzip}},
+			HelloAck{Version: CurrentVersion, Codec: CodecJSON, Compress: CompressGzip, Encrypt: EncryptNone}, 0},
+		{"客户端版本更高", Hello{Version: CurrentVersion + 3},
+			HelloAck{Version: CurrentVersion, Codec: CodecBinary, Compress: CompressNone, Encrypt: EncryptNone}, 0},
+		{"兼容上一个版本", Hello{Version: MinVersion},
+			HelloAck{Version: MinVersion, Codec: CodecBinary, Compress: CompressNone, Encrypt: EncryptNone}, 0},
+		{"版本太旧", Hello{Version: MinVersion - 1}, HelloAck{}, ERR_UPGRADE},
+		{"没有共同的编码", Hello{Version: CurrentVersion, Codecs: []string{"msgpack"}}, HelloAck{}, ERR_NEGOTIATE},
+		{"没有共同的压缩", Hello{Version: CurrentVersion, Compress: []string{"zstd"}}, HelloAck{}, ERR_NEGOTIATE},
+		{"没有共同的加密", Hello{Version: CurrentVersion, Encrypt: []string{"aes-gcm"}}, HelloAck{}, ERR_NEGOTIATE},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ack, code := Negotiate(&c.hello)
+			if code != c.code {
+				t.Fatalf("错误码 %d, 应该是 %d", code, c.code)
+			}
+			if code != 0 {
+				if ack != nil {
+					t.Fatalf("失败时不应该有结果: %+v", ack)
+				}
+				return
+			}
+			if *ack != c.ack {
+				t.Fatalf("协商结果 %+v, 应该是 %+v", *ack, c.ack)
+			}
+		})
+	}
+}
+
+// 错误包在所有版本里都能编码，老客户端也能看懂
+func TestErrorPacket(t *testing.T) {
+	for _, version := range []uint8{ProtocolV1, ProtocolV2} {
+		for _, code := range []uint32{ERR_UPGRADE, ERR_PROTOCOL, ERR_HELLO_REQUIRED, ERR_NEGOTIATE, ERR_AUTH, ERR_ROOM,
+			ERR_BUSY, ERR_RATE_LIMIT, ERR_KICKED, ERR_BANNED, ERR_DELETING} {
+			p := NewErrorPacket(code, "msg")
+			p.Version = version
+			p.Accid = 1
+			if _, err := EncodePacket(p); err != nil {
+				t.Fatalf("v%d 错误码 %d 编码失败: %v", version, code, err)
+			}
+			var body ErrorBody
+			if err := json.Unmarshal(p.Body, &body); err != nil || body.Code != code {
+				t.Fatalf("错误包消息体 %s: %v", p.Body, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+/**
+ * 服务器主动推送的通知，和错误包一样格式固定，不依赖协商的编码
+ */
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 重连原因
+const (
+	ReasonRestart = "restart" // 平滑重启，新进程已经在同一个端口上监听
+)
+
+// 维护通知的阶段
+const (
+	MaintenanceCountdown = "countdown" // 即将停服维护，倒计时
+	MaintenanceRefuse    = "refuse"    // 维护中，拒绝登录，随后断开
+	MaintenanceKick      = "kick"      // 维护开始，随后断开
+	MaintenanceCancel    = "cancel"    // 维护取消
+)
+
+// ReconnectBody RECONNECT 的消息体，客户端等 Delay 毫秒后重新连接同一个地址并重新登录
+type ReconnectBody struct {
+	Reason string `json:"reason"`
+	Delay  int64  `json:"delay"`
+}
+
+// NewReconnectPacket 创建重连通知，delay 用来把大量客户端的重连时间错开
+func NewReconnectPacket(reason string, delay time.Duration) *Packet {
+	body, _ := json.Marshal(ReconnectBody{
+		Reason: reason,
+		Delay:  delay.Milliseconds(),
+	})
+	return &Packet{Cmd: RECONNECT, Body: body}
+}
+
+// MaintenanceBody MAINTENANCE 的消息体，时间都是 unix 秒
+type MaintenanceBody struct {
+	Stage    string `json:"stage"`
+	Reason   string `json:"reason"`
+	Shutdown int64  `json:"shutdown"` // 停服时间
+	Until    int64  `json:"until"`    // 预计恢复时间
+	Remain   int64  `json:"remain"`   // 距离停服还有多少秒
+}
+
+// NewMaintenancePacket 创建维护通知
+func NewMaintenancePacket(stage string, reason string, shutdown time.Time, until time.Time) *Packet {
+	remain := int64(time.Until(shutdown).Seconds())
+	if remain < 0 {
+		remain = 0
+	}
+	body, _ := json.Marshal(MaintenanceBody{
+		Stage:    stage,
+		Reason:   reason,
+		Shutdown: shutdown.Unix(),
+		Until:    until.Unix(),
+		Remain:   remain,
+	})
+	return &Packet{Cmd: MAINTENANCE, Body: body}
+}
+
+// NoticeBody NOTICE 的消息体
+type NoticeBody struct {
+	Text string `json:"text"`
+	Time int64  `json:"time"` // 发布时间，unix 秒
+}
+
+// NewNoticePacket 创建系统公告
+func NewNoticePacket(text string) *Packet {
+	body, _ := json.Marshal(NoticeBody{
+		Text: text,
+		Time: time.Now().Unix(),
+	})
+	return &Packet{Cmd: NOTICE, Body: body}
+}
@@ -0,0 +1,313 @@
+package protocol
+
+/**
+ * 消息包的编解码
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gameserver/utils"
+	"io"
+	"io/ioutil"
+	"log/slog"
+)
+
+// 消息检验码
+const (
+	LegacyMagic = 65433 // v1 协议检验码，没有版本号，以\n分隔
+	PacketMagic = 65434 // v2 及以后的协议检验码，后面紧跟 1 字节版本号
+)
+
+// 协议版本
+const (
+	ProtocolV1 = 1 // 旧版协议
+	ProtocolV2 = 2 // 带版本号，按长度分包
+
+	CurrentVersion = ProtocolV2         // 服务器当前的协议版本
+	MinVersion     = CurrentVersion - 1 // 服务器最少兼容到 N-1 个版本
+)
+
+// 包头标志位
+const (
+	FlagCompressed = 1 << 0 // 消息体已压缩，压缩方式由 HELLO 协商
+	FlagTrace      = 1 << 1 // 包头后面跟着 25 字节的调用链上下文，不算在消息长度里，只有 v2 及以后支持
+
+	knownFlags = FlagCompressed | FlagTrace
+)
+
+const (
+	headerLenV1 = 28               // 检验码4 + 长度4 + 身份8 + 主命令4 + 子命令4 + 加密方式4
+	headerLenV2 = 30               // 检验码4 + 版本1 + 标志1 + 长度4 + 身份8 + 主命令4 + 子命令4 + 加密方式4
+	MaxBodyLen  = 64 * 1024        // 消息体最大长度
+	trailerV1   = "\x00\x00\x00\n" // v1 包尾，解码时会去掉最后4个字节
+
+	// MaxPacketLen 编码后一个包的最大长度：最长的包头、调用链、消息体和 v1 包尾
+	MaxPacketLen = headerLenV2 + traceLen + MaxBodyLen + len(trailerV1)
+)
+
+var (
+	// ErrProtocol 包结构错误，收到后直接断开连接
+	ErrProtocol = errors.New("协议错误")
+	// ErrBodyTooLarge 消息体超过 MaxBodyLen
+	ErrBodyTooLarge = errors.New("消息体过长")
+)
+
+// VersionError 客户端协议版本不被支持
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("不支持的协议版本: %d, 支持范围 %d-%d", e.Version, MinVersion, CurrentVersion)
+}
+
+// Packet 解码后的消息包，各个版本的协议最终都解析成这个结构
+type Packet struct {
+	Version uint8  // 协议版本
+	Flags   uint8  // 标志位
+	Accid   int64  // 身份（账号ID或者其他）
+	Cmd     uint32 // 主命令
+	SubCmd  uint32 // 子命令
+	Encrypt uint32 // 加密方式
+	Body    []byte // 消息体
+	Seq     uint32 // 请求序号，只有 JSON 信封会带上，二进制协议不编码
+	Trace   string // 调用链上下文，W3C traceparent 格式，客户端发起的命令可以带上
+}
+
+// Decoder 从 reader 中读出一个完整的包并解码
+type Decoder func(r *bufio.Reader) (*Packet, error)
+
+// Encoder 把包编码成可以直接写到连接上的字节
+type Encoder func(p *Packet) ([]byte, error)
+
+// 各个版本的解码器，去掉老版本时从这里删除
+var decoders = map[uint8]Decoder{
+	ProtocolV1: decodeV1,
+	ProtocolV2: decodeV2,
+}
+
+var encoders = map[uint8]Encoder{
+	ProtocolV1: encodeV1,
+	ProtocolV2: encodeV2,
+}
+
+// ReadPacket 根据检验码和版本号选择解码器，读出一个包
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	head, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	var version uint8
+	switch binary.BigEndian.Uint32(head[0:4]) {
+	case LegacyMagic:
+		version = ProtocolV1
+	case PacketMagic:
+		version = head[4]
+	default:
+		return nil, ErrProtocol
+	}
+	decoder, ok := decoders[version]
+	if !ok || version < MinVersion || version > CurrentVersion {
+		return nil, &VersionError{Version: version}
+	}
+	return decoder(r)
+}
+
+// EncodePacket 按 p.Version 编码，版本为0时使用当前版本
+func EncodePacket(p *Packet) ([]byte, error) {
+	if p.Version == 0 {
+		p.Version = CurrentVersion
+	}
+	encoder, ok := encoders[p.Version]
+	if !ok {
+		return nil, &VersionError{Version: p.Version}
+	}
+	return encoder(p)
+}
+
+// decodeV1
+// 解析旧版消息包
+// 消息检验码 4字节
+// 消息长度	4字节
+// 身份		8字节
+// 主命令	4字节
+// 子命令	4字节
+// 加密方式	4字节
+// 消息体	N字节（字节数组：消息长度+消息+消息长度+消息）
+// 分隔符	1字节
+func decodeV1(r *bufio.Reader) (*Packet, error) {
+	// 这里以\n为分隔，所以v1的消息体里面不能出现\n
+	bs, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) < headerLenV1+len(trailerV1) {
+		return nil, ErrProtocol
+	}
+	// 开始解析bytes
+	// 消息检验码
+	crccode := append([]byte{0, 0, 0, 0}, bs[0:4]...)
+	crccode_i := utils.BytesToInt(crccode)
+	if crccode_i != LegacyMagic {
+		return nil, ErrProtocol
+	}
+	// 消息长度 bs[4:8]，v1 按分隔符分包，用不到
+
+	p := &Packet{Version: ProtocolV1}
+	// 身份（账号ID或者其他）
+	p.Accid = int64(utils.BytesToInt(bs[8:16]))
+	// 主命令
+	p.Cmd = binary.BigEndian.Uint32(bs[16:20])
+	// 子命令
+	p.SubCmd = binary.BigEndian.Uint32(bs[20:24])
+	// 加密方式
+	p.Encrypt = binary.BigEndian.Uint32(bs[24:28])
+
+	// 消息体，剩下的是分隔符len(bs)-4
+	p.Body = bs[headerLenV1 : len(bs)-len(trailerV1)]
+	if len(p.Body)%8 != 0 {
+		slog.Debug("v1 消息体长度不是 8 的倍数", "len", len(p.Body))
+		return nil, ErrProtocol
+	}
+	return p, nil
+}
+
+func encodeV1(p *Packet) ([]byte, error) {
+	if bytes.IndexByte(p.Body, '\n') >= 0 {
+		return nil, ErrProtocol
+	}
+	// v1 要求消息体是 8 的倍数，错误包、通知这类 JSON 消息体在后面补空格，JSON 解析会忽略
+	body := p.Body
+	if n := len(body) % 8; n != 0 {
+		body = append(append([]byte{}, body...), bytes.Repeat([]byte{' '}, 8-n)...)
+	}
+	buf := make([]byte, headerLenV1, headerLenV1+len(body)+len(trailerV1))
+	binary.BigEndian.PutUint32(buf[0:4], LegacyMagic)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(body)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(p.Accid))
+	binary.BigEndian.PutUint32(buf[16:20], p.Cmd)
+	binary.BigEndian.PutUint32(buf[20:24], p.SubCmd)
+	binary.BigEndian.PutUint32(buf[24:28], p.Encrypt)
+	// 包头是二进制的，身份、子命令（比如房间号 10）、长度里都可能有 0x0a，v1 客户端按 \n 分包会被截断
+	if bytes.IndexByte(buf, '\n') >= 0 {
+		return nil, ErrProtocol
+	}
+	buf = append(buf, body...)
+	buf = append(buf, trailerV1...)
+	return buf, nil
+}
+
+// decodeV2
+// 解析 v2 消息包，按长度分包，消息体可以是任意字节
+// 消息检验码 4字节
+// 版本号	1字节
+// 标志位	1字节
+// 消息长度	4字节（只算消息体）
+// 身份		8字节
+// 主命令	4字节
+// 子命令	4字节
+// 加密方式	4字节
+// 调用链	25字节（标志位有 FlagTrace 时才有：trace-id 16 + parent-id 8 + trace-flags 1）
+// 消息体	N字节
+func decodeV2(r *bufio.Reader) (*Packet, error) {
+	head := make([]byte, headerLenV2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(head[0:4]) != PacketMagic {
+		return nil, ErrProtocol
+	}
+	if head[5]&^knownFlags != 0 {
+		return nil, ErrProtocol
+	}
+	bodyLen := binary.BigEndian.Uint32(head[6:10])
+	if bodyLen > MaxBodyLen {
+		return nil, ErrBodyTooLarge
+	}
+	p := &Packet{
+		Version: head[4],
+		Flags:   head[5],
+		Accid:   int64(binary.BigEndian.Uint64(head[10:18])),
+		Cmd:     binary.BigEndian.Uint32(head[18:22]),
+		SubCmd:  binary.BigEndian.Uint32(head[22:26]),
+		Encrypt: binary.BigEndian.Uint32(head[26:30]),
+		Body:    make([]byte, bodyLen),
+	}
+	if p.Flags&FlagTrace != 0 {
+		trace := make([]byte, traceLen)
+		if _, err := io.ReadFull(r, trace); err != nil {
+			return nil, err
+		}
+		p.Trace = formatTrace(trace)
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func encodeV2(p *Packet) ([]byte, error) {
+	if len(p.Body) > MaxBodyLen {
+		return nil, ErrBodyTooLarge
+	}
+	// 复用收到的包回复时，标志位可能带着 FlagTrace，按 Trace 字段重新算
+	trace := parseTrace(p.Trace)
+	flags := p.Flags &^ FlagTrace
+	if trace != nil {
+		flags |= FlagTrace
+	}
+	buf := make([]byte, headerLenV2, headerLenV2+len(trace)+len(p.Body))
+	binary.BigEndian.PutUint32(buf[0:4], PacketMagic)
+	buf[4] = p.Version
+	buf[5] = flags
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(p.Body)))
+	binary.BigEndian.PutUint64(buf[10:18], uint64(p.Accid))
+	binary.BigEndian.PutUint32(buf[18:22], p.Cmd)
+	binary.BigEndian.PutUint32(buf[22:26], p.SubCmd)
+	binary.BigEndian.PutUint32(buf[26:30], p.Encrypt)
+	buf = append(buf, trace...)
+	return append(buf, p.Body...), nil
+}
+
+// CompressBody 按协商的压缩方式压缩消息体
+func CompressBody(method string, body []byte) ([]byte, error) {
+	switch method {
+	case CompressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return body, nil
+}
+
+// DecompressBody 解压消息体，解压后同样受 MaxBodyLen 限制
+func DecompressBody(method string, body []byte) ([]byte, error) {
+	switch method {
+	case CompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, MaxBodyLen+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MaxBodyLen {
+			return nil, ErrBodyTooLarge
+		}
+		return out, nil
+	}
+	return body, nil
+}
@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+const testTrace = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		p    Packet
+		err  error // 编码时的错误，为 nil 时解码后要和原来一样
+	}{
+		{"v1", Packet{Version: ProtocolV1, Accid: 1001, Cmd: ROOM_JOIN, SubCmd: 3, Body: []byte("12345678")}, nil},
+		{"v1 空消息体", Packet{Version: ProtocolV1, Accid: 1, Cmd: ROOM_LEAVE}, nil},
+		{"v1 消息体有换行", Packet{Version: ProtocolV1, Cmd: ROOM_SYNC, Body: []byte("1234567\n")}, ErrProtocol},
+		{"v1 accid 10", Packet{Version: ProtocolV1, Accid: 10, Cmd: ROOM_SYNC}, ErrProtocol},
+		{"v1 accid 266", Packet{Version: ProtocolV1, Accid: 266, Cmd: ROOM_SYNC}, ErrProtocol},
+		{"v1 房间 10", Packet{Version: ProtocolV1, Accid: 1, Cmd: ROOM_STATE, SubCmd: 10}, ErrProtocol},
+		{"v1 消息体长度 2560", Packet{Version: ProtocolV1, Accid: 1, Cmd: ROOM_SYNC, Body: bytes.Repeat([]byte{'a'}, 2560)}, ErrProtocol},
+		{"v1 消息体长度 2816", Packet{Version: ProtocolV1, Accid: 1, Cmd: ROOM_SYNC, Body: bytes.Repeat([]byte{'a'}, 2816)}, nil},
+		{"v2", Packet{Version: ProtocolV2, Accid: 1001, Cmd: ROOM_JOIN, SubCmd: 3, Body: []byte("hello")}, nil},
+		{"v2 accid 10", Packet{Version: ProtocolV2, Accid: 10, Cmd: ROOM_SYNC, Body: []byte("a\nb")}, nil},
+		{"v2 房间 10", Packet{Version: ProtocolV2, Accid: 266, Cmd: ROOM_STATE, SubCmd: 10}, nil},
+		{"v2 消息体长度 2560", Packet{Version: ProtocolV2, Accid: 1, Cmd: ROOM_SYNC, Body: bytes.Repeat([]byte{'\n'}, 2560)}, nil},
+		{"v2 调用链", Packet{Version: ProtocolV2, Flags: FlagTrace, Accid: 1, Cmd: LOGIN_AUTH, Body: []byte("{}"), Trace: testTrace}, nil},
+		{"v2 压缩", Packet{Version: ProtocolV2, Flags: FlagCompressed, Accid: 1, Cmd: ROOM_SYNC, Body: []byte{0x1f, 0x8b}}, nil},
+		{"v2 最大消息体", Packet{Version: ProtocolV2, Cmd: ROOM_SYNC, Body: make([]byte, MaxBodyLen)}, nil},
+		{"v2 消息体过长", Packet{Version: ProtocolV2, Cmd: ROOM_SYNC, Body: make([]byte, MaxBodyLen+1)}, ErrBodyTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			want := c.p
+			bs, err := EncodePacket(&c.p)
+			if err != c.err {
+				t.Fatalf("编码错误 %v, 应该是 %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(bs) > MaxPacketLen {
+				t.Fatalf("编码后 %d 字节，超过 MaxPacketLen", len(bs))
+			}
+			r := bufio.NewReader(bytes.NewReader(bs))
+			got, err := ReadPacket(r)
+			if err != nil {
+				t.Fatalf("解码失败: %v", err)
+			}
+			if _, err := r.ReadByte(); err != io.EOF {
+				t.Fatal("解码后还有剩下的字节")
+			}
+			if got.Version != want.Version || got.Flags != want.Flags || got.Accid != want.Accid ||
+				got.Cmd != want.Cmd || got.SubCmd != want.SubCmd || got.Trace != want.Trace || !bytes.Equal(got.Body, want.Body) {
+				t.Fatalf("解码结果 %+v, 应该是 %+v", got, want)
+			}
+		})
+	}
+}
+
+// v1 消息体不是 8 的倍数时补空格
+func TestEncodeV1Padding(t *testing.T) {
+	bs, err := EncodePacket(&Packet{Version: ProtocolV1, Accid: 1, Cmd: ERROR, Body: []byte(`{"code":2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPacket(bufio.NewReader(bytes.NewReader(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Body) != `{"code":2}      ` {
+		t.Fatalf("消息体 %q", got.Body)
+	}
+}
+
+// 多个包连在一起时按顺序读出来
+func TestReadPacketStream(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range []*Packet{
+		{Version: ProtocolV2, Accid: 1, Cmd: HELLO, Body: []byte("{}")},
+		{Version: ProtocolV1, Accid: 1, Cmd: ROOM_SYNC, Body: []byte("abcdefgh")},
+		{Version: ProtocolV2, Accid: 1, Cmd: ROOM_SYNC, Body: []byte("\n\n")},
+	} {
+		bs, err := EncodePacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(bs)
+	}
+	r := bufio.NewReader(&buf)
+	for i, want := range []uint8{ProtocolV2, ProtocolV1, ProtocolV2} {
+		p, err := ReadPacket(r)
+		if err != nil {
+			t.Fatalf("第 %d 个包: %v", i, err)
+		}
+		if p.Version != want {
+			t.Fatalf("第 %d 个包版本 %d", i, p.Version)
+		}
+	}
+	if _, err := ReadPacket(r); err != io.EOF {
+		t.Fatalf("读完之后应该是 EOF, 是 %v", err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	valid, err := EncodePacket(&Packet{Version: ProtocolV2, Accid: 1, Cmd: ROOM_SYNC, Body: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func(bs []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"检验码错误", modify(func(bs []byte) []byte {
+			binary.BigEndian.PutUint32(bs[0:4], 12345)
+			return bs
+		}), ErrProtocol},
+		{"长度超过上限", modify(func(bs []byte) []byte {
+			binary.BigEndian.PutUint32(bs[6:10], MaxBodyLen+1)
+			return bs
+		}), ErrBodyTooLarge},
+		{"长度是负数", modify(func(bs []byte) []byte {
+			binary.BigEndian.PutUint32(bs[6:10], 0xffffffff)
+			return bs
+		}), ErrBodyTooLarge},
+		{"消息体不完整", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+		{"包头不完整", valid[:headerLenV2-1], io.ErrUnexpectedEOF},
+		{"调用链不完整", modify(func(bs []byte) []byte {
+			// 后面只剩 5 字节的消息体，不够 25 字节的调用链
+			bs[5] |= FlagTrace
+			return bs
+		}), io.ErrUnexpectedEOF},
+		{"未知标志位", modify(func(bs []byte) []byte {
+			bs[5] |= 1 << 7
+			return bs
+		}), ErrProtocol},
+		{"v1 没有分隔符", []byte{0, 0, 0xff, 0x99, 0, 0, 0, 0}, io.EOF},
+		{"v1 太短", []byte{0, 0, 0xff, 0x99, '\n'}, ErrProtocol},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ReadPacket(bufio.NewReader(bytes.NewReader(c.data)))
+			if err != c.err {
+				t.Fatalf("错误 %v, 应该是 %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	for _, version := range []uint8{0, CurrentVersion + 1, 255} {
+		bs, err := EncodePacket(&Packet{Version: ProtocolV2, Cmd: HELLO})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs[4] = version
+		_, err = ReadPacket(bufio.NewReader(bytes.NewReader(bs)))
+		var verr *VersionError
+		if !errors.As(err, &verr) || verr.Version != version {
+			t.Fatalf("版本 %d: 错误 %v", version, err)
+		}
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	body := bytes.Repeat([]byte("room sync "), 100)
+	compressed, err := CompressBody(CompressGzip, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecompressBody(CompressGzip, compressed)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("解压结果不一致: %v", err)
+	}
+	// 解压后超过上限的拒绝，防止压缩炸弹
+	bomb, err := CompressBody(CompressGzip, make([]byte, MaxBodyLen+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecompressBody(CompressGzip, bomb); err != ErrBodyTooLarge {
+		t.Fatalf("错误 %v, 应该是 ErrBodyTooLarge", err)
+	}
+	if _, err := DecompressBody(CompressGzip, []byte("not gzip")); err == nil {
+		t.Fatal("不是 gzip 的消息体应该解压失败")
+	}
+}
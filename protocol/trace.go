@@ -0,0 +1,39 @@
+package protocol
+
+/**
+ * 包头里的调用链上下文：W3C traceparent 的二进制形式，固定 25 字节
+ * traceparent 文本格式是 00-<trace-id 32位hex>-<parent-id 16位hex>-<trace-flags 2位hex>，
+ * 二进制里不带版本号，只支持 00 版本
+ */
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	traceLen         = 25 // trace-id 16 + parent-id 8 + trace-flags 1
+	traceparentLen   = 55 // 文本格式的长度
+	traceparentBegin = "00-"
+)
+
+// parseTrace traceparent 转成包头里的字节，为空或者格式错误时返回 nil，不带调用链
+func parseTrace(traceparent string) []byte {
+	if len(traceparent) != traceparentLen || !strings.HasPrefix(traceparent, traceparentBegin) {
+		return nil
+	}
+	parts := strings.Split(traceparent[len(traceparentBegin):], "-")
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := hex.DecodeString(parts[0] + parts[1] + parts[2])
+	if err != nil || len(b) != traceLen {
+		return nil
+	}
+	return b
+}
+
+// formatTrace 包头里的字节转成 traceparent，是否有效由使用的地方判断
+func formatTrace(b []byte) string {
+	return traceparentBegin + hex.EncodeToString(b[0:16]) + "-" + hex.EncodeToString(b[16:24]) + "-" + hex.EncodeToString(b[24:25])
+}
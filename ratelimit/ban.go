@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// BanStore 封禁的持久化，多个节点通过它共享封禁列表
+type BanStore interface {
+	Ban(ip string, until time.Time) error
+	Unban(ip string) error
+	List() (map[string]time.Time, error)
+}
+
+// BanList 临时封禁的 IP，到期自动解封
+// 设置了 BanStore 时，封禁和解封都会写过去，并定时同步其他节点和管理员的修改
+// 还没写进共享列表的修改（正在写或者写失败了）同步时保留在本地，并重试写入
+type BanList struct {
+	mu       sync.Mutex
+	until    map[string]time.Time
+	store    BanStore
+	unsaved  map[string]time.Time // 还没写进共享列表的封禁
+	unbanned map[string]bool      // 还没写进共享列表的解封
+}
+
+// NewBanList 创建封禁列表
+func NewBanList() *BanList {
+	return &BanList{
+		until:    make(map[string]time.Time),
+		unsaved:  make(map[string]time.Time),
+		unbanned: make(map[string]bool),
+	}
+}
+
+// UseStore 使用共享的封禁列表，每隔 interval 同步一次，启动时调用
+func (b *BanList) UseStore(store BanStore, interval time.Duration) {
+	b.mu.Lock()
+	b.store = store
+	b.mu.Unlock()
+	b.sync()
+	go func() {
+		for range time.Tick(interval) {
+			b.sync()
+		}
+	}()
+}
+
+// sync 先重试写失败的修改，再用共享的列表替换本地列表，读取失败时保留本地列表
+// 还没写进去的封禁和解封合并到共享的列表上，不会因为同步丢掉
+func (b *BanList) sync() {
+	b.retry()
+	list, err := b.store.List()
+	if err != nil {
+		slog.Error("同步封禁列表失败", "err", err)
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	for ip, until := range b.unsaved {
+		if !until.After(now) {
+			delete(b.unsaved, ip)
+			continue
+		}
+		if until.After(list[ip]) {
+			list[ip] = until
+		}
+	}
+	for ip := range b.unbanned {
+		delete(list, ip)
+	}
+	b.until = list
+	b.mu.Unlock()
+}
+
+// retry 重新写入之前写失败的封禁和解封
+func (b *BanList) retry() {
+	b.mu.Lock()
+	bans := make(map[string]time.Time, len(b.unsaved))
+	for ip, until := range b.unsaved {
+		bans[ip] = until
+	}
+	unbans := make([]string, 0, len(b.unbanned))
+	for ip := range b.unbanned {
+		unbans = append(unbans, ip)
+	}
+	b.mu.Unlock()
+	for ip, until := range bans {
+		if !until.After(time.Now()) {
+			continue
+		}
+		if err := b.store.Ban(ip, until); err != nil {
+			slog.Error("重试保存封禁失败", "ip", ip, "err", err)
+			continue
+		}
+		b.saved(ip, until)
+	}
+	for _, ip := range unbans {
+		if err := b.store.Unban(ip); err != nil {
+			slog.Error("重试解除封禁失败", "ip", ip, "err", err)
+			continue
+		}
+		b.mu.Lock()
+		delete(b.unbanned, ip)
+		b.mu.Unlock()
+	}
+}
+
+// saved 封禁已经写进共享列表，期间又改过的不算
+func (b *BanList) saved(ip string, until time.Time) {
+	b.mu.Lock()
+	if u, ok := b.unsaved[ip]; ok && u.Equal(until) {
+		delete(b.unsaved, ip)
+	}
+	b.mu.Unlock()
+}
+
+// Ban 封禁 ip 一段时间，已经封禁的取较晚的到期时间
+func (b *BanList) Ban(ip string, d time.Duration) {
+	b.mu.Lock()
+	until := time.Now().Add(d)
+	if old, ok := b.until[ip]; ok && !until.After(old) {
+		b.mu.Unlock()
+		return
+	}
+	b.until[ip] = until
+	store := b.store
+	if store != nil {
+		// 写进去之前同步也不会丢
+		b.unsaved[ip] = until
+		delete(b.unbanned, ip)
+	}
+	b.mu.Unlock()
+	if store != nil {
+		if err := store.Ban(ip, until); err != nil {
+			slog.Error("保存封禁失败，先在本节点生效，同步时重试", "ip", ip, "err", err)
+			return
+		}
+		b.saved(ip, until)
+	}
+}
+
+// Unban 解除封禁
+func (b *BanList) Unban(ip string) {
+	b.mu.Lock()
+	delete(b.until, ip)
+	delete(b.unsaved, ip)
+	store := b.store
+	if store != nil {
+		b.unbanned[ip] = true
+	}
+	b.mu.Unlock()
+	if store != nil {
+		if err := store.Unban(ip); err != nil {
+			slog.Error("解除封禁失败，同步时重试", "ip", ip, "err", err)
+			return
+		}
+		b.mu.Lock()
+		delete(b.unbanned, ip)
+		b.mu.Unlock()
+	}
+}
+
+// List 当前所有封禁及到期时间
+func (b *BanList) List() map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	list := make(map[string]time.Time, len(b.until))
+	for ip, until := range b.until {
+		if until.After(now) {
+			list[ip] = until
+		}
+	}
+	return list
+}
+
+// Banned 是否在封禁中
+func (b *BanList) Banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, ip)
+		return false
+	}
+	return true
+}
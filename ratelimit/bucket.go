@@ -0,0 +1,118 @@
+package ratelimit
+
+/**
+ * 令牌桶限速：桶里最多 Burst 个令牌，每秒补充 Rate 个，每次请求消耗一个，没有令牌时拒绝
+ */
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Rule 限速规则
+type Rule struct {
+	Rate  float64 `yaml:"rate"`  // 每秒补充的令牌数，0 表示不限制
+	Burst int     `yaml:"burst"` // 桶的容量，也就是允许的突发数量，不填时按 Rate 计算
+}
+
+// Unlimited 是否不限制
+func (r Rule) Unlimited() bool {
+	return r.Rate <= 0
+}
+
+func (r Rule) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.Rate))
+}
+
+// Bucket 一个令牌桶，可以在多个goroutine里使用
+type Bucket struct {
+	mu     sync.Mutex
+	rule   Rule
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket 创建装满令牌的桶
+func NewBucket(rule Rule) *Bucket {
+	return &Bucket{rule: rule, tokens: rule.capacity(), last: time.Now()}
+}
+
+// Allow 取一个令牌，没有令牌时返回 false
+func (b *Bucket) Allow() bool {
+	if b.rule.Unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.rule.capacity(), b.tokens+now.Sub(b.last).Seconds()*b.rule.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idle 桶已经补满并且有一段时间没用了，可以回收
+func (b *Bucket) idle(now time.Time, d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last) > d
+}
+
+// Keyed 按 key（比如 IP）分别限速，长时间不用的桶会被清理
+type Keyed struct {
+	mu        sync.Mutex
+	rule      Rule
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// 多久清理一次不用的桶，以及多久不用算作空闲
+const (
+	sweepInterval = time.Minute
+	idleTimeout   = 10 * time.Minute
+)
+
+// NewKeyed 创建按 key 限速
+func NewKeyed(rule Rule) *Keyed {
+	return &Keyed{rule: rule, buckets: make(map[string]*Bucket), lastSweep: time.Now()}
+}
+
+// SetRule 修改规则，已有的桶会重新创建
+func (k *Keyed) SetRule(rule Rule) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rule = rule
+	k.buckets = make(map[string]*Bucket)
+}
+
+// Allow 给 key 取一个令牌
+func (k *Keyed) Allow(key string) bool {
+	k.mu.Lock()
+	if k.rule.Unlimited() {
+		k.mu.Unlock()
+		return true
+	}
+	now := time.Now()
+	if now.Sub(k.lastSweep) > sweepInterval {
+		k.lastSweep = now
+		for key, b := range k.buckets {
+			if b.idle(now, idleTimeout) {
+				delete(k.buckets, key)
+			}
+		}
+	}
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rule)
+		k.buckets[key] = b
+	}
+	k.mu.Unlock()
+	return b.Allow()
+}
@@ -0,0 +1,198 @@
+package ratelimit
+
+/**
+ * 防刷：会话超过限速的消息按违规次数逐级处理，丢弃 -> 警告 -> 断开 -> 临时封禁 IP
+ * IP 级别的限速和封禁 tcp、udp、websocket、http 共用
+ */
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config 限速配置
+type Config struct {
+	Session  Rule            `yaml:"session"`  // 每个会话所有命令合计
+	Commands map[uint32]Rule `yaml:"commands"` // 按主命令单独限速，覆盖代码里的默认值
+	IP       Rule            `yaml:"ip"`       // 每个 IP 的新连接和 http 请求
+
+	Window          time.Duration `yaml:"window"`           // 会话违规计数的时间窗口
+	WarnAfter       int           `yaml:"warn-after"`       // 窗口内违规多少次后回复警告
+	DisconnectAfter int           `yaml:"disconnect-after"` // 窗口内违规多少次后断开
+	BanAfter        int           `yaml:"ban-after"`        // 同一个 IP 在 BanWindow 内被断开多少次后封禁，0 表示不封禁
+	BanWindow       time.Duration `yaml:"ban-window"`
+	BanDuration     time.Duration `yaml:"ban-duration"` // 临时封禁多久
+}
+
+// DefaultConfig 默认配置
+func DefaultConfig() Config {
+	return Config{
+		Session:         Rule{Rate: 50, Burst: 100},
+		IP:              Rule{Rate: 5, Burst: 20},
+		Window:          10 * time.Second,
+		WarnAfter:       5,
+		DisconnectAfter: 50,
+		BanAfter:        3,
+		BanWindow:       10 * time.Minute,
+		BanDuration:     10 * time.Minute,
+	}
+}
+
+// Action 违规后的处理
+type Action int
+
+const (
+	Drop       Action = iota // 丢弃这条消息
+	Warn                     // 丢弃并回复警告
+	Disconnect               // 断开连接
+)
+
+// 拒绝原因，用于统计
+const (
+	ReasonDropped      = "dropped"       // 会话超速，消息被丢弃
+	ReasonWarned       = "warned"        // 会话超速，回复了警告
+	ReasonDisconnected = "disconnected"  // 会话超速太多，被断开
+	ReasonBanned       = "banned"        // IP 被封禁
+	ReasonIPRate       = "ip_rate_limit" // IP 新连接或者请求太频繁
+)
+
+var (
+	mu     sync.RWMutex
+	config = DefaultConfig()
+
+	// IPs 每个 IP 的新连接和 http 请求限速
+	IPs = NewKeyed(config.IP)
+	// Bans 被临时封禁的 IP
+	Bans = NewBanList()
+
+	strikes   = make(map[string][]time.Time) // IP 被断开的时间，用来决定是否封禁
+	lastSweep = time.Now()                   // 上次清理 strikes 的时间
+	stats     sync.Map                       // 原因 -> *int64
+)
+
+// Setup 使用新的配置，启动时调用
+func Setup(cfg Config) {
+	mu.Lock()
+	config = cfg
+	mu.Unlock()
+	IPs.SetRule(cfg.IP)
+}
+
+// Current 当前配置
+func Current() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config
+}
+
+// Count 记录一次拒绝
+func Count(reason string) {
+	v, _ := stats.LoadOrStore(reason, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// Stats 按原因统计的拒绝次数
+func Stats() map[string]int64 {
+	m := make(map[string]int64)
+	stats.Range(func(k, v interface{}) bool {
+		m[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return m
+}
+
+// Host 取出地址里的 IP，没有端口时原样返回
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// AllowIP 新连接或者 http 请求进来时检查，被封禁或者太频繁时返回 false 和原因
+func AllowIP(ip string) (bool, string) {
+	if Bans.Banned(ip) {
+		Count(ReasonBanned)
+		return false, ReasonBanned
+	}
+	if !IPs.Allow(ip) {
+		Count(ReasonIPRate)
+		return false, ReasonIPRate
+	}
+	return true, ""
+}
+
+// Strike 会话因为刷消息被断开，同一个 IP 次数多了就临时封禁，返回是否被封禁
+func Strike(ip string) bool {
+	cfg := Current()
+	if cfg.BanAfter <= 0 {
+		return false
+	}
+	now := time.Now()
+	mu.Lock()
+	// 只被断开过一两次的 IP 不会再走到下面的清理，定期把整个表里过期的都删掉
+	if now.Sub(lastSweep) > sweepInterval {
+		lastSweep = now
+		for k, times := range strikes {
+			if now.Sub(times[len(times)-1]) >= cfg.BanWindow {
+				delete(strikes, k)
+			}
+		}
+	}
+	list := strikes[ip][:0]
+	for _, t := range strikes[ip] {
+		if now.Sub(t) < cfg.BanWindow {
+			list = append(list, t)
+		}
+	}
+	list = append(list, now)
+	banned := len(list) >= cfg.BanAfter
+	if banned {
+		delete(strikes, ip)
+	} else {
+		strikes[ip] = list
+	}
+	mu.Unlock()
+	if banned {
+		slog.Warn("IP 多次刷消息，临时封禁", "ip", ip, "duration", cfg.BanDuration)
+		Bans.Ban(ip, cfg.BanDuration)
+	}
+	return banned
+}
+
+// Violations 一个会话在时间窗口内的违规次数
+type Violations struct {
+	mu    sync.Mutex
+	count int
+	start time.Time
+}
+
+// Add 记一次违规，返回应该怎么处理
+func (v *Violations) Add() Action {
+	cfg := Current()
+	v.mu.Lock()
+	now := time.Now()
+	if now.Sub(v.start) > cfg.Window {
+		v.start = now
+		v.count = 0
+	}
+	v.count++
+	n := v.count
+	v.mu.Unlock()
+	switch {
+	case cfg.DisconnectAfter > 0 && n >= cfg.DisconnectAfter:
+		Count(ReasonDisconnected)
+		return Disconnect
+	case cfg.WarnAfter > 0 && n >= cfg.WarnAfter && (n-cfg.WarnAfter)%cfg.WarnAfter == 0:
+		// 警告也不要每条都回，不然等于帮对方放大流量
+		Count(ReasonWarned)
+		return Warn
+	default:
+		Count(ReasonDropped)
+		return Drop
+	}
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"gameserver/protocol"
+	"gameserver/ratelimit"
+	"gameserver/tcp/sync/atomic"
+	"sync"
+)
+
+// 会话属性里保存限速状态的 key
+const attrLimit = "ratelimit"
+
+// sessionLimit 一个会话的令牌桶和违规次数
+type sessionLimit struct {
+	total      *ratelimit.Bucket
+	mu         sync.Mutex
+	commands   map[uint32]*ratelimit.Bucket
+	violations ratelimit.Violations
+	kicked     atomic.Boolean // 已经因为刷消息断开，缓冲区里剩下的消息直接丢弃，不再重复计数
+}
+
+// Limit 给主命令单独限速，比如聊天每秒 2 条、移动每秒 30 条，在会话的总限速之外再检查
+func (r *Router) Limit(cmd uint32, rule ratelimit.Rule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limits[cmd] = rule
+}
+
+// UseLimits 开启会话限速，配置里的命令限速覆盖代码里的默认值，必须在开始服务之前调用
+func (r *Router) UseLimits(cfg ratelimit.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cmd, rule := range cfg.Commands {
+		r.limits[cmd] = rule
+	}
+	r.sessionRule = cfg.Session
+	r.limitEnabled = true
+}
+
+// allow 检查会话限速，超速时按违规次数丢弃、警告或者断开
+func (r *Router) allow(s Session, p *protocol.Packet) bool {
+	r.mu.RLock()
+	enabled := r.limitEnabled
+	rule, hasRule := r.limits[p.Cmd]
+	sessionRule := r.sessionRule
+	r.mu.RUnlock()
+	if !enabled {
+		return true
+	}
+	v, ok := s.Attributes().Get(attrLimit)
+	if !ok {
+		v, _ = s.Attributes().LoadOrStore(attrLimit, &sessionLimit{
+			total:    ratelimit.NewBucket(sessionRule),
+			commands: make(map[uint32]*ratelimit.Bucket),
+		})
+	}
+	l := v.(*sessionLimit)
+	if l.kicked.Get() {
+		return false
+	}
+	allowed := l.total.Allow()
+	if allowed && hasRule {
+		l.mu.Lock()
+		b := l.commands[p.Cmd]
+		if b == nil {
+			b = ratelimit.NewBucket(rule)
+			l.commands[p.Cmd] = b
+		}
+		l.mu.Unlock()
+		allowed = b.Allow()
+	}
+	if allowed {
+		return true
+	}
+
+	switch l.violations.Add() {
+	case ratelimit.Warn:
+		LogPacket(s, p).Warn("会话发送太快，警告")
+		e := protocol.NewErrorPacket(protocol.ERR_RATE_LIMIT, "too many requests")
+		e.Seq = p.Seq
+		_ = s.Send(e)
+	case ratelimit.Disconnect:
+		l.kicked.Set(true)
+		LogPacket(s, p).Warn("会话持续刷消息，断开")
+		_ = s.Send(protocol.NewErrorPacket(protocol.ERR_RATE_LIMIT, "too many requests, disconnected"))
+		_ = s.Close()
+		if ip := s.ClientIP(); ip != "" {
+			ratelimit.Strike(ip)
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package session
+
+import (
+	"gameserver/protocol"
+	"log/slog"
+)
+
+// Log 带上会话信息的日志：会话ID、账号、传输方式和客户端 IP
+func Log(s Session) *slog.Logger {
+	return slog.With("session", s.ID(), "accid", s.Accid(), "transport", s.Transport(), "ip", s.ClientIP())
+}
+
+// LogPacket 在 Log 的基础上再带上命令，处理函数里用它记日志
+func LogPacket(s Session, p *protocol.Packet) *slog.Logger {
+	return Log(s).With("cmd", p.Cmd, "sub", p.SubCmd, "seq", p.Seq)
+}
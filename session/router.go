@@ -0,0 +1,238 @@
+package session
+
+import (
+	"context"
+	"gameserver/metrics"
+	"gameserver/protocol"
+	"gameserver/ratelimit"
+	"gameserver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// HandlerFunc 命令处理函数，ctx 带着这个命令的调用链，查数据库、redis 时传下去
+type HandlerFunc func(ctx context.Context, s Session, p *protocol.Packet)
+
+type route struct {
+	handler HandlerFunc
+	public  bool // 未认证也可以调用，比如 LOGIN_AUTH
+}
+
+// LoginFilter 登录前的检查，返回非 nil 时拒绝登录，返回的包会发给客户端
+type LoginFilter func(ctx context.Context, s Session, accid int64) *protocol.Packet
+
+// Router 按主命令把包分发给处理函数，所有传输方式共用一个 Router
+// 同时记录已经登录的会话，用于全服广播
+type Router struct {
+	mu      sync.RWMutex
+	routes  map[uint32]*route
+	onClose []func(s Session)
+	filters []LoginFilter
+
+	onlineMu sync.RWMutex
+	online   map[int64]Session // 会话ID -> 已登录的会话
+
+	pool *workerPool // 为 nil 时在调用 Dispatch 的协程里直接处理
+
+	limitEnabled bool                      // 是否开启会话限速
+	sessionRule  ratelimit.Rule            // 每个会话所有命令合计的限速
+	limits       map[uint32]ratelimit.Rule // 按主命令的限速
+}
+
+// NewRouter 创建命令路由
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[uint32]*route),
+		online: make(map[int64]Session),
+		limits: make(map[uint32]ratelimit.Rule),
+	}
+}
+
+// Handle 注册需要认证后才能调用的命令
+func (r *Router) Handle(cmd uint32, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[cmd] = &route{handler: h}
+}
+
+// HandlePublic 注册不需要认证的命令
+func (r *Router) HandlePublic(cmd uint32, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[cmd] = &route{handler: h, public: true}
+}
+
+// OnClose 注册会话断开时的回调，比如离开房间
+func (r *Router) OnClose(f func(s Session)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onClose = append(r.onClose, f)
+}
+
+// FilterLogin 注册登录检查，比如停服维护时不让新玩家进来
+func (r *Router) FilterLogin(f LoginFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filters = append(r.filters, f)
+}
+
+// Login 账号校验通过后由传输层或者 LOGIN_AUTH 调用：依次执行登录检查，都通过时绑定账号并记为在线
+// 被拒绝时返回要发给客户端的包，调用方发送后断开连接
+func (r *Router) Login(ctx context.Context, s Session, accid int64) *protocol.Packet {
+	r.mu.RLock()
+	filters := r.filters
+	r.mu.RUnlock()
+	for _, f := range filters {
+		if p := f(ctx, s, accid); p != nil {
+			// 被拒绝时记回复的命令号，比如维护
+			metrics.Login(s.Transport(), int(p.Cmd))
+			return p
+		}
+	}
+	metrics.Login(s.Transport(), 0)
+	s.Authenticate(accid)
+	r.onlineMu.Lock()
+	r.online[s.ID()] = s
+	r.onlineMu.Unlock()
+	return nil
+}
+
+// Online 所有已登录的会话
+func (r *Router) Online() []Session {
+	r.onlineMu.RLock()
+	defer r.onlineMu.RUnlock()
+	list := make([]Session, 0, len(r.online))
+	for _, s := range r.online {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Broadcast 发给所有已登录的会话，不管是哪种连接
+func (r *Router) Broadcast(p *protocol.Packet) {
+	for _, s := range r.Online() {
+		// 每个连接编码方式可能不一样，各发一份拷贝
+		cp := *p
+		_ = s.Send(&cp)
+	}
+}
+
+// UseWorkers 开启工作协程池，必须在开始服务之前调用
+func (r *Router) UseWorkers(cfg WorkerConfig) {
+	if cfg.Workers <= 0 {
+		return
+	}
+	r.pool = newWorkerPool(cfg, func(j job) {
+		if j.closed {
+			r.closed(j.s)
+		} else {
+			r.dispatch(j.ctx, j.s, j.p)
+		}
+	})
+	slog.Info("开启工作协程池", "workers", cfg.Workers, "queue_size", cfg.QueueSize)
+	metrics.GaugeFunc("worker_queue", "工作协程池里等待处理的消息数", func() float64 {
+		return float64(r.Pending())
+	})
+}
+
+// Stop 停止工作协程池，等已经排队的消息处理完，服务器关闭时调用
+func (r *Router) Stop() {
+	if r.pool != nil {
+		r.pool.stop()
+	}
+}
+
+// Pending 工作协程池里等待处理的消息数
+func (r *Router) Pending() int {
+	if r.pool == nil {
+		return 0
+	}
+	return r.pool.pending()
+}
+
+// Dispatch 分发一个包，超过限速的直接丢弃，开启工作协程池时放进会话对应的队列，队列满了回复服务器繁忙
+// 收到包时开始命令的 span，包括在队列里等待的时间，客户端带了调用链时接在后面
+func (r *Router) Dispatch(s Session, p *protocol.Packet) {
+	label := r.cmdLabel(p.Cmd)
+	metrics.PacketsIn.WithLabelValues(s.Transport(), label).Inc()
+	ctx, span := tracing.Start(tracing.Extract(context.Background(), p.Trace), "cmd "+label,
+		attribute.String("transport", s.Transport()),
+		attribute.Int64("session", s.ID()),
+		attribute.Int64("accid", s.Accid()),
+		attribute.Int64("cmd", int64(p.Cmd)),
+		attribute.Int64("sub", int64(p.SubCmd)),
+	)
+	if !r.allow(s, p) {
+		span.SetAttributes(attribute.Bool("rate_limited", true))
+		span.End()
+		return
+	}
+	if r.pool == nil {
+		r.dispatch(ctx, s, p)
+		return
+	}
+	if !r.pool.submit(job{ctx: ctx, s: s, p: p}, false) {
+		span.SetAttributes(attribute.Bool("busy", true))
+		span.End()
+		LogPacket(s, p).Warn("服务器繁忙，丢弃消息")
+		e := protocol.NewErrorPacket(protocol.ERR_BUSY, "server busy")
+		e.Seq = p.Seq
+		_ = s.Send(e)
+	}
+}
+
+// dispatch 执行处理函数，未认证的会话调用需要认证的命令时断开，结束 Dispatch 开始的 span
+func (r *Router) dispatch(ctx context.Context, s Session, p *protocol.Packet) {
+	defer trace.SpanFromContext(ctx).End()
+	r.mu.RLock()
+	rt := r.routes[p.Cmd]
+	r.mu.RUnlock()
+	if rt == nil {
+		LogPacket(s, p).Warn("未知命令")
+		return
+	}
+	if !rt.public && !s.Authed() {
+		LogPacket(s, p).Warn("未认证的会话调用命令")
+		_ = s.Send(protocol.NewErrorPacket(protocol.ERR_AUTH, "login auth required"))
+		_ = s.Close()
+		return
+	}
+	start := time.Now()
+	rt.handler(ctx, s, p)
+	metrics.HandlerSeconds.WithLabelValues(metrics.Cmd(p.Cmd)).Observe(time.Since(start).Seconds())
+}
+
+// cmdLabel 指标里的命令标签，没有注册的命令合在一起
+func (r *Router) cmdLabel(cmd uint32) string {
+	r.mu.RLock()
+	_, ok := r.routes[cmd]
+	r.mu.RUnlock()
+	if !ok {
+		return metrics.UnknownCmd
+	}
+	return metrics.Cmd(cmd)
+}
+
+// Closed 传输层在会话断开后调用，每个会话只能调用一次
+// 开启工作协程池时排在这个会话已有的消息后面，保证离开房间这类回调在最后执行
+func (r *Router) Closed(s Session) {
+	if r.pool != nil && r.pool.submit(job{s: s, closed: true}, true) {
+		return
+	}
+	r.closed(s)
+}
+
+func (r *Router) closed(s Session) {
+	r.onlineMu.Lock()
+	delete(r.online, s.ID())
+	r.onlineMu.Unlock()
+	r.mu.RLock()
+	callbacks := r.onClose
+	r.mu.RUnlock()
+	for _, f := range callbacks {
+		f(s)
+	}
+}
@@ -0,0 +1,104 @@
+package session
+
+/**
+ * 和传输层无关的会话抽象，tcp、udp、websocket 的连接都实现 Session，
+ * 游戏逻辑只面向 Session 编写，不同客户端可以在同一局里对战
+ */
+
+import (
+	"gameserver/protocol"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 传输方式
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+	TransportWS  = "ws"
+)
+
+// Session 一个客户端连接
+type Session interface {
+	ID() int64                     // 会话ID，进程内唯一
+	Accid() int64                  // 认证后绑定的账号ID，未认证时为 0
+	Authed() bool                  // 是否已经认证
+	Authenticate(accid int64)      // 认证通过后绑定账号
+	Send(p *protocol.Packet) error // 发送一个包，按连接协商的格式编码
+	Close() error                  // 关闭连接
+	RemoteAddr() net.Addr          // 对端地址
+	ClientIP() string              // 客户端真实 IP，在负载均衡后面时从 PROXY 协议或者 X-Forwarded-For 取得
+	Transport() string             // 传输方式
+	Attributes() *Attributes       // 会话上挂的自定义数据，比如所在房间
+}
+
+// RTTer 能测量往返时间的会话，管理接口展示用
+type RTTer interface {
+	RTT() time.Duration
+}
+
+// RTT 会话的往返时间，不支持测量或者还没有样本时为 0
+func RTT(s Session) time.Duration {
+	if r, ok := s.(RTTer); ok {
+		return r.RTT()
+	}
+	return 0
+}
+
+// 会话认证用的 token 存在属性里的 key
+const attrToken = "token"
+
+// SetToken 记下会话认证用的 token，token 作废时按它把会话踢下线
+func SetToken(s Session, token string) {
+	s.Attributes().Set(attrToken, token)
+}
+
+// Token 会话认证用的 token，还没认证时为空
+func Token(s Session) string {
+	if v, ok := s.Attributes().Get(attrToken); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// 会话ID，所有传输方式共用一个计数器
+var lastID int64
+
+// NextID 分配一个新的会话ID
+func NextID() int64 {
+	return atomic.AddInt64(&lastID, 1)
+}
+
+// Attributes 并发安全的键值对
+type Attributes struct {
+	m sync.Map
+}
+
+// Get 读取属性
+func (a *Attributes) Get(key string) (interface{}, bool) {
+	return a.m.Load(key)
+}
+
+// Set 设置属性
+func (a *Attributes) Set(key string, val interface{}) {
+	a.m.Store(key, val)
+}
+
+// LoadOrStore 属性存在时返回已有的值，不存在时设置为 val，两个goroutine同时初始化时只有一个生效
+func (a *Attributes) LoadOrStore(key string, val interface{}) (interface{}, bool) {
+	return a.m.LoadOrStore(key, val)
+}
+
+// Delete 删除属性
+func (a *Attributes) Delete(key string) {
+	a.m.Delete(key)
+}
+
+// Range 遍历属性，f 返回 false 时停止
+func (a *Attributes) Range(f func(key string, val interface{}) bool) {
+	a.m.Range(func(k, v interface{}) bool {
+		return f(k.(string), v)
+	})
+}
@@ -0,0 +1,120 @@
+package session
+
+/**
+ * 工作协程池：按会话ID把消息分到固定数量的 worker 上执行
+ * 同一个会话的消息总在同一个 worker 里按顺序处理，处理函数慢（比如查数据库）也不会卡住读协程
+ */
+
+import (
+	"context"
+	"gameserver/protocol"
+	"runtime/debug"
+	"sync"
+)
+
+// WorkerConfig 工作协程池配置
+type WorkerConfig struct {
+	Workers   int `yaml:"workers"`    // worker 数量，0 表示在读协程里直接处理
+	QueueSize int `yaml:"queue-size"` // 每个 worker 的队列长度，满了之后回复服务器繁忙
+}
+
+// 没有配置队列长度时的默认值
+const defaultQueueSize = 256
+
+type job struct {
+	ctx    context.Context // 命令的调用链
+	s      Session
+	p      *protocol.Packet
+	closed bool // 会话断开，也要排在这个会话前面的消息后面处理
+}
+
+type workerPool struct {
+	mu      sync.RWMutex
+	stopped bool
+	queues  []chan job
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(cfg WorkerConfig, run func(j job)) *workerPool {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	w := &workerPool{queues: make([]chan job, cfg.Workers)}
+	for i := range w.queues {
+		q := make(chan job, cfg.QueueSize)
+		w.queues[i] = q
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for j := range q {
+				safeRun(run, j)
+			}
+		}()
+	}
+	return w
+}
+
+// safeRun 一个 worker 服务很多会话，处理函数 panic 不能把 worker 带走
+func safeRun(run func(j job), j job) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log(j.s).Error("处理消息时panic", "err", err, "stack", string(debug.Stack()))
+		}
+	}()
+	run(j)
+}
+
+// submit 放入会话对应的队列，队列满时 wait 为 false 直接返回 false，为 true 时在后台等队列有空位
+// 已经停止时也返回 false，由调用方自己处理
+func (w *workerPool) submit(j job, wait bool) bool {
+	w.mu.RLock()
+	if w.stopped {
+		w.mu.RUnlock()
+		return false
+	}
+	q := w.queues[uint64(j.s.ID())%uint64(len(w.queues))]
+	select {
+	case q <- j:
+		w.mu.RUnlock()
+		return true
+	default:
+	}
+	w.mu.RUnlock()
+	if !wait {
+		return false
+	}
+	// 调用方可能就是这个 worker 自己（处理函数里关闭连接），不能在这里阻塞
+	// 这个会话后面不会再有消息，晚一点入队不影响顺序
+	go func() {
+		w.mu.RLock()
+		defer w.mu.RUnlock()
+		if !w.stopped {
+			q <- j
+		}
+	}()
+	return true
+}
+
+// stop 不再接收新的消息，等队列里已有的处理完
+func (w *workerPool) stop() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// pending 所有队列里等待处理的消息数
+func (w *workerPool) pending() int {
+	n := 0
+	for _, q := range w.queues {
+		n += len(q)
+	}
+	return n
+}
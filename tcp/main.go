@@ -1,17 +1,137 @@
 package main
 
 import (
+	"flag"
+	"gameserver/admin"
+	"gameserver/game"
+	"gameserver/gm"
+	"gameserver/ipfilter"
+	"gameserver/logger"
+	"gameserver/model"
+	"gameserver/ratelimit"
+	"gameserver/session"
+	"gameserver/tcp/restart"
+	"gameserver/tcp/rudp"
 	"gameserver/tcp/tcp"
+	"gameserver/tracing"
+	"gameserver/websocket/wsocket"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
 )
 
+// serverConfig 配置文件的结构，tcp 配置在顶层
+type serverConfig struct {
+	tcp.Config `yaml:",inline"`
+	WebSocket  wsocket.Config       `yaml:"websocket"`  // 同时提供 websocket 服务，和 tcp 玩家共用房间，地址为空时不开启
+	Workers    session.WorkerConfig `yaml:"workers"`    // 消息处理的工作协程池，tcp、udp、websocket 共用
+	RateLimit  ratelimit.Config     `yaml:"rate-limit"` // 会话和 IP 限速，超速后逐级丢弃、警告、断开、封禁
+	IPFilter   ipfilter.Config      `yaml:"ip-filter"`  // 新连接的黑白名单和单个 IP 连接数上限
+
+	Admin   admin.Config   `yaml:"admin"`   // 管理端口：健康检查、就绪检查、指标和 pprof
+	Log     logger.Config  `yaml:"log"`     // 日志级别、格式和采样
+	Tracing tracing.Config `yaml:"tracing"` // 调用链追踪的导出方式和采样
+}
+
 func main() {
+	configFile := flag.String("c", "", "配置文件路径（yaml），不指定时使用默认配置")
+	flag.Parse()
+
 	//tcp config
-	var config tcp.Config
+	var config serverConfig
 	config.Address = "127.0.0.1:20001"
 	config.MaxConnect = 10000
 	config.Timeout = 60
+	config.UDP.Address = "127.0.0.1:20001"
+	config.UDP.Config = rudp.DefaultConfig()
+	config.WebSocket.MaxConnect = 10000
+	config.Workers.Workers = 64
+	config.Workers.QueueSize = 256
+	config.RateLimit = ratelimit.DefaultConfig()
+	config.Admin.Address = "127.0.0.1:9101"
+	config.Log = logger.DefaultConfig()
+	config.Tracing = tracing.DefaultConfig()
+	if *configFile != "" {
+		if err := tcp.LoadConfig(*configFile, &config); err != nil {
+			slog.Error("读取配置文件失败", "file", *configFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	if err := logger.Setup(config.Log); err != nil {
+		slog.Error("日志配置错误", "err", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := tracing.Setup(config.Tracing, "gameserver")
+	if err != nil {
+		slog.Error("调用链追踪配置错误", "err", err)
+		os.Exit(1)
+	}
+
+	if config.Admin.Address != "" {
+		game.AddReadyChecks()
+		admin.HandleAPI("/api/", gm.Handler())
+		// 管理端口起不来时就绪检查一直失败，负载均衡不会把玩家转过来，直接退出，错误已经记了日志
+		go func() {
+			if err := admin.ListenAndServe(config.Admin); err != nil {
+				os.Exit(1)
+			}
+		}()
+		if config.Admin.Console != "" {
+			go func() {
+				if err := gm.ServeConsole(config.Admin.Console, config.Admin.Operators); err != nil {
+					os.Exit(1)
+				}
+			}()
+		}
+	}
 
 	// 创建
-	shandler := tcp.ServeHandler{}
-	tcp.ListenAndServeWithSignal(&config, &shandler)
+	router := game.NewRouter()
+	router.UseWorkers(config.Workers)
+	gm.Setup(router)
+	// 其他节点上封禁、踢人时，本节点上这个账号的会话也要断开
+	go gm.WatchKicks()
+	go gm.WatchRevokedTokens()
+	ratelimit.Setup(config.RateLimit)
+	router.UseLimits(config.RateLimit)
+	if err := ipfilter.Setup(config.IPFilter); err != nil {
+		slog.Error("连接过滤配置错误", "err", err)
+		os.Exit(1)
+	}
+	// 封禁保存在 redis 里，所有节点共享
+	ratelimit.Bans.UseStore(model.IPBanStore{}, 5*time.Second)
+	shandler := tcp.ServeHandler{Router: router}
+	gm.AddSessions(shandler.Sessions)
+	// 网页客户端和原生客户端在同一个进程里才能进同一个房间
+	if config.WebSocket.Address != "" {
+		// 先同步监听，平滑重启时新进程要在通知旧进程之前拿到继承的 socket
+		ln, err := wsocket.Listen(&config.WebSocket)
+		if err != nil {
+			os.Exit(1)
+		}
+		gm.AddSessions(wsocket.Sessions)
+		go func() {
+			if err := wsocket.Serve(ln, &config.WebSocket, router); err != nil {
+				slog.Error("websocket服务器退出", "err", err)
+			}
+		}()
+		// 平滑重启时 websocket 连接发 1001 关闭帧，浏览器重连到新进程
+		go func() {
+			<-restart.Forked()
+			_ = wsocket.Shutdown(config.WebSocket.ShutdownTimeout)
+		}()
+	}
+	// 停服维护的对局都结束后，走和 kill 一样的关闭流程
+	go game.WatchMaintenance(router, func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	})
+	tcp.ListenAndServeWithSignal(&config.Config, &shandler)
+	// tcp 收到退出信号并关闭后，websocket 也一起关闭
+	if config.WebSocket.Address != "" {
+		_ = wsocket.Shutdown(config.WebSocket.ShutdownTimeout)
+	}
+	// 连接都关了，等排队的消息和断线回调处理完
+	router.Stop()
+	shutdownTracing()
 }
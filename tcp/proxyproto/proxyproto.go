@@ -0,0 +1,247 @@
+package proxyproto
+
+/**
+ * PROXY 协议（v1 文本和 v2 二进制），服务器在 L4 负载均衡后面时，从连接开头的 PROXY 头取得客户端真实地址
+ * Listener 包装原来的监听，读 PROXY 头在单独的goroutine里，慢的连接不会卡住 Accept
+ * 只解析受信任的负载均衡发来的连接，其他连接原样交出去
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"gameserver/ipfilter"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config PROXY 协议配置
+type Config struct {
+	Enable        bool          `yaml:"enable"`
+	Trusted       []string      `yaml:"trusted"`        // 负载均衡的网段，只有从这里来的连接才解析 PROXY 头，为空时所有连接都必须带
+	HeaderTimeout time.Duration `yaml:"header-timeout"` // 连接后必须在这个时间内发完 PROXY 头
+}
+
+const (
+	// 没有配置时等待 PROXY 头的时间
+	defaultHeaderTimeout = 5 * time.Second
+	// v1 头的最大长度，包括 \r\n
+	maxV1Length = 107
+	// v2 地址部分的最大长度，后面可能带 TLV，多了认为是错误的头
+	maxV2Length = 1024
+)
+
+// v2 头的前 12 个字节
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader PROXY 头格式错误
+var ErrInvalidHeader = errors.New("PROXY协议头格式错误")
+
+// Listener 解析 PROXY 头的监听，Accept 返回的连接 RemoteAddr 是客户端真实地址
+type Listener struct {
+	net.Listener
+	trusted ipfilter.Nets
+	timeout time.Duration
+
+	conns    chan net.Conn
+	done     chan struct{}
+	err      error // 底层 Accept 的错误，done 关闭后可以读
+	doneOnce sync.Once
+}
+
+// NewListener 包装监听，关闭返回的 Listener 会关闭原来的监听
+func NewListener(l net.Listener, cfg Config) (*Listener, error) {
+	trusted, err := ipfilter.ParseNets(cfg.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = defaultHeaderTimeout
+	}
+	pl := &Listener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  cfg.HeaderTimeout,
+		conns:    make(chan net.Conn, 128),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+// Accept 等待下一个读完 PROXY 头的连接
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			l.doneOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+// handshake 读 PROXY 头，成功后交给 Accept
+func (l *Listener) handshake(c net.Conn) {
+	conn := c
+	if len(l.trusted) == 0 || l.trusted.ContainsAddr(c.RemoteAddr().String()) {
+		pc, err := readHeader(c, l.timeout)
+		if err != nil {
+			slog.Warn("PROXY协议头错误，断开", "addr", c.RemoteAddr().String(), "err", err)
+			_ = c.Close()
+			return
+		}
+		conn = pc
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+// Conn 去掉了 PROXY 头的连接
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader // PROXY 头后面可能已经读进来了数据
+	remote net.Addr
+}
+
+// Read 先读缓冲里剩下的数据
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr 客户端真实地址，负载均衡自己的健康检查（LOCAL）是负载均衡的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ProxyAddr 负载均衡的地址
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader 读 PROXY 头，v1 和 v2 都支持
+func readHeader(c net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(c, 256)
+	// v1 和 v2 的头都不会短于 12 个字节
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		addr, err = readV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		addr, err = readV1(r)
+	default:
+		err = ErrInvalidHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = c.RemoteAddr()
+	}
+	return &Conn{Conn: c, r: r, remote: addr}, nil
+}
+
+// readV1 PROXY TCP4 源IP 目的IP 源端口 目的端口\r\n，UNKNOWN 时返回 nil
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrInvalidHeader
+		}
+		return nil, err
+	}
+	if len(line) > maxV1Length || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2 二进制格式：12 字节签名，版本和命令，地址族，2 字节长度，然后是地址
+// LOCAL 命令（负载均衡的健康检查）和不认识的地址族返回 nil
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > maxV2Length {
+		return nil, ErrInvalidHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+	var ip net.IP
+	var port uint16
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		ip = net.IP(payload[0:4])
+		port = binary.BigEndian.Uint16(payload[8:10])
+	case 2: // AF_INET6
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		ip = net.IP(payload[0:16])
+		port = binary.BigEndian.Uint16(payload[32:34])
+	default:
+		return nil, nil
+	}
+	if hdr[13]&0x0f == 2 { // DGRAM
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,206 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// v2 头：签名、版本和命令、地址族和协议、长度、地址
+func v2Header(cmd byte, family byte, addr []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+	return append(b, addr...)
+}
+
+// v2 的地址部分：源地址、目的地址、源端口、目的端口
+func v2Addr(src, dst net.IP, sport, dport uint16) []byte {
+	b := append(append([]byte{}, src...), dst...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := v2Addr(net.ParseIP("192.0.2.1").To4(), net.ParseIP("10.0.0.1").To4(), 56324, 20001)
+	v6 := v2Addr(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 20001)
+	oversized := v2Header(0x1, 0x11, nil)
+	binary.BigEndian.PutUint16(oversized[14:16], maxV2Length+1)
+	cases := []struct {
+		name   string
+		data   []byte
+		remote string // 为空时是连接本来的地址
+		err    error
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 20001\r\n"), "192.0.2.1:56324", nil},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 20001\r\n"), "[2001:db8::1]:56324", nil},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v2 IPv4", v2Header(0x1, 0x11, v4), "192.0.2.1:56324", nil},
+		{"v2 IPv6", v2Header(0x1, 0x21, v6), "[2001:db8::1]:56324", nil},
+		{"v2 IPv4 带 TLV", v2Header(0x1, 0x11, append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", nil},
+		{"v2 LOCAL", v2Header(0x0, 0x00, nil), "", nil},
+		{"v1 不完整", []byte("PROXY TCP4 192.0.2.1 10.0."), "", io.EOF},
+		{"v1 太长", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 20001" + string(make([]byte, maxV1Length)) + "\r\n"), "", ErrInvalidHeader},
+		{"v1 没有 \\r", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 20001\n"), "", ErrInvalidHeader},
+		{"v1 端口错误", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 70000 20001\r\n"), "", ErrInvalidHeader},
+		{"v1 IP 错误", []byte("PROXY TCP4 192.0.2 10.0.0.1 56324 20001\r\n"), "", ErrInvalidHeader},
+		{"v2 头不完整", v2Header(0x1, 0x11, v4)[:14], "", io.ErrUnexpectedEOF},
+		{"v2 地址不完整", v2Header(0x1, 0x11, v4)[:20], "", io.ErrUnexpectedEOF},
+		{"v2 长度过大", oversized, "", ErrInvalidHeader},
+		{"v2 IPv4 长度不够", v2Header(0x1, 0x11, v4[:8]), "", ErrInvalidHeader},
+		{"v2 IPv6 长度不够", v2Header(0x1, 0x21, v6[:20]), "", ErrInvalidHeader},
+		{"v2 版本错误", append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0), "", ErrInvalidHeader},
+		{"v2 命令错误", v2Header(0x2, 0x11, v4), "", ErrInvalidHeader},
+		{"没有 PROXY 头", []byte("GET / HTTP/1.1\r\n\r\n"), "", ErrInvalidHeader},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				// 错误的头写完就断开；正确的头后面跟着应用层的数据，解析完 PROXY 头之后要能原样读到
+				if c.err != nil {
+					_, _ = client.Write(c.data)
+					_ = client.Close()
+					return
+				}
+				_, _ = client.Write(append(append([]byte{}, c.data...), "hello"...))
+			}()
+			defer client.Close()
+			conn, err := readHeader(server, time.Second)
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("错误 %v, 应该是 %v", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := c.remote
+			if want == "" {
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Fatalf("地址 %s, 应该是 %s", got, want)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("PROXY 头后面的数据 %q: %v", buf, err)
+			}
+		})
+	}
+}
+
+// 连上之后一直不发 PROXY 头，超时后断开
+func TestReadHeaderTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	_, err := readHeader(server, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("错误 %v, 应该是超时", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("等了 %v 才超时", d)
+	}
+}
+
+// listen 在本机监听，Accept 到的连接从返回的通道取
+func listen(t *testing.T, cfg Config) (*Listener, <-chan net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := NewListener(ln, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pl.Close() })
+	conns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	return pl, conns
+}
+
+func accepted(t *testing.T, conns <-chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case c := <-conns:
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有收到连接")
+		return nil
+	}
+}
+
+// 不受信任的地址发来的 PROXY 头不解析，按普通数据交给应用层，不能伪造地址
+func TestUntrustedSource(t *testing.T) {
+	pl, conns := listen(t, Config{Trusted: []string{"10.0.0.0/8"}})
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	header := "PROXY TCP4 192.0.2.1 10.0.0.1 56324 20001\r\n"
+	if _, err := client.Write([]byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	c := accepted(t, conns)
+	if _, ok := c.(*Conn); ok {
+		t.Fatal("不受信任的连接不应该解析 PROXY 头")
+	}
+	if got := c.RemoteAddr().String(); got != client.LocalAddr().String() {
+		t.Fatalf("地址 %s, 应该是 %s", got, client.LocalAddr())
+	}
+	buf := make([]byte, len(header))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != header {
+		t.Fatalf("读到 %q: %v", buf, err)
+	}
+}
+
+// 受信任的地址必须带 PROXY 头，慢的连接超时断开，不会卡住其他连接
+func TestListenerTimeout(t *testing.T) {
+	pl, conns := listen(t, Config{Trusted: []string{"127.0.0.0/8"}, HeaderTimeout: 200 * time.Millisecond})
+	slow, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	fast, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	if _, err := fast.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 20001\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := accepted(t, conns).RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Fatalf("地址 %s", got)
+	}
+
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("没有发 PROXY 头的连接应该被断开, 读到 %v", err)
+	}
+	select {
+	case c := <-conns:
+		t.Fatalf("超时的连接不应该交出去: %s", c.RemoteAddr())
+	default:
+	}
+}
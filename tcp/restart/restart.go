@@ -0,0 +1,231 @@
+package restart
+
+/**
+ * 平滑重启：收到重启信号后启动新的进程，并把正在监听的 socket 交给它
+ * 新进程直接在继承的 socket 上 Accept，内核里排队的连接不会丢，旧进程停止 Accept 后等老玩家断开再退出
+ *
+ * 传给新进程的文件依次是：fd 3 就绪通知管道，fd 4 开始是监听 socket，名字按顺序写在环境变量里
+ */
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 继承的监听 socket 名字，逗号分隔，顺序和 fd 一致
+	envInherit = "GAMESERVER_INHERIT"
+	// 新进程就绪后通过这个 fd 通知旧进程
+	readyFd = 3
+	// 等待新进程就绪的时间，超时认为启动失败
+	readyTimeout = time.Minute
+)
+
+var (
+	// ErrNotReady 新进程没有在规定时间内就绪
+	ErrNotReady = errors.New("新进程启动超时")
+	// ErrNoListener 没有可以交接的监听
+	ErrNoListener = errors.New("没有可以交接的监听")
+)
+
+// 可以取出底层 fd 的监听，*net.TCPListener 和 *net.UDPConn 都满足
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	mu        sync.Mutex
+	loaded    bool
+	child     bool                // 是不是 Fork 启动的进程，只有这样 fd 3 才是就绪管道
+	inherited map[string]*os.File // 从旧进程继承的，还没被取走的 socket
+	active    []string            // 本进程正在使用的监听名字，按注册顺序
+	listeners map[string]filer    // 名字 -> 监听
+	forked    = make(chan struct{})
+	forkOnce  sync.Once
+)
+
+// loadInherited 第一次使用时解析环境变量，取出继承的 socket
+func loadInherited() {
+	if loaded {
+		return
+	}
+	loaded = true
+	inherited = make(map[string]*os.File)
+	listeners = make(map[string]filer)
+	names := os.Getenv(envInherit)
+	if names == "" {
+		return
+	}
+	child = true
+	// 再往下启动的进程不能再继承一次
+	_ = os.Unsetenv(envInherit)
+	for i, name := range strings.Split(names, ",") {
+		inherited[name] = os.NewFile(uintptr(readyFd+1+i), name)
+	}
+}
+
+// Listen 监听 tcp 地址，平滑重启时优先使用旧进程交过来的同名 socket
+func Listen(name, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	loadInherited()
+	var l net.Listener
+	var err error
+	if f, ok := inherited[name]; ok {
+		delete(inherited, name)
+		l, err = net.FileListener(f)
+		_ = f.Close()
+		if err == nil {
+			slog.Info("继承旧进程的监听", "name", name, "addr", l.Addr().String())
+		}
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fl, ok := l.(filer); ok {
+		register(name, fl)
+	}
+	return l, nil
+}
+
+// ListenPacket 监听 udp 地址，平滑重启时优先使用旧进程交过来的同名 socket
+func ListenPacket(name, addr string) (net.PacketConn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	loadInherited()
+	var pc net.PacketConn
+	var err error
+	if f, ok := inherited[name]; ok {
+		delete(inherited, name)
+		pc, err = net.FilePacketConn(f)
+		_ = f.Close()
+		if err == nil {
+			slog.Info("继承旧进程的监听", "name", name, "addr", pc.LocalAddr().String())
+		}
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fl, ok := pc.(filer); ok {
+		register(name, fl)
+	}
+	return pc, nil
+}
+
+func register(name string, l filer) {
+	if _, ok := listeners[name]; !ok {
+		active = append(active, name)
+	}
+	listeners[name] = l
+}
+
+// Ready 新进程监听都准备好之后调用，通知旧进程可以停止 Accept 了，不是平滑重启启动的进程调用也没关系
+func Ready() {
+	mu.Lock()
+	defer mu.Unlock()
+	loadInherited()
+	// 没用上的 socket 关掉，避免端口一直被占着
+	for name, f := range inherited {
+		slog.Warn("继承的监听没有使用", "name", name)
+		_ = f.Close()
+		delete(inherited, name)
+	}
+	if !child {
+		return
+	}
+	child = false
+	f := os.NewFile(uintptr(readyFd), "ready")
+	if _, err := f.Write([]byte{1}); err == nil {
+		slog.Info("已通知旧进程新进程就绪")
+	}
+	_ = f.Close()
+}
+
+// Fork 用同样的命令行参数启动新进程，把所有监听交给它，等它就绪后返回
+// 返回之后 Forked() 返回的通道会被关闭，旧进程应该停止 Accept 并开始排空连接
+func Fork() (*os.Process, error) {
+	mu.Lock()
+	loadInherited()
+	if len(active) == 0 {
+		mu.Unlock()
+		return nil, ErrNoListener
+	}
+	files := make([]*os.File, 0, len(active))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range active {
+		// File 返回的是复制出来的 fd，关掉它不影响本进程的监听
+		f, err := listeners[name].File()
+		if err != nil {
+			mu.Unlock()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	names := strings.Join(active, ",")
+	mu.Unlock()
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), envInherit+"="+names)
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("新进程已启动", "pid", cmd.Process.Pid, "listeners", names)
+
+	// 新进程退出或者就绪都会让 Read 返回
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := r.Read(buf)
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			_ = cmd.Wait()
+			return nil, ErrNotReady
+		}
+	case <-time.After(readyTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, ErrNotReady
+	}
+	// 旧进程退出后新进程由 init 接管，在那之前要回收，避免僵尸进程
+	go func() { _ = cmd.Wait() }()
+	forkOnce.Do(func() { close(forked) })
+	return cmd.Process, nil
+}
+
+// Forked 新进程就绪后关闭，websocket 这类不在 tcp 服务器里的监听可以用它来一起排空
+func Forked() <-chan struct{} {
+	return forked
+}
@@ -0,0 +1,73 @@
+package rudp
+
+import "time"
+
+// Config 可靠 udp 的参数，两端可以不一样
+type Config struct {
+	Interval    time.Duration `yaml:"interval"`     // 刷新间隔，越小延迟越低，cpu 占用越高
+	MinRTO      time.Duration `yaml:"min-rto"`      // 最小重传超时
+	MaxRTO      time.Duration `yaml:"max-rto"`      // 最大重传超时，超时按 2 倍退避到这里为止
+	FastResend  int           `yaml:"fast-resend"`  // 被后面的包跳过确认多少次就立即重传，0 表示关闭
+	DeadLink    int           `yaml:"dead-link"`    // 一个包最多发送多少次，超过认为连接已断开
+	SendWindow  int           `yaml:"send-window"`  // 发送窗口，单位是包
+	RecvWindow  int           `yaml:"recv-window"`  // 接收窗口，单位是包
+	MTU         int           `yaml:"mtu"`          // 单个 udp 包的最大字节数
+	IdleTimeout time.Duration `yaml:"idle-timeout"` // 多久没有收到对端的任何包就断开
+	DialTimeout time.Duration `yaml:"dial-timeout"` // 客户端握手超时
+}
+
+// DefaultConfig 适合手机网络下实时对战的默认参数
+func DefaultConfig() Config {
+	return Config{
+		Interval:    10 * time.Millisecond,
+		MinRTO:      30 * time.Millisecond,
+		MaxRTO:      3 * time.Second,
+		FastResend:  2,
+		DeadLink:    20,
+		SendWindow:  128,
+		RecvWindow:  128,
+		MTU:         1200,
+		IdleTimeout: 30 * time.Second,
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+// withDefaults 没有配置的字段用默认值
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = d.MinRTO
+	}
+	if c.MaxRTO < c.MinRTO {
+		c.MaxRTO = d.MaxRTO
+	}
+	if c.FastResend < 0 {
+		c.FastResend = 0
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = d.DeadLink
+	}
+	if c.SendWindow <= 0 {
+		c.SendWindow = d.SendWindow
+	}
+	if c.RecvWindow <= 0 {
+		c.RecvWindow = d.RecvWindow
+	}
+	if c.MTU <= headerLen+64 {
+		c.MTU = d.MTU
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = d.IdleTimeout
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = d.DialTimeout
+	}
+	return c
+}
+
+func (c *Config) mss() int {
+	return c.MTU - headerLen
+}
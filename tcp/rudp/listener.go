@@ -0,0 +1,342 @@
+package rudp
+
+/**
+ * 可靠 udp 的监听和拨号，Listener 实现了 net.Listener，可以直接交给 tcp.ListenAndServe
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// cookie 按这个时间分段，当前和上一段签出的 cookie 都有效
+const cookieSlot = 30 * time.Second
+
+// Listener 在一个 udp 端口上按会话ID分发数据
+type Listener struct {
+	pc     net.PacketConn
+	cfg    Config
+	secret []byte // 签 cookie 的密钥，进程内随机生成
+
+	mu       sync.Mutex
+	sessions map[uint32]*Session
+	pending  map[string]uint32 // 握手中的客户端，地址+随机数 -> 会话ID，用来应对 SYN 重传
+	keys     map[uint32]string // 会话ID -> pending 里的 key，会话关闭时一起删除
+
+	acceptCh chan *Session
+	die      chan struct{}
+	dieOnce  sync.Once
+	stop     chan struct{} // Shutdown 之后关闭，不再接受新会话
+	stopOnce sync.Once
+	draining bool // 已经 Shutdown，最后一个会话结束时关闭 socket
+}
+
+// Listen 监听 udp 地址
+func Listen(addr string, cfg Config) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return Serve(pc, cfg), nil
+}
+
+// Serve 在已有的 PacketConn 上提供服务，可以传入 NewLossyPacketConn 包装过的连接模拟弱网
+func Serve(pc net.PacketConn, cfg Config) *Listener {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	l := &Listener{
+		pc:       pc,
+		secret:   secret,
+		cfg:      cfg.withDefaults(),
+		sessions: make(map[uint32]*Session),
+		pending:  make(map[string]uint32),
+		keys:     make(map[uint32]string),
+		acceptCh: make(chan *Session, 128),
+		die:      make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+// Accept 等待下一个完成握手的会话
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.acceptCh:
+		return s, nil
+	case <-l.die:
+		return nil, ErrClosed
+	case <-l.stop:
+		return nil, ErrClosed
+	}
+}
+
+// Shutdown 停止接受新会话，已有的会话继续收发，最后一个会话结束后关闭 socket
+// 平滑重启时用，新进程读同一个 socket，新客户端的 SYN 由新进程处理
+func (l *Listener) Shutdown() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		l.mu.Lock()
+		l.draining = true
+		empty := len(l.sessions) == 0
+		l.mu.Unlock()
+		if empty {
+			_ = l.Close()
+		}
+	})
+}
+
+// Close 停止监听并关闭所有会话
+func (l *Listener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		_ = l.pc.Close()
+		l.mu.Lock()
+		sessions := make([]*Session, 0, len(l.sessions))
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.closeWithError(ErrClosed)
+		}
+	})
+	return nil
+}
+
+// Addr 监听地址
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// Count 当前会话数
+func (l *Listener) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.sessions)
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.die:
+			default:
+				_ = l.Close()
+			}
+			return
+		}
+		seg, err := decodeSegment(buf[:n])
+		if err != nil {
+			continue
+		}
+		if seg.cmd == cmdSyn {
+			select {
+			case <-l.stop:
+				// 排空中不接新会话，客户端重发的 SYN 会被新进程读到
+			default:
+				l.handshake(seg, addr)
+			}
+			continue
+		}
+		l.mu.Lock()
+		s := l.sessions[seg.conv]
+		l.mu.Unlock()
+		if s == nil {
+			continue
+		}
+		if !sameAddr(s.RemoteAddr(), addr) {
+			// 换地址要先用会话密钥通过验证，验证期间新地址发来的包丢掉，等客户端重传
+			// 没有认证的会话不允许换地址
+			if seg.cmd == cmdPathResponse {
+				s.checkPath(addr, seg.data)
+			} else {
+				s.challengePath(addr)
+			}
+			continue
+		}
+		// 数据在 buf 里，input 会自己拷贝需要保留的部分
+		s.input(seg)
+	}
+}
+
+// handshake 分配会话ID并回复 SYNACK，重复的 SYN 回复同一个会话ID
+// 第一个 SYN 只回复 cookie，不保存任何状态，带着正确 cookie 的 SYN 证明客户端能收到这个地址的包，才创建会话
+func (l *Listener) handshake(seg *segment, addr net.Addr) {
+	if len(seg.data) != nonceLen+cookieLen {
+		return
+	}
+	nonce, cookie := seg.data[:nonceLen], seg.data[nonceLen:]
+	if !l.checkCookie(addr, nonce, cookie) {
+		reply := &segment{cmd: cmdCookie, data: append(append([]byte(nil), nonce...), l.cookie(addr, nonce, time.Now())...)}
+		_, _ = l.pc.WriteTo(reply.encode(), addr)
+		return
+	}
+	key := addr.String() + "/" + string(nonce)
+	l.mu.Lock()
+	var s *Session
+	conv, ok := l.pending[key]
+	if ok {
+		s = l.sessions[conv]
+	} else {
+		for conv == 0 || l.sessions[conv] != nil {
+			conv = randomConv()
+		}
+		sessionKey := make([]byte, keyLen)
+		_, _ = rand.Read(sessionKey)
+		s = newSession(conv, sessionKey, l.pc, addr, l.cfg, l)
+		select {
+		case l.acceptCh <- s:
+		default:
+			// 来不及 Accept，丢弃这次握手，客户端会重试
+			l.mu.Unlock()
+			s.closeWithError(ErrClosed)
+			return
+		}
+		l.sessions[conv] = s
+		l.pending[key] = conv
+		l.keys[conv] = key
+	}
+	l.mu.Unlock()
+
+	ack := &segment{conv: conv, cmd: cmdSynAck, wnd: uint16(l.cfg.RecvWindow), data: append(append([]byte(nil), nonce...), s.key...)}
+	_, _ = l.pc.WriteTo(ack.encode(), addr)
+}
+
+// cookie 用监听的密钥对客户端地址、随机数和时间段签名
+func (l *Listener) cookie(addr net.Addr, nonce []byte, t time.Time) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	var slot [8]byte
+	binary.BigEndian.PutUint64(slot[:], uint64(t.UnixNano()/int64(cookieSlot)))
+	mac.Write(slot[:])
+	mac.Write(nonce)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieLen]
+}
+
+func (l *Listener) checkCookie(addr net.Addr, nonce []byte, cookie []byte) bool {
+	now := time.Now()
+	return hmac.Equal(cookie, l.cookie(addr, nonce, now)) || hmac.Equal(cookie, l.cookie(addr, nonce, now.Add(-cookieSlot)))
+}
+
+func (l *Listener) remove(s *Session) {
+	l.mu.Lock()
+	if l.sessions[s.conv] == s {
+		delete(l.sessions, s.conv)
+		delete(l.pending, l.keys[s.conv])
+		delete(l.keys, s.conv)
+	}
+	done := l.draining && len(l.sessions) == 0
+	l.mu.Unlock()
+	if done {
+		// 在会话自己的关闭流程里调用，放到后台避免 Close 再去关它
+		go l.Close()
+	}
+}
+
+// Dial 连接可靠 udp 服务器
+func Dial(addr string, cfg Config) (*Session, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s, err := DialWithConn(pc, raddr, cfg)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// DialWithConn 在已有的 PacketConn 上握手，会话关闭时会关闭 pc
+func DialWithConn(pc net.PacketConn, raddr net.Addr, cfg Config) (*Session, error) {
+	cfg = cfg.withDefaults()
+	// 随机数后面是 cookie，第一次发全0，服务器回复 cookie 后带上重发
+	data := make([]byte, nonceLen+cookieLen)
+	if _, err := rand.Read(data[:nonceLen]); err != nil {
+		return nil, err
+	}
+	nonce := data[:nonceLen]
+
+	deadline := time.Now().Add(cfg.DialTimeout)
+	buf := make([]byte, 64*1024)
+	var conv uint32
+	var key []byte
+	for conv == 0 {
+		if time.Now().After(deadline) {
+			return nil, timeoutError{}
+		}
+		syn := &segment{cmd: cmdSyn, wnd: uint16(cfg.RecvWindow), data: data}
+		if _, err := pc.WriteTo(syn.encode(), raddr); err != nil {
+			return nil, err
+		}
+		_ = pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			seg, err := decodeSegment(buf[:n])
+			if err != nil || !sameAddr(addr, raddr) || len(seg.data) < nonceLen || string(seg.data[:nonceLen]) != string(nonce) {
+				continue
+			}
+			if seg.cmd == cmdCookie && len(seg.data) == nonceLen+cookieLen {
+				copy(data[nonceLen:], seg.data[nonceLen:])
+				break
+			}
+			if seg.cmd != cmdSynAck || len(seg.data) != nonceLen+keyLen {
+				continue
+			}
+			conv = seg.conv
+			key = append([]byte(nil), seg.data[nonceLen:]...)
+			break
+		}
+	}
+	_ = pc.SetReadDeadline(time.Time{})
+
+	s := newSession(conv, key, pc, raddr, cfg, nil)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				s.closeWithError(err)
+				return
+			}
+			seg, err := decodeSegment(buf[:n])
+			if err != nil || seg.conv != conv || !sameAddr(addr, raddr) {
+				continue
+			}
+			if seg.cmd == cmdPathChallenge {
+				s.respondPath(seg.data)
+				continue
+			}
+			s.input(seg)
+		}
+	}()
+	return s, nil
+}
+
+func randomConv() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+func sameAddr(a, b net.Addr) bool {
+	return a.Network() == b.Network() && a.String() == b.String()
+}
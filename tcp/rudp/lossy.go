@@ -0,0 +1,52 @@
+package rudp
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LossyPacketConn 模拟弱网的 PacketConn，发送时按概率丢包、延迟和乱序，用于在本机调试重传参数
+type LossyPacketConn struct {
+	net.PacketConn
+	Loss   float64       // 丢包率 0-1
+	Delay  time.Duration // 固定延迟
+	Jitter time.Duration // 在固定延迟上随机增加 0-Jitter，大于 0 时会产生乱序
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewLossyPacketConn 包装一个 PacketConn
+func NewLossyPacketConn(pc net.PacketConn, loss float64, delay, jitter time.Duration) *LossyPacketConn {
+	return &LossyPacketConn{
+		PacketConn: pc,
+		Loss:       loss,
+		Delay:      delay,
+		Jitter:     jitter,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// WriteTo 按配置丢弃或者延迟发送，总是返回成功
+func (c *LossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rnd.Float64() < c.Loss
+	delay := c.Delay
+	if c.Jitter > 0 {
+		delay += time.Duration(c.rnd.Int63n(int64(c.Jitter)))
+	}
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if delay <= 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	data := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		_, _ = c.PacketConn.WriteTo(data, addr)
+	})
+	return len(b), nil
+}
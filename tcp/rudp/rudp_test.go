@@ -0,0 +1,363 @@
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试用的参数，重传快一些，弱网下也能很快跑完
+func testConfig() Config {
+	return Config{
+		Interval:    5 * time.Millisecond,
+		MinRTO:      20 * time.Millisecond,
+		MaxRTO:      200 * time.Millisecond,
+		FastResend:  2,
+		DeadLink:    40,
+		SendWindow:  32,
+		RecvWindow:  32,
+		MTU:         1200,
+		IdleTimeout: 5 * time.Second,
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+// lossyPair 建立一对会话，两端发出的包都按 loss 丢弃，延迟在 delay 到 delay+jitter 之间，会乱序
+func lossyPair(t *testing.T, cfg Config, loss float64, delay, jitter time.Duration) (*Session, *Session, *Listener) {
+	t.Helper()
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Serve(NewLossyPacketConn(spc, loss, delay, jitter), cfg)
+	t.Cleanup(func() { _ = l.Close() })
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := DialWithConn(NewLossyPacketConn(cpc, loss, delay, jitter), l.Addr(), cfg)
+	if err != nil {
+		_ = cpc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, conn.(*Session), l
+}
+
+func TestReliableOrdered(t *testing.T) {
+	client, server, _ := lossyPair(t, testConfig(), 0.2, 2*time.Millisecond, 10*time.Millisecond)
+
+	// 有比 MTU 大的消息，会被拆成多个包
+	var want bytes.Buffer
+	for i := 0; i < 200; i++ {
+		msg := make([]byte, 1+i*17%3000)
+		_, _ = rand.Read(msg)
+		want.Write(msg)
+	}
+	go func() {
+		b := want.Bytes()
+		for len(b) > 0 {
+			n := min(len(b), 1000)
+			if _, err := client.Write(b[:n]); err != nil {
+				return
+			}
+			b = b[n:]
+		}
+	}()
+
+	_ = server.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, want.Len())
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("读取失败：%v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatal("收到的数据和发送的不一致")
+	}
+}
+
+func TestUnreliableSequenced(t *testing.T) {
+	client, server, _ := lossyPair(t, testConfig(), 0.2, 2*time.Millisecond, 20*time.Millisecond)
+
+	const total = 300
+	go func() {
+		for i := 1; i <= total; i++ {
+			_ = client.SendUnreliable([]byte{byte(i >> 8), byte(i)})
+			time.Sleep(time.Millisecond)
+		}
+		_ = client.SendUnreliable([]byte{0xff, 0xff})
+	}()
+
+	ch := make(chan []byte)
+	go func() {
+		for {
+			b, err := server.ReadUnreliable()
+			if err != nil {
+				return
+			}
+			ch <- b
+		}
+	}()
+	last, received := 0, 0
+	timeout := time.After(10 * time.Second)
+	for {
+		var b []byte
+		select {
+		case b = <-ch:
+		case <-time.After(500 * time.Millisecond):
+			// 最后一个包也可能丢了
+			if received == 0 {
+				t.Fatal("一个不可靠消息都没有收到")
+			}
+			return
+		case <-timeout:
+			t.Fatal("超时")
+		}
+		n := int(b[0])<<8 | int(b[1])
+		if n == 0xffff {
+			break
+		}
+		if n <= last {
+			t.Fatalf("收到了旧消息 %d，上一个是 %d", n, last)
+		}
+		last = n
+		received++
+	}
+	if received == 0 || received == total {
+		t.Fatalf("丢包率 20%% 时收到 %d/%d 个不可靠消息", received, total)
+	}
+}
+
+func TestResendUntilDeadLink(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRTO = 40 * time.Millisecond
+	cfg.DeadLink = 5
+	client, _, _ := lossyPair(t, cfg, 0, 0, 0)
+
+	// 握手之后客户端发出的包全部丢掉，一直重传到 DeadLink
+	lossy := client.pc.(*LossyPacketConn)
+	lossy.mu.Lock()
+	lossy.Loss = 1
+	lossy.mu.Unlock()
+	if _, err := client.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("一直收不到确认时会话没有断开")
+	}
+	if err := client.closeErr(); err != ErrDeadLink {
+		t.Fatalf("断开原因是 %v，应该是 ErrDeadLink", err)
+	}
+}
+
+func TestResendUnderLoss(t *testing.T) {
+	client, server, _ := lossyPair(t, testConfig(), 0.5, time.Millisecond, 5*time.Millisecond)
+
+	want := make([]byte, 64*1024)
+	_, _ = rand.Read(want)
+	go func() { _, _ = client.Write(want) }()
+	_ = server.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("丢包率 50%% 时读取失败：%v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("收到的数据和发送的不一致")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	cfg := testConfig()
+	cfg.SendWindow = 8
+	cfg.RecvWindow = 8
+	client, server, _ := lossyPair(t, cfg, 0, 0, 0)
+
+	// 服务端不读，客户端发出去的包不能超过两边的窗口
+	const packets = 64
+	want := make([]byte, packets*cfg.mss())
+	_, _ = rand.Read(want)
+	go func() { _, _ = client.Write(want) }()
+	for i := 0; i < 30; i++ {
+		time.Sleep(10 * time.Millisecond)
+		client.mu.Lock()
+		inflight := len(client.sndBuf)
+		client.mu.Unlock()
+		if inflight > cfg.SendWindow {
+			t.Fatalf("在途的包有 %d 个，超过了发送窗口 %d", inflight, cfg.SendWindow)
+		}
+	}
+	server.mu.Lock()
+	buffered := len(server.rcvData)/cfg.mss() + len(server.rcvBuf)
+	server.mu.Unlock()
+	if buffered > cfg.RecvWindow {
+		t.Fatalf("接收端没有读的时候缓存了 %d 个包，接收窗口是 %d", buffered, cfg.RecvWindow)
+	}
+
+	// 开始读之后窗口重新打开，剩下的数据都能收到
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("窗口重新打开后读取失败：%v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("收到的数据和发送的不一致")
+	}
+}
+
+// readSegment 从原始 udp socket 读一个段
+func readSegment(t *testing.T, pc net.PacketConn) *segment {
+	t.Helper()
+	buf := make([]byte, 64*1024)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("没有收到回复：%v", err)
+	}
+	seg, err := decodeSegment(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seg
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	data := make([]byte, nonceLen+cookieLen)
+	copy(data, "abcd")
+	send := func() {
+		_, _ = raw.WriteTo((&segment{cmd: cmdSyn, data: data}).encode(), l.Addr())
+	}
+
+	// 没有 cookie 时只回复 cookie，不创建会话
+	send()
+	seg := readSegment(t, raw)
+	if seg.cmd != cmdCookie || len(seg.data) != len(data) || string(seg.data[:nonceLen]) != "abcd" {
+		t.Fatalf("没有 cookie 的 SYN 收到了 %d", seg.cmd)
+	}
+	if l.Count() != 0 {
+		t.Fatal("没有 cookie 的 SYN 创建了会话")
+	}
+	cookie := append([]byte(nil), seg.data[nonceLen:]...)
+
+	// 换一个随机数，cookie 就不对了
+	copy(data, "wxyz")
+	copy(data[nonceLen:], cookie)
+	send()
+	if seg := readSegment(t, raw); seg.cmd != cmdCookie || l.Count() != 0 {
+		t.Fatal("cookie 和随机数不匹配时创建了会话")
+	}
+
+	copy(data, "abcd")
+	send()
+	seg = readSegment(t, raw)
+	if seg.cmd != cmdSynAck || seg.conv == 0 || len(seg.data) != nonceLen+keyLen {
+		t.Fatalf("带 cookie 的 SYN 收到了 %d", seg.cmd)
+	}
+	// 重发的 SYN 回复同一个会话
+	send()
+	if again := readSegment(t, raw); again.conv != seg.conv || !bytes.Equal(again.data, seg.data) {
+		t.Fatal("重发的 SYN 创建了新会话")
+	}
+	if l.Count() != 1 {
+		t.Fatalf("会话数是 %d", l.Count())
+	}
+}
+
+func TestMigration(t *testing.T) {
+	client, server, _ := lossyPair(t, testConfig(), 0, 0, 0)
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	origin := server.RemoteAddr()
+	ping := (&segment{conv: server.Conv(), cmd: cmdPing}).encode()
+
+	// 没有认证的会话不会换地址，也不会发验证
+	_, _ = raw.WriteTo(ping, server.pc.LocalAddr())
+	_ = raw.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := raw.ReadFrom(make([]byte, 2048)); err == nil {
+		t.Fatal("没有认证的会话给新地址发了包")
+	}
+
+	server.Authenticate(1)
+	time.Sleep(pathChallengeInterval)
+	_, _ = raw.WriteTo(ping, server.pc.LocalAddr())
+	challenge := readSegment(t, raw)
+	if challenge.cmd != cmdPathChallenge || challenge.conv != server.Conv() {
+		t.Fatalf("新地址收到了 %d，应该是换地址验证", challenge.cmd)
+	}
+	if !sameAddr(server.RemoteAddr(), origin) {
+		t.Fatal("只知道会话ID就换了地址")
+	}
+
+	// 签名不对不能换地址
+	bad := (&segment{conv: server.Conv(), cmd: cmdPathResponse, data: make([]byte, keyLen)}).encode()
+	_, _ = raw.WriteTo(bad, server.pc.LocalAddr())
+	time.Sleep(50 * time.Millisecond)
+	if !sameAddr(server.RemoteAddr(), origin) {
+		t.Fatal("签名错误时换了地址")
+	}
+
+	// 客户端的会话密钥和服务端一样，用它签名后换到新地址
+	good := (&segment{conv: server.Conv(), cmd: cmdPathResponse, data: client.pathSign(challenge.data)}).encode()
+	_, _ = raw.WriteTo(good, server.pc.LocalAddr())
+	deadline := time.Now().Add(time.Second)
+	for !sameAddr(server.RemoteAddr(), raw.LocalAddr()) {
+		if time.Now().After(deadline) {
+			t.Fatal("签名正确时没有换地址")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	client, server, l := lossyPair(t, testConfig(), 0, 0, 0)
+	go func() { _, _ = io.Copy(server, server) }()
+
+	l.Shutdown()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Fatalf("Shutdown 之后 Accept 返回 %v", err)
+	}
+	// 已有的会话继续收发
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Shutdown 之后已有的会话收发失败：%v", err)
+	}
+	// 新客户端握手不会成功
+	cfg := testConfig()
+	cfg.DialTimeout = 300 * time.Millisecond
+	if _, err := Dial(l.Addr().String(), cfg); err == nil {
+		t.Fatal("Shutdown 之后还能建立新会话")
+	}
+
+	// 最后一个会话结束后关闭 socket
+	_ = client.Close()
+	select {
+	case <-l.die:
+	case <-time.After(2 * time.Second):
+		t.Fatal("会话都结束后监听没有关闭")
+	}
+}
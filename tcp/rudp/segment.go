@@ -0,0 +1,91 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 段类型
+const (
+	cmdSyn           = 1  // 客户端发起握手，数据是4字节随机数加16字节 cookie，第一次的 cookie 全是0
+	cmdSynAck        = 2  // 服务器分配会话ID，数据是原样带回的随机数加16字节会话密钥
+	cmdPush          = 3  // 可靠有序数据
+	cmdAck           = 4  // 确认，数据是若干个4字节序号
+	cmdUnrel         = 5  // 不可靠有序数据，旧的直接丢弃
+	cmdPing          = 6  // 保活
+	cmdFin           = 7  // 关闭
+	cmdCookie        = 8  // 服务器要求带上 cookie 重发 SYN，数据是随机数加 cookie，和 SYN 一样长，不会被用来放大流量
+	cmdPathChallenge = 9  // 对端从新地址发来包，服务器发给新地址的验证数据
+	cmdPathResponse  = 10 // 客户端用会话密钥对验证数据的签名
+)
+
+// 段头
+// 会话ID	4字节
+// 类型		1字节
+// 接收窗口	2字节
+// 序号		4字节
+// 累计确认	4字节（对端下一个期望收到的序号）
+// 数据长度	2字节
+const headerLen = 17
+
+// 握手时的随机数和 cookie 长度
+const (
+	nonceLen  = 4
+	cookieLen = 16
+	keyLen    = 16 // 会话密钥，换地址时用来证明是同一个客户端
+)
+
+var errSegment = errors.New("rudp: bad segment")
+
+type segment struct {
+	conv uint32
+	cmd  uint8
+	wnd  uint16
+	sn   uint32
+	una  uint32
+	data []byte
+
+	// 下面是发送端重传用的状态，不参与编码
+	xmit     int           // 发送次数
+	rto      time.Duration // 这个包当前的重传超时
+	resendAt time.Time     // 下次重传时间
+	sentAt   time.Time     // 最后一次发送时间
+	fastack  int           // 被后面的包跳过确认的次数
+}
+
+func (s *segment) encode() []byte {
+	buf := make([]byte, headerLen+len(s.data))
+	binary.BigEndian.PutUint32(buf[0:4], s.conv)
+	buf[4] = s.cmd
+	binary.BigEndian.PutUint16(buf[5:7], s.wnd)
+	binary.BigEndian.PutUint32(buf[7:11], s.sn)
+	binary.BigEndian.PutUint32(buf[11:15], s.una)
+	binary.BigEndian.PutUint16(buf[15:17], uint16(len(s.data)))
+	copy(buf[headerLen:], s.data)
+	return buf
+}
+
+func decodeSegment(b []byte) (*segment, error) {
+	if len(b) < headerLen {
+		return nil, errSegment
+	}
+	s := &segment{
+		conv: binary.BigEndian.Uint32(b[0:4]),
+		cmd:  b[4],
+		wnd:  binary.BigEndian.Uint16(b[5:7]),
+		sn:   binary.BigEndian.Uint32(b[7:11]),
+		una:  binary.BigEndian.Uint32(b[11:15]),
+	}
+	n := int(binary.BigEndian.Uint16(b[15:17]))
+	if len(b) != headerLen+n {
+		return nil, errSegment
+	}
+	s.data = b[headerLen:]
+	return s, nil
+}
+
+// seqDiff 序号回绕时也能正确比较大小，a 在 b 之后时返回正数
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
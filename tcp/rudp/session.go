@@ -0,0 +1,644 @@
+package rudp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed 会话已经关闭
+	ErrClosed = errors.New("rudp: session closed")
+	// ErrDeadLink 重传次数超过 DeadLink，认为对端已经断开
+	ErrDeadLink = errors.New("rudp: dead link")
+	// ErrIdleTimeout 超过 IdleTimeout 没有收到对端的包
+	ErrIdleTimeout = errors.New("rudp: idle timeout")
+	// ErrTooLarge 不可靠消息超过一个包的大小
+	ErrTooLarge = errors.New("rudp: message too large")
+)
+
+// 换地址验证的时间分段，当前和上一段的验证数据都有效
+const pathSlot = 10 * time.Second
+
+// 同一个会话多久最多发一次换地址验证，防止伪造源地址的包让服务器往别人的地址发包
+const pathChallengeInterval = 200 * time.Millisecond
+
+// timeoutError 读写超时，实现 net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "rudp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session 一个可靠 udp 会话，实现了 net.Conn，Read/Write 走可靠有序通道，
+// SendUnreliable/ReadUnreliable 走不可靠有序通道（只保证不会收到比上一个更旧的包）
+type Session struct {
+	conv     uint32
+	cfg      Config
+	pc       net.PacketConn
+	listener *Listener // 服务端会话所属的监听，客户端为 nil
+
+	mu     sync.Mutex
+	remote net.Addr
+
+	// 发送
+	sndNxt   uint32     // 下一个要分配的序号
+	sndQueue [][]byte   // 还没进入发送窗口的数据
+	sndBuf   []*segment // 已发送未确认的包，按序号排列
+	rmtWnd   uint16     // 对端的接收窗口
+
+	// 接收
+	rcvNxt  uint32            // 下一个期望收到的序号
+	rcvBuf  map[uint32][]byte // 乱序到达的包
+	rcvData []byte            // 已按序到达，等待 Read 的数据
+	ackList []uint32          // 待回复确认的序号
+	wndFull bool              // 上次通告的窗口为 0，读出数据后要主动通知对端
+
+	// 不可靠有序
+	unrelSn   uint32
+	unrelLast uint32
+	unrelSeen bool
+	unrelCh   chan []byte
+
+	// 往返时间估计，RFC 6298
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	lastRecv      time.Time
+	lastSend      time.Time
+	authenticated bool   // 认证之后才允许对端换地址（比如手机在 wifi 和 4g 之间切换）
+	accid         int64  // 认证后绑定的账号
+	key           []byte // 握手时服务器发的会话密钥，换地址时要用它签名验证数据
+	pathSentAt    time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readEvent     chan struct{}
+	writeEvent    chan struct{}
+	die           chan struct{}
+	dieOnce       sync.Once
+	err           error // 关闭原因，对端正常关闭时是 io.EOF
+}
+
+func newSession(conv uint32, key []byte, pc net.PacketConn, remote net.Addr, cfg Config, l *Listener) *Session {
+	now := time.Now()
+	s := &Session{
+		conv:       conv,
+		key:        key,
+		cfg:        cfg,
+		pc:         pc,
+		listener:   l,
+		remote:     remote,
+		rmtWnd:     uint16(cfg.RecvWindow),
+		rcvBuf:     make(map[uint32][]byte),
+		unrelCh:    make(chan []byte, 128),
+		rto:        cfg.MinRTO * 4,
+		lastRecv:   now,
+		lastSend:   now,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+	go s.updateLoop()
+	return s
+}
+
+// Conv 会话ID，由服务器在握手时分配
+func (s *Session) Conv() uint32 {
+	return s.conv
+}
+
+// Authenticate 应用层认证通过后调用，之后对端换了地址也能继续使用这个会话
+func (s *Session) Authenticate(accid int64) {
+	s.mu.Lock()
+	s.authenticated = true
+	s.accid = accid
+	s.mu.Unlock()
+}
+
+// challengePath 对端从新地址发来包，认证过的会话给新地址发验证数据，客户端签名回复后才换地址
+// 只知道会话ID的人拿不到会话密钥，没法把会话劫持到自己的地址
+func (s *Session) challengePath(addr net.Addr) {
+	s.mu.Lock()
+	now := time.Now()
+	if !s.authenticated || s.err != nil || now.Sub(s.pathSentAt) < pathChallengeInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.pathSentAt = now
+	s.mu.Unlock()
+	seg := &segment{conv: s.conv, cmd: cmdPathChallenge, data: s.pathChallenge(addr, now)}
+	_, _ = s.pc.WriteTo(seg.encode(), addr)
+}
+
+// checkPath 校验新地址回复的签名，通过后换到新地址
+func (s *Session) checkPath(addr net.Addr, sig []byte) bool {
+	now := time.Now()
+	if !hmac.Equal(sig, s.pathSign(s.pathChallenge(addr, now))) &&
+		!hmac.Equal(sig, s.pathSign(s.pathChallenge(addr, now.Add(-pathSlot)))) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authenticated || s.err != nil {
+		return false
+	}
+	s.remote = addr
+	s.lastRecv = now
+	return true
+}
+
+// respondPath 客户端收到验证数据，用会话密钥签名后回复
+func (s *Session) respondPath(challenge []byte) {
+	s.mu.Lock()
+	remote := s.remote
+	s.mu.Unlock()
+	seg := &segment{conv: s.conv, cmd: cmdPathResponse, data: s.pathSign(challenge)}
+	_, _ = s.pc.WriteTo(seg.encode(), remote)
+}
+
+// pathChallenge 验证数据由地址和时间段算出来，服务器不用保存
+func (s *Session) pathChallenge(addr net.Addr, t time.Time) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	var slot [8]byte
+	binary.BigEndian.PutUint64(slot[:], uint64(t.UnixNano()/int64(pathSlot)))
+	mac.Write([]byte("challenge"))
+	mac.Write(slot[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:keyLen]
+}
+
+func (s *Session) pathSign(challenge []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("response"))
+	mac.Write(challenge)
+	return mac.Sum(nil)[:keyLen]
+}
+
+// Accid 认证时绑定的账号，没有认证时为 0
+func (s *Session) Accid() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accid
+}
+
+// Read 读取可靠有序通道的数据
+func (s *Session) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.rcvData) > 0 {
+			n := copy(b, s.rcvData)
+			s.rcvData = s.rcvData[n:]
+			if len(s.rcvData) == 0 {
+				s.rcvData = nil
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		timeout, stop := deadlineChan(deadline)
+		select {
+		case <-s.readEvent:
+		case <-s.die:
+		case <-timeout:
+			stop()
+			return 0, timeoutError{}
+		}
+		stop()
+	}
+}
+
+// Write 写入可靠有序通道，数据会按 MTU 拆成多个包，发送队列满时阻塞
+func (s *Session) Write(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			s.mu.Unlock()
+			return 0, ErrClosed
+		}
+		if len(s.sndQueue) < s.cfg.SendWindow*2 {
+			mss := s.cfg.mss()
+			for off := 0; off < len(b); off += mss {
+				end := off + mss
+				if end > len(b) {
+					end = len(b)
+				}
+				s.sndQueue = append(s.sndQueue, append([]byte(nil), b[off:end]...))
+			}
+			s.mu.Unlock()
+			return len(b), nil
+		}
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+
+		timeout, stop := deadlineChan(deadline)
+		select {
+		case <-s.writeEvent:
+		case <-s.die:
+		case <-timeout:
+			stop()
+			return 0, timeoutError{}
+		}
+		stop()
+	}
+}
+
+// SendUnreliable 发送一个不可靠消息，不重传，对端只会收到比上一个更新的消息
+func (s *Session) SendUnreliable(b []byte) error {
+	if len(b) > s.cfg.mss() {
+		return ErrTooLarge
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.unrelSn++
+	seg := &segment{conv: s.conv, cmd: cmdUnrel, sn: s.unrelSn, data: b}
+	s.fillHeader(seg)
+	remote := s.remote
+	s.lastSend = time.Now()
+	s.mu.Unlock()
+	_, err := s.pc.WriteTo(seg.encode(), remote)
+	return err
+}
+
+// ReadUnreliable 读取一个不可靠消息，消息堆积太多时旧的会被丢弃
+func (s *Session) ReadUnreliable() ([]byte, error) {
+	select {
+	case b := <-s.unrelCh:
+		return b, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// Close 关闭会话，会尽量通知对端
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.err == nil {
+		fin := &segment{conv: s.conv, cmd: cmdFin}
+		s.fillHeader(fin)
+		_, _ = s.pc.WriteTo(fin.encode(), s.remote)
+	}
+	s.mu.Unlock()
+	s.closeWithError(ErrClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+		close(s.die)
+		if s.listener != nil {
+			s.listener.remove(s)
+		} else {
+			_ = s.pc.Close()
+		}
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == io.EOF {
+		return ErrClosed
+	}
+	return s.err
+}
+
+// LocalAddr 本地地址
+func (s *Session) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// RemoteAddr 对端地址，认证之后可能会变化
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// SetDeadline 同时设置读写超时
+func (s *Session) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	return nil
+}
+
+// SetReadDeadline 设置读超时
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeEvent)
+	return nil
+}
+
+// input 处理收到的一个段，由监听或者客户端的读协程调用
+func (s *Session) input(seg *segment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	now := time.Now()
+	s.lastRecv = now
+	s.rmtWnd = seg.wnd
+	s.ackUna(seg.una)
+
+	switch seg.cmd {
+	case cmdPush:
+		if seqDiff(seg.sn, s.rcvNxt) < 0 {
+			// 重复的包，只回复确认
+			s.ackList = append(s.ackList, seg.sn)
+			return
+		}
+		if seqDiff(seg.sn, s.rcvNxt) >= int32(s.cfg.RecvWindow-len(s.rcvData)/s.cfg.mss()) {
+			// 超出窗口，应用层还没读走的数据也占窗口，丢掉等对端重传
+			// 回一个不确认任何包的空确认，让对端知道窗口还是满的
+			s.ackList = append(s.ackList, s.rcvNxt-1)
+			return
+		}
+		s.ackList = append(s.ackList, seg.sn)
+		if _, ok := s.rcvBuf[seg.sn]; !ok {
+			s.rcvBuf[seg.sn] = append([]byte(nil), seg.data...)
+		}
+		moved := false
+		for {
+			data, ok := s.rcvBuf[s.rcvNxt]
+			if !ok {
+				break
+			}
+			delete(s.rcvBuf, s.rcvNxt)
+			s.rcvData = append(s.rcvData, data...)
+			s.rcvNxt++
+			moved = true
+		}
+		if moved {
+			notify(s.readEvent)
+		}
+	case cmdAck:
+		for i := 0; i+4 <= len(seg.data); i += 4 {
+			s.ackSn(binary.BigEndian.Uint32(seg.data[i:]), now)
+		}
+	case cmdUnrel:
+		if s.unrelSeen && seqDiff(seg.sn, s.unrelLast) <= 0 {
+			return
+		}
+		s.unrelSeen = true
+		s.unrelLast = seg.sn
+		data := append([]byte(nil), seg.data...)
+		select {
+		case s.unrelCh <- data:
+		default:
+			// 应用层处理不过来时丢掉最旧的一个
+			select {
+			case <-s.unrelCh:
+			default:
+			}
+			select {
+			case s.unrelCh <- data:
+			default:
+			}
+		}
+	case cmdFin:
+		s.err = io.EOF
+		notify(s.readEvent)
+		go s.closeWithError(io.EOF)
+	}
+}
+
+// ackUna 对端累计确认，una 之前的包都已经收到
+func (s *Session) ackUna(una uint32) {
+	i := 0
+	for i < len(s.sndBuf) && seqDiff(s.sndBuf[i].sn, una) < 0 {
+		i++
+	}
+	if i > 0 {
+		s.sndBuf = s.sndBuf[i:]
+		notify(s.writeEvent)
+	}
+}
+
+// ackSn 对端确认了单个包，顺便更新往返时间和快速重传计数
+func (s *Session) ackSn(sn uint32, now time.Time) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				s.updateRTT(now.Sub(seg.sentAt))
+			}
+			s.sndBuf = append(s.sndBuf[:i], s.sndBuf[i+1:]...)
+			notify(s.writeEvent)
+			return
+		}
+		if seqDiff(seg.sn, sn) > 0 {
+			return
+		}
+		seg.fastack++
+	}
+}
+
+func (s *Session) updateRTT(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := s.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (3*s.rttvar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	rto := s.srtt + 4*s.rttvar
+	if rto < s.cfg.MinRTO {
+		rto = s.cfg.MinRTO
+	}
+	if rto > s.cfg.MaxRTO {
+		rto = s.cfg.MaxRTO
+	}
+	s.rto = rto
+}
+
+// RTT 平滑后的往返时间，还没有样本时为 0
+func (s *Session) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.srtt
+}
+
+// fillHeader 填写本端的窗口和累计确认
+func (s *Session) fillHeader(seg *segment) {
+	wnd := s.cfg.RecvWindow - len(s.rcvBuf) - len(s.rcvData)/s.cfg.mss()
+	if wnd < 0 {
+		wnd = 0
+	}
+	s.wndFull = wnd == 0
+	seg.wnd = uint16(wnd)
+	seg.una = s.rcvNxt
+}
+
+// updateLoop 定时刷新：发确认、发新数据、重传、保活、超时检测
+func (s *Session) updateLoop() {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) flush() error {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastRecv) > s.cfg.IdleTimeout {
+		s.mu.Unlock()
+		return ErrIdleTimeout
+	}
+	var out [][]byte
+
+	// 确认
+	if s.wndFull && s.cfg.RecvWindow-len(s.rcvBuf)-len(s.rcvData)/s.cfg.mss() > 0 && len(s.ackList) == 0 {
+		// 窗口重新打开，发一个空确认通知对端
+		s.ackList = append(s.ackList, s.rcvNxt-1)
+	}
+	for len(s.ackList) > 0 {
+		n := len(s.ackList)
+		if max := s.cfg.mss() / 4; n > max {
+			n = max
+		}
+		data := make([]byte, 4*n)
+		for i := 0; i < n; i++ {
+			binary.BigEndian.PutUint32(data[4*i:], s.ackList[i])
+		}
+		s.ackList = s.ackList[n:]
+		seg := &segment{conv: s.conv, cmd: cmdAck, data: data}
+		s.fillHeader(seg)
+		out = append(out, seg.encode())
+	}
+	s.ackList = nil
+
+	// 新数据进入发送窗口，对端窗口为 0 时也保留一个包做探测
+	cwnd := s.cfg.SendWindow
+	if int(s.rmtWnd) < cwnd {
+		cwnd = int(s.rmtWnd)
+	}
+	if cwnd < 1 {
+		cwnd = 1
+	}
+	for len(s.sndQueue) > 0 && len(s.sndBuf) < cwnd {
+		seg := &segment{conv: s.conv, cmd: cmdPush, sn: s.sndNxt, data: s.sndQueue[0]}
+		s.sndNxt++
+		s.sndQueue = s.sndQueue[1:]
+		s.sndBuf = append(s.sndBuf, seg)
+	}
+	if len(s.sndQueue) == 0 {
+		s.sndQueue = nil
+	}
+
+	// 首次发送、超时重传、快速重传
+	for _, seg := range s.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = s.rto
+		case !now.Before(seg.resendAt):
+			send = true
+			seg.rto *= 2
+			if seg.rto > s.cfg.MaxRTO {
+				seg.rto = s.cfg.MaxRTO
+			}
+		case s.cfg.FastResend > 0 && seg.fastack >= s.cfg.FastResend:
+			send = true
+		}
+		if !send {
+			continue
+		}
+		seg.xmit++
+		// 对端窗口为 0 时是在探测窗口，不算断开，对端真的断开了会按 IdleTimeout 断开
+		if seg.xmit > s.cfg.DeadLink && s.rmtWnd > 0 {
+			s.mu.Unlock()
+			return ErrDeadLink
+		}
+		seg.fastack = 0
+		seg.sentAt = now
+		seg.resendAt = now.Add(seg.rto)
+		s.fillHeader(seg)
+		out = append(out, seg.encode())
+	}
+
+	// 空闲时保活
+	if len(out) == 0 && now.Sub(s.lastSend) > s.cfg.IdleTimeout/3 {
+		seg := &segment{conv: s.conv, cmd: cmdPing}
+		s.fillHeader(seg)
+		out = append(out, seg.encode())
+	}
+	if len(out) > 0 {
+		s.lastSend = now
+	}
+	remote := s.remote
+	s.mu.Unlock()
+
+	for _, b := range out {
+		if _, err := s.pc.WriteTo(b, remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify 非阻塞地通知等待中的读写
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deadlineChan 没有设置超时时返回 nil 通道，永远不会触发
+func deadlineChan(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
+}
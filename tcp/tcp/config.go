@@ -0,0 +1,16 @@
+package tcp
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+)
+
+// LoadConfig 从 yaml 文件读取配置，文件里没有的字段保留 cfg 原来的值
+// cfg 一般是 *Config，也可以是嵌入了 Config 的结构体
+func LoadConfig(path string, cfg interface{}) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(bs, cfg)
+}
@@ -0,0 +1,41 @@
+package tcp
+
+import (
+	"encoding/json"
+	"gameserver/protocol"
+	"gameserver/session"
+)
+
+// hello 处理 HELLO 命令
+func (h *ServeHandler) hello(c *ServeClient, p *protocol.Packet) {
+	var hello protocol.Hello
+	if err := json.Unmarshal(p.Body, &hello); err != nil {
+		session.LogPacket(c, p).Warn("HELLO 消息体错误", "err", err)
+		c.Reject(protocol.ERR_PROTOCOL, "bad hello")
+		h.NormalClose(c)
+		return
+	}
+	if hello.Version == 0 {
+		hello.Version = p.Version
+	}
+	ack, code := protocol.Negotiate(&hello)
+	if code != 0 {
+		session.LogPacket(c, p).Warn("HELLO 协商失败", "code", code, "version", hello.Version, "codecs", hello.Codecs, "compress", hello.Compress, "encrypt", hello.Encrypt)
+		if code == protocol.ERR_UPGRADE {
+			c.Reject(code, "please upgrade your client")
+		} else {
+			c.Reject(code, "no common options")
+		}
+		h.NormalClose(c)
+		return
+	}
+	body, _ := json.Marshal(ack)
+	if err := c.Write(&protocol.Packet{Cmd: protocol.HELLO, Body: body}); err != nil {
+		session.Log(c).Warn("HELLO 回复失败", "err", err)
+		return
+	}
+	// 回复之后再切换，HELLO 的回复本身不压缩
+	c.version.Store(uint32(ack.Version))
+	c.hello.Store(ack)
+	session.Log(c).Debug("HELLO 协商完成", "version", ack.Version, "codec", ack.Codec, "compress", ack.Compress, "encrypt", ack.Encrypt)
+}
@@ -0,0 +1,102 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"gameserver/protocol"
+	"gameserver/session"
+	"net"
+	"testing"
+	"time"
+)
+
+// 读协程处理 HELLO 的同时，别的协程一直在广播，协商结果的读写不能有竞争，握手之后发的包按协商的方式压缩
+func TestHelloWhileBroadcasting(t *testing.T) {
+	h := &ServeHandler{Router: session.NewRouter()}
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(context.Background(), server)
+
+	var s session.Session
+	for deadline := time.Now().Add(time.Second); s == nil; {
+		if list := h.Sessions(); len(list) > 0 {
+			s = list[0]
+		} else if time.Now().After(deadline) {
+			t.Fatal("连接没有注册")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	packets := make(chan *protocol.Packet, 16)
+	go func() {
+		defer close(packets)
+		r := bufio.NewReader(client)
+		for {
+			p, err := protocol.ReadPacket(r)
+			if err != nil {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	notice := bytes.Repeat([]byte("notice "), 20)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = s.Send(&protocol.Packet{Cmd: protocol.NOTICE, Body: notice})
+		}
+	}()
+
+	body, _ := json.Marshal(protocol.Hello{Version: protocol.ProtocolV2, Compress: []string{protocol.CompressGzip}})
+	bs, err := protocol.EncodePacket(&protocol.Packet{Version: protocol.ProtocolV2, Cmd: protocol.HELLO, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+	for p := range packets {
+		if p.Cmd == protocol.HELLO {
+			var ack protocol.HelloAck
+			if err := json.Unmarshal(p.Body, &ack); err != nil || ack.Compress != protocol.CompressGzip {
+				t.Fatalf("HELLO 回复 %s: %v", p.Body, err)
+			}
+			break
+		}
+	}
+	close(stop)
+	// 广播协程可能正卡在写上，继续读才能让它退出
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-packets:
+		}
+	}
+
+	go func() { _ = s.Send(&protocol.Packet{Cmd: protocol.ROOM_STATE, Body: notice}) }()
+	for p := range packets {
+		if p.Cmd != protocol.ROOM_STATE {
+			continue
+		}
+		if p.Flags&protocol.FlagCompressed == 0 {
+			t.Fatal("握手之后的消息没有压缩")
+		}
+		got, err := protocol.DecompressBody(protocol.CompressGzip, p.Body)
+		if err != nil || !bytes.Equal(got, notice) {
+			t.Fatalf("解压结果不一致: %v", err)
+		}
+		return
+	}
+	t.Fatal("没有收到握手之后的消息")
+}
@@ -0,0 +1,37 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"gameserver/tcp/proxyproto"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+)
+
+// tcpRTT 从内核的 TCP_INFO 读平滑后的 RTT，拿不到时为 0
+func tcpRTT(conn net.Conn) time.Duration {
+	// TLS 和 PROXY 协议的连接外面都包了一层，取出底层的 tcp 连接
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyproto.Conn:
+			conn = c.Conn
+		case *net.TCPConn:
+			raw, err := c.SyscallConn()
+			if err != nil {
+				return 0
+			}
+			var info *unix.TCPInfo
+			_ = raw.Control(func(fd uintptr) {
+				info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+			})
+			if err != nil || info == nil {
+				return 0
+			}
+			return time.Duration(info.Rtt) * time.Microsecond
+		default:
+			return 0
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"net"
+	"time"
+)
+
+// tcpRTT 只有 linux 能从内核读 TCP_INFO，其他系统不统计
+func tcpRTT(conn net.Conn) time.Duration {
+	return 0
+}
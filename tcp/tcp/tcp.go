@@ -7,76 +7,199 @@ package tcp
 import (
 	"bufio"
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"gameserver/admin"
+	"gameserver/ipfilter"
+	"gameserver/metrics"
+	"gameserver/protocol"
+	"gameserver/ratelimit"
+	"gameserver/session"
+	"gameserver/tcp/proxyproto"
+	"gameserver/tcp/restart"
+	"gameserver/tcp/rudp"
 	"gameserver/tcp/sync/atomic"
 	"gameserver/tcp/sync/wait"
-	"gameserver/utils"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
+	goatomic "sync/atomic"
 	"syscall"
 	"time"
 )
 
-// 定义主命令常量
-const (
-	LOGIN_AUTH = 1001 // 登录验证
-	SIGN_DAY   = 1002 // 每日签到
-)
-
 // Config stores tcp server properties
 type Config struct {
 	Address    string        `yaml:"address"`     // 监听地址
 	MaxConnect uint32        `yaml:"max-connect"` // 最大连接数
 	Timeout    time.Duration `yaml:"timeout"`     // 超时时间
+	TLS        TLSConfig     `yaml:"tls"`         // TLS 配置，不开启时是明文 tcp
+	UDP        UDPConfig     `yaml:"udp"`         // 可靠 udp 配置，和 tcp 共用同一个 Handler
+
+	Proxy proxyproto.Config `yaml:"proxy-protocol"` // 在 L4 负载均衡后面时，从 PROXY 头取得客户端真实地址
+
+	DrainTimeout time.Duration `yaml:"drain-timeout"` // 平滑重启时等待旧连接断开的最长时间
 }
 
+const (
+	// 没有配置时的默认排空时间
+	defaultDrainTimeout = 60 * time.Second
+	// 通知重连时随机等待的最长时间，避免所有客户端同时连新进程
+	reconnectSpread = 3 * time.Second
+)
+
 // Handler 是应用层服务器的抽象接口
 type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 	NormalClose(client *ServeClient) error
+	Drain(timeout time.Duration)
 }
 
 // ServeClient 客户端连接的抽象
 type ServeClient struct {
-	Conn      net.Conn  // tcp 连接
-	AuthState bool      // 认证状态，连接成功后必须在规定时间内认证，不然就主动断开
-	Waiting   wait.Wait // 当服务端开始发送数据时进入waiting, 阻止其它goroutine关闭连接
+	Conn      net.Conn       // tcp 连接
+	AuthState atomic.Boolean // 认证状态，连接成功后必须在规定时间内认证，不然就主动断开
+	Waiting   wait.Wait      // 当服务端开始发送数据时进入waiting, 阻止其它goroutine关闭连接
+
+	// 读协程握手时写，广播、踢人、排空这些协程发消息时读，都用原子操作
+	version goatomic.Uint32                     // 协议版本，收到第一个包或者 HELLO 之后确定
+	hello   goatomic.Pointer[protocol.HelloAck] // HELLO 协商的结果，为 nil 时还没有握手
+
+	id         int64              // 会话ID
+	accid      int64              // 认证后绑定的账号
+	attributes session.Attributes // 会话上挂的自定义数据
+	writeMu    sync.Mutex         // 多个goroutine写同一个连接时加锁
 }
 
 // ServeHandler 服务端处理函数
 type ServeHandler struct {
-	activeConn sync.Map       // 所有活跃连接，存的是上面的ServeClient，为什么用sync.map呢，是因为在协程里面不会被锁报错
-	closing    atomic.Boolean // 关闭状态
+	Router     *session.Router // 命令路由，和 websocket 服务器共用
+	activeConn sync.Map        // 所有活跃连接，存的是上面的ServeClient，为什么用sync.map呢，是因为在协程里面不会被锁报错
+	closing    atomic.Boolean  // 关闭状态
 }
 
 // ListenAndServeWithSignal 监听中断信号并通过 closeChan 通知服务器关闭
+// 开启 TLS 时 SIGHUP 用来重新加载证书，不会关闭服务器
+// SIGUSR2 平滑重启：启动新进程并交出监听，旧进程通知客户端重连，连接排空后退出
 func ListenAndServeWithSignal(cfg *Config, handler Handler) error {
 	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
+	drained := make(chan struct{})
+	var restarting atomic.Boolean
+	sigCh := make(chan os.Signal, 1)
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+
+	// 平滑重启启动的进程直接用旧进程交过来的 socket
+	rawListener, err := restart.Listen("tcp", cfg.Address)
+	if err != nil {
+		slog.Error("tcp服务器监听失败", "addr", cfg.Address, "err", err)
+		return err
+	}
+	listener := rawListener
+	// PROXY 头在 TLS 握手之前
+	if cfg.Proxy.Enable {
+		pl, err := proxyproto.NewListener(listener, cfg.Proxy)
+		if err != nil {
+			slog.Error("PROXY协议配置错误", "err", err)
+			_ = listener.Close()
+			return err
+		}
+		listener = pl
+	}
+	var reloader *certReloader
+	if cfg.TLS.Enable {
+		reloader, err = newCertReloader(&cfg.TLS)
+		if err != nil {
+			slog.Error("TLS证书加载失败", "err", err)
+			_ = listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, reloader.serverConfig())
+	}
+	var udpListener *rudp.Listener
+	if cfg.UDP.Enable {
+		pc, err := restart.ListenPacket("udp", cfg.UDP.Address)
+		if err != nil {
+			slog.Error("udp服务器监听失败", "addr", cfg.UDP.Address, "err", err)
+			_ = listener.Close()
+			return err
+		}
+		udpListener = rudp.Serve(pc, cfg.UDP.Config)
+		slog.Info("udp服务器开始监听", "addr", cfg.UDP.Address)
+		go ListenAndServe(udpListener, handler, closeChan)
+	}
+	// 如果是平滑重启启动的，通知旧进程停止 Accept
+	restart.Ready()
+	admin.SetListening("tcp", true)
+	if udpListener != nil {
+		admin.SetListening("udp", true)
+	}
 
 	// 我理解是创建一个通道，用于接收发来的信号，如果收到退出信号就发给closeChan通道，执行退出操作
 	// 比如我们ctrl+c主动关闭，就会触发，或者在linux服务器上面杀进程
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
 	go func() {
 		// 这里该协程被通道阻塞了，等下次收到命令后继续执行
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			closeChan <- struct{}{}
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP && reloader != nil {
+				// 只影响之后的新连接，已经握手的连接继续用旧证书
+				if err := reloader.Reload(); err != nil {
+					slog.Error("TLS证书重新加载失败，继续使用旧证书", "err", err)
+				} else {
+					slog.Info("TLS证书重新加载成功")
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				if restarting.Get() {
+					continue
+				}
+				if _, err := restart.Fork(); err != nil {
+					slog.Error("平滑重启失败，继续提供服务", "err", err)
+					continue
+				}
+				restarting.Set(true)
+				admin.SetDraining()
+				go func() {
+					// 停止 Accept 之后，ListenAndServe 会等现有的连接都结束再返回
+					_ = listener.Close()
+					if udpListener != nil {
+						// udp 会话和 tcp 连接一样排空，新会话的 SYN 交给新进程
+						// 新旧进程读同一个 socket，被新进程读走的旧会话的包靠重传补上
+						udpListener.Shutdown()
+					}
+					handler.Drain(cfg.DrainTimeout)
+					close(drained)
+				}()
+				continue
+			}
+			switch sig {
+			case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+				// tcp 和 udp 监听都在等这个通道，关闭通道可以同时通知到
+				admin.SetDraining()
+				close(closeChan)
+				return
+			}
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		log.Println("tcp服务器监听失败，", err)
-		return err
-	}
-	log.Println(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
+	slog.Info("tcp服务器开始监听", "addr", cfg.Address, "tls", cfg.TLS.Enable, "proxy_protocol", cfg.Proxy.Enable)
 	ListenAndServe(listener, handler, closeChan)
+	admin.SetListening("tcp", false)
+	if restarting.Get() {
+		<-drained
+		slog.Info("旧进程连接已排空，退出")
+	}
+	// 只有这里和关闭通知会关闭 handler，udp 的 ListenAndServe 返回时不能把 tcp 的连接也关了
+	if udpListener != nil {
+		_ = udpListener.Close()
+	}
+	_ = handler.Close()
 	return nil
 }
 
@@ -85,16 +208,15 @@ func ListenAndServe(listener net.Listener, handler Handler, closeChan <-chan str
 	// 监听关闭通知
 	go func() {
 		<-closeChan
-		log.Println("服务器主动关闭...")
+		slog.Info("服务器主动关闭...")
 		_ = listener.Close() // 停止监听，listener.Accept()会立即返回 io.EOF
 		_ = handler.Close()  // 关闭应用层服务器
 	}()
 
-	// 在异常退出后释放资源
+	// 在异常退出后释放监听，handler 由调用方关闭，tcp 和 udp 共用一个 handler
 	defer func() {
-		log.Println("服务器defer关闭...")
+		slog.Info("服务器defer关闭...")
 		_ = listener.Close()
-		_ = handler.Close()
 	}()
 
 	// 返回一个空的Context
@@ -105,14 +227,22 @@ func ListenAndServe(listener net.Listener, handler Handler, closeChan <-chan str
 		// 监听端口, 阻塞直到收到新连接或者出现错误
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("accept err: ", err)
+			slog.Info("停止接受新连接", "err", err)
 			break
 		}
+		// 黑名单、封禁、连接太频繁或者连接数超限的 IP 直接断开，不启动处理协程
+		release, reason := ipfilter.Accept(ratelimit.Host(conn.RemoteAddr().String()))
+		if release == nil {
+			slog.Info("拒绝连接", "addr", conn.RemoteAddr().String(), "reason", reason)
+			_ = conn.Close()
+			continue
+		}
 		// 开启 goroutine 来处理新连接
-		log.Println("客户端连接，来自:", conn.RemoteAddr().String())
+		slog.Info("客户端连接", "addr", conn.RemoteAddr().String())
 		wg.Add(1) // 计数器+1
 		go func() {
 			defer func() {
+				release()
 				wg.Done() // 计数器-1
 			}()
 			handler.Handle(ctx, conn)
@@ -126,65 +256,120 @@ func (h *ServeHandler) Handle(ctx context.Context, conn net.Conn) {
 	// 关闭中的 handler 不会处理新连接的消息
 	if h.closing.Get() {
 		_ = conn.Close()
+		return
 	}
 
 	// 创建客户端结构体
 	client := &ServeClient{
-		Conn:      conn,
-		AuthState: false,
+		Conn: conn,
+		id:   session.NextID(),
 	}
 	// 保存存活的连接到sync.map中
 	h.activeConn.Store(client, struct{}{})
+	metrics.Accepts.WithLabelValues(client.Transport()).Inc()
+	metrics.Sessions.WithLabelValues(client.Transport()).Inc()
+	defer metrics.Sessions.WithLabelValues(client.Transport()).Dec()
 
 	// 检查认证
 	go client.CheckAuth(h)
 
+	// 可靠 udp 连接还有一个不可靠通道，单独读
+	if _, ok := conn.(*rudp.Session); ok {
+		go h.serveUnreliable(client)
+	}
+
 	// 从缓存中读取数据，if has
 	reader := bufio.NewReader(conn)
 	for {
-		// 这里以\n为分隔，后期考虑用header+body来处黏包拆包
-		//msg, err := reader.ReadString('\n')
-		msg, err := reader.ReadBytes('\n')
+		// v1 以\n为分隔，v2 以后按包头里的长度分包，由 ReadPacket 根据检验码和版本号决定
+		packet, err := protocol.ReadPacket(reader)
 		if err != nil {
+			var verr *protocol.VersionError
+			switch {
 			// 当在Read时，收到一个IO.EOF，代表的就是对端已经关闭了发送的通道，通常来说是发起了FIN
-			if err == io.EOF {
-				log.Println("客户端主动关闭")
-				h.NormalClose(client)
-			} else {
-				log.Println("read err: ", err)
+			case err == io.EOF:
+				session.Log(client).Info("客户端主动关闭")
+			case errors.As(err, &verr):
+				session.Log(client).Warn("客户端版本不支持", "err", verr)
+				metrics.DecodeErrors.WithLabelValues(client.Transport()).Inc()
+				client.Reject(protocol.ERR_UPGRADE, verr.Error())
+			case err == protocol.ErrProtocol || err == protocol.ErrBodyTooLarge:
+				session.Log(client).Warn("协议错误", "err", err)
+				metrics.DecodeErrors.WithLabelValues(client.Transport()).Inc()
+				client.Reject(protocol.ERR_PROTOCOL, err.Error())
+			default:
+				session.Log(client).Info("读取失败", "err", err)
 			}
+			h.NormalClose(client)
 			return
 		}
-		// 发送数据前先置为waiting状态，阻止连接被关闭
-		client.Waiting.Add(1)
-
 		// 根据接收到的消息执行不同的操作
-		UnPackageBytes(msg, client, h)
-
-		// 发送完毕, 结束waiting
-		client.Waiting.Done()
+		// 处理函数里可能会关闭连接，所以 waiting 只包住真正的写操作（见 Write），不然关闭时会等自己
+		h.dispatch(client, packet)
 	}
 }
 
 // Close 关闭服务器处理函数
 func (h *ServeHandler) Close() error {
-	log.Println("ServeHandler shutting down...")
+	slog.Info("ServeHandler shutting down...")
 	h.closing.Set(true)
 	// 逐个关闭客户端连接
 	h.activeConn.Range(func(key interface{}, val interface{}) bool {
 		client := key.(*ServeClient)
 		_ = client.Close()
 		h.activeConn.Delete(key) // 这里要记住从连接池里面移除
+		h.Router.Closed(client)
 		return true
 	})
 	return nil
 }
 
+// Drain 通知所有客户端重连，等它们自己断开，超时后关闭剩下的连接
+func (h *ServeHandler) Drain(timeout time.Duration) {
+	slog.Info("开始排空连接...", "timeout", timeout)
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		client := key.(*ServeClient)
+		delay := time.Duration(rand.Int63n(int64(reconnectSpread)))
+		if err := client.Write(protocol.NewReconnectPacket(protocol.ReasonRestart, delay)); err != nil {
+			slog.Warn("发送重连通知失败", "err", err)
+		}
+		return true
+	})
+	deadline := time.Now().Add(timeout)
+	for h.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := h.count(); n > 0 {
+		slog.Warn("排空超时，关闭剩余连接", "count", n)
+	}
+	_ = h.Close()
+}
+
+// Sessions 所有连接的快照，包括还没认证的
+func (h *ServeHandler) Sessions() []session.Session {
+	var list []session.Session
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		list = append(list, key.(*ServeClient))
+		return true
+	})
+	return list
+}
+
+// count 当前连接数
+func (h *ServeHandler) count() int {
+	n := 0
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
 // Close 关闭客户端连接
 func (c *ServeClient) Close() error {
 	// 等待数据发送完成或超时10秒后
 	c.Waiting.WaitWithTimeout(10 * time.Second)
-	log.Println("主动关闭客户端:", c.Conn)
+	session.Log(c).Info("主动关闭客户端")
 	c.Conn.Close()
 	return nil
 }
@@ -193,94 +378,172 @@ func (c *ServeClient) Close() error {
 func (h *ServeHandler) NormalClose(c *ServeClient) error {
 	c.Waiting.WaitWithTimeout(10 * time.Second)
 	c.Close()
-	h.activeConn.Delete(c)
+	// 可能会被多个goroutine调用，只有真正移除的那一次通知游戏逻辑
+	if _, ok := h.activeConn.LoadAndDelete(c); ok {
+		h.Router.Closed(c)
+	}
 	return nil
 }
 
 // CheckAuth 检查认证
 func (c *ServeClient) CheckAuth(h *ServeHandler) {
-	log.Println("开始检查auth")
+	session.Log(c).Debug("开始检查auth")
 	select {
 	case <-time.After(time.Second * 10):
-		if c.AuthState == false {
-			log.Println("auth认证失败")
+		if !c.AuthState.Get() {
+			session.Log(c).Info("认证超时，断开")
 			h.NormalClose(c)
 		}
 	}
 }
 
-// UnPackageBytes
-// 解析消息包
-// 消息检验码 4字节
-// 消息长度	4字节
-// 身份		8字节
-// 主命令	4字节
-// 子命令	4字节
-// 加密方式	4字节
-// 消息体	N字节（字节数组：消息长度+消息+消息长度+消息）
-// 分隔符	1字节
-func UnPackageBytes(bs []byte, c *ServeClient, h Handler) {
-
-	log.Println("bytes", bs)
-	log.Println("bytes len", len(bs))
-	// 开始解析bytes
-	// 消息检验码
-	crccode := append([]byte{0, 0, 0, 0}, bs[0:4]...)
-	crccode_i := utils.BytesToInt(crccode)
-	log.Println("消息检验码", crccode_i)
-	if crccode_i != 65433 {
-		log.Println("协议错误", c)
-		h.NormalClose(c)
-		return
+// Write 按客户端的协议版本编码并发送一个包
+func (c *ServeClient) Write(p *protocol.Packet) error {
+	bs, err := c.encode(p)
+	if err != nil {
+		return err
 	}
-	// 消息长度
-	msglen := append([]byte{0, 0, 0, 0}, bs[4:8]...)
-	msglen_i := utils.BytesToInt(msglen)
-	log.Println("消息长度", msglen_i)
-
-	// 身份（账号ID或者其他）
-	accid := bs[8:16]
-	accid_i := utils.BytesToInt(accid)
-	log.Println("身份", accid_i)
-
-	// 主命令
-	mcommand := append([]byte{0, 0, 0, 0}, bs[16:20]...)
-	mcommand_i := utils.BytesToInt(mcommand)
-	log.Println("主命令", mcommand_i)
-
-	// 子命令
-	ccommand := append([]byte{0, 0, 0, 0}, bs[20:24]...)
-	ccommand_i := utils.BytesToInt(ccommand)
-	log.Println("子命令", ccommand_i)
-
-	// 加密方式
-	encrypt := append([]byte{0, 0, 0, 0}, bs[24:28]...)
-	encrypt_i := utils.BytesToInt(encrypt)
-	log.Println("加密方式", encrypt_i)
-
-	// 消息体
-	msgbody := bs[28 : len(bs)-4]
-	log.Println("消息体", msgbody)
-	// 判断
-	if len(msgbody)%8 != 0 {
-		log.Println("消息体结构错误")
-		return
+	// 发送数据前先置为waiting状态，阻止连接被关闭
+	c.Waiting.Add(1)
+	defer c.Waiting.Done()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err = c.Conn.Write(bs); err != nil {
+		return err
 	}
-	num := len(msgbody) / 8
-	ms := 0
-	for i := 0; i < num; i++ {
-		// 每个消息前面都有个是这段消息的长度，这里先不做处理
-		ms++
-		if ms == 1 {
-			continue
+	metrics.PacketsOut.WithLabelValues(c.Transport(), metrics.Cmd(p.Cmd)).Inc()
+	return nil
+}
+
+// encode 按连接的协议版本和 HELLO 协商的方式编码，可靠和不可靠通道都走这里
+// 同一个包可能发给多个连接，在拷贝上修改，不动传进来的包
+func (c *ServeClient) encode(p *protocol.Packet) ([]byte, error) {
+	cp := *p
+	if cp.Version == 0 {
+		cp.Version = c.Version()
+	}
+	// 握手完成后，按协商的方式压缩消息体，HELLO 和错误包不压缩
+	ack := c.hello.Load()
+	if ack != nil && cp.Version >= protocol.ProtocolV2 && cp.Cmd != protocol.HELLO && cp.Cmd != protocol.ERROR &&
+		ack.Compress != "" && ack.Compress != protocol.CompressNone && len(cp.Body) > 0 {
+		body, err := protocol.CompressBody(ack.Compress, cp.Body)
+		if err != nil {
+			return nil, err
+		}
+		cp.Body = body
+		cp.Flags |= protocol.FlagCompressed
+	}
+	return protocol.EncodePacket(&cp)
+}
+
+// Reject 发送错误包，一般紧接着就会关闭连接
+func (c *ServeClient) Reject(code uint32, msg string) {
+	if err := c.Write(protocol.NewErrorPacket(code, msg)); err != nil {
+		session.Log(c).Warn("发送错误包失败", "code", code, "err", err)
+	}
+}
+
+// ID 会话ID
+func (c *ServeClient) ID() int64 {
+	return c.id
+}
+
+// Version 连接的协议版本，还没收到包时为 0
+func (c *ServeClient) Version() uint8 {
+	return uint8(c.version.Load())
+}
+
+// Accid 认证后绑定的账号
+func (c *ServeClient) Accid() int64 {
+	return goatomic.LoadInt64(&c.accid)
+}
+
+// Authed 是否已经认证
+func (c *ServeClient) Authed() bool {
+	return c.AuthState.Get()
+}
+
+// Authenticate 认证通过，绑定账号
+func (c *ServeClient) Authenticate(accid int64) {
+	goatomic.StoreInt64(&c.accid, accid)
+	c.AuthState.Set(true)
+	// udp 会话认证后才允许客户端换地址
+	if sess, ok := c.Conn.(*rudp.Session); ok {
+		sess.Authenticate(accid)
+	}
+}
+
+// Send 实现 session.Session
+func (c *ServeClient) Send(p *protocol.Packet) error {
+	return c.Write(p)
+}
+
+// RemoteAddr 对端地址
+func (c *ServeClient) RemoteAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// ClientIP 客户端真实 IP，开启 PROXY 协议时 RemoteAddr 已经是真实地址
+func (c *ServeClient) ClientIP() string {
+	return ratelimit.Host(c.Conn.RemoteAddr().String())
+}
+
+// Transport 传输方式
+func (c *ServeClient) Transport() string {
+	if _, ok := c.Conn.(*rudp.Session); ok {
+		return session.TransportUDP
+	}
+	return session.TransportTCP
+}
+
+// RTT 往返时间，udp 用可靠通道的平滑 RTT，tcp 从内核读，拿不到时为 0
+func (c *ServeClient) RTT() time.Duration {
+	if sess, ok := c.Conn.(*rudp.Session); ok {
+		return sess.RTT()
+	}
+	return tcpRTT(c.Conn)
+}
+
+// Attributes 会话上挂的自定义数据
+func (c *ServeClient) Attributes() *session.Attributes {
+	return &c.attributes
+}
+
+// dispatch 根据主命令执行不同的操作
+func (h *ServeHandler) dispatch(c *ServeClient, p *protocol.Packet) {
+	c.version.CompareAndSwap(0, uint32(p.Version))
+	ack := c.hello.Load()
+	if p.Flags&protocol.FlagCompressed != 0 {
+		// 没有协商压缩方式时不能带压缩标志
+		if ack == nil || ack.Compress == protocol.CompressNone {
+			session.LogPacket(c, p).Warn("没有协商压缩就发送压缩的消息")
+			c.Reject(protocol.ERR_PROTOCOL, "compression not negotiated")
+			h.NormalClose(c)
+			return
+		}
+		body, err := protocol.DecompressBody(ack.Compress, p.Body)
+		if err != nil {
+			session.LogPacket(c, p).Warn("消息体解压失败", "err", err)
+			c.Reject(protocol.ERR_PROTOCOL, "bad compressed body")
+			h.NormalClose(c)
+			return
 		}
-		// 取到消息体
-		tmsg := msgbody[(i * 8):((i + 1) * 8)]
-		log.Println("消息", string(tmsg))
-		ms = 0
+		p.Body = body
+	}
+
+	// v1 客户端没有 HELLO，保持原来的行为；v2 及以后必须先握手
+	if p.Cmd == protocol.HELLO {
+		h.hello(c, p)
+		return
+	}
+	if p.Version >= protocol.ProtocolV2 && ack == nil {
+		session.LogPacket(c, p).Warn("没有 HELLO 就发送命令")
+		c.Reject(protocol.ERR_HELLO_REQUIRED, "hello required")
+		h.NormalClose(c)
+		return
 	}
 
-	// 剩下的是分隔符len(bs)-4
-	log.Println("auth检查通过")
-	c.AuthState = true
+	// v1 客户端也要先用 LOGIN_AUTH 认证，包头里的 accid 不可信
+	// 认证在工作协程里做，没有认证的命令由 Router 按顺序检查并拒绝，这里不能提前判断
+	h.Router.Dispatch(c, p)
 }
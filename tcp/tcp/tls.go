@@ -0,0 +1,164 @@
+package tcp
+
+/**
+ * tcp 监听的 TLS 支持，证书可以在收到 SIGHUP 时热加载，已经建立的连接不受影响
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLSConfig tcp 服务器的 TLS 配置
+type TLSConfig struct {
+	Enable            bool   `yaml:"enable"`              // 是否开启 TLS
+	CertFile          string `yaml:"cert-file"`           // 证书路径
+	KeyFile           string `yaml:"key-file"`            // 私钥路径
+	SelfSigned        bool   `yaml:"self-signed"`         // 开发模式，启动时生成自签名证书，不需要证书文件
+	ClientCAFile      string `yaml:"client-ca-file"`      // 校验客户端证书的 CA，设置后开启双向认证，用于服务器之间的连接
+	RequireClientCert bool   `yaml:"require-client-cert"` // 为 true 时所有连接都必须带证书，否则只校验带了证书的连接
+}
+
+// certReloader 持有当前生效的 tls.Config，新连接握手时取最新的一份
+type certReloader struct {
+	cfg     *TLSConfig
+	mu      sync.RWMutex
+	current *tls.Config
+}
+
+func newCertReloader(cfg *TLSConfig) (*certReloader, error) {
+	r := &certReloader{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新读取证书文件，失败时保留原来的证书
+func (r *certReloader) Reload() error {
+	var cert tls.Certificate
+	var err error
+	if r.cfg.SelfSigned {
+		r.mu.RLock()
+		loaded := r.current != nil
+		r.mu.RUnlock()
+		if loaded {
+			// 自签名证书不需要重新生成
+			return nil
+		}
+		cert, err = selfSignedCert()
+	} else {
+		cert, err = tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		conf.ClientCAs = pool
+		if r.cfg.RequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	r.mu.Lock()
+	r.current = conf
+	r.mu.Unlock()
+	return nil
+}
+
+// serverConfig 给 tls.NewListener 用的配置，每次握手都取当前生效的证书
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.current, nil
+		},
+	}
+}
+
+// NewClientTLSConfig 服务器之间连接时使用的客户端配置，certFile 和 keyFile 为空时不带客户端证书
+func NewClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("CA 证书解析失败: " + file)
+	}
+	return pool, nil
+}
+
+// selfSignedCert 生成一个给 localhost 用的自签名证书，只用于开发环境
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gameserver dev"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	slog.Warn("使用自签名证书，仅限开发环境")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
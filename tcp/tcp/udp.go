@@ -0,0 +1,59 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"gameserver/metrics"
+	"gameserver/protocol"
+	"gameserver/session"
+	"gameserver/tcp/rudp"
+)
+
+// UDPConfig 可靠 udp 监听配置
+type UDPConfig struct {
+	Enable      bool   `yaml:"enable"`  // 是否同时监听 udp
+	Address     string `yaml:"address"` // 监听地址
+	rudp.Config `yaml:",inline"`
+}
+
+// WriteUnreliable 通过不可靠通道发送，适合位置同步这类只关心最新状态的消息
+// 不是 udp 连接或者包太大时退回到可靠通道
+func (c *ServeClient) WriteUnreliable(p *protocol.Packet) error {
+	sess, ok := c.Conn.(*rudp.Session)
+	if !ok {
+		return c.Write(p)
+	}
+	bs, err := c.encode(p)
+	if err != nil {
+		return err
+	}
+	if err = sess.SendUnreliable(bs); err == rudp.ErrTooLarge {
+		return c.Write(p)
+	}
+	if err == nil {
+		metrics.PacketsOut.WithLabelValues(session.TransportUDP, metrics.Cmd(p.Cmd)).Inc()
+	}
+	return err
+}
+
+// serveUnreliable 读取 udp 会话的不可靠通道，每个 udp 包里是一个完整的 Packet
+func (h *ServeHandler) serveUnreliable(c *ServeClient) {
+	sess := c.Conn.(*rudp.Session)
+	for {
+		data, err := sess.ReadUnreliable()
+		if err != nil {
+			return
+		}
+		// 不可靠通道只接受认证过的消息
+		if !c.Authed() {
+			continue
+		}
+		packet, err := protocol.ReadPacket(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			session.Log(c).Warn("不可靠消息解析失败", "err", err)
+			metrics.DecodeErrors.WithLabelValues(session.TransportUDP).Inc()
+			continue
+		}
+		h.dispatch(c, packet)
+	}
+}
@@ -0,0 +1,56 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"gameserver/protocol"
+	"gameserver/tcp/rudp"
+	"net"
+	"testing"
+)
+
+// 不可靠通道和可靠通道按同样的协商结果编码，并且不修改调用方的包
+func TestWriteUnreliableEncoding(t *testing.T) {
+	cfg := rudp.DefaultConfig()
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := rudp.Serve(spc, cfg)
+	defer l.Close()
+	remote, err := rudp.Dial(l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ServeClient{Conn: conn}
+	c.version.Store(protocol.ProtocolV2)
+	c.hello.Store(&protocol.HelloAck{Version: protocol.ProtocolV2, Codec: protocol.CodecBinary, Compress: protocol.CompressGzip, Encrypt: protocol.EncryptNone})
+
+	body := bytes.Repeat([]byte("position "), 20)
+	p := &protocol.Packet{Cmd: protocol.ROOM_SYNC, Accid: 1, Body: body}
+	if err := c.WriteUnreliable(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != 0 || p.Flags != 0 || !bytes.Equal(p.Body, body) {
+		t.Fatalf("调用方的包被修改了: %+v", p)
+	}
+	data, err := remote.ReadUnreliable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := protocol.ReadPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != protocol.ProtocolV2 || got.Flags&protocol.FlagCompressed == 0 {
+		t.Fatalf("不可靠通道的包没有按协商压缩: version %d flags %d", got.Version, got.Flags)
+	}
+	if plain, err := protocol.DecompressBody(protocol.CompressGzip, got.Body); err != nil || !bytes.Equal(plain, body) {
+		t.Fatalf("解压结果不一致: %v", err)
+	}
+}
@@ -2,41 +2,74 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"math/rand"
+	"gameserver/protocol"
+	"gameserver/tcp/rudp"
 	"net"
-	"strconv"
+	"time"
 )
 
 func main() {
+	useUDP := flag.Bool("udp", false, "使用可靠 udp 连接")
+	loss := flag.Float64("loss", 0, "udp 模拟丢包率 0-1")
+	account := flag.String("account", "", "账号")
+	token := flag.String("token", "", "http 登录后拿到的 token")
+	flag.Parse()
+
 	var err error
 	//closeChan := make(chan struct{})
 	addr := "127.0.0.1:20001"
 
 	//conn, err := net.Dial("tcp", addr)
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	if *useUDP {
+		conn, err = dialUDP(addr, *loss)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		fmt.Println("TCP服务器连接失败：", err)
 		return
 	}
+	reader := bufio.NewReader(conn)
+
+	// 先 HELLO 协商协议
+	hello, _ := json.Marshal(protocol.Hello{
+		Version:  protocol.CurrentVersion,
+		Codecs:   []string{protocol.CodecJSON},
+		Compress: []string{protocol.CompressGzip, protocol.CompressNone},
+		Encrypt:  []string{protocol.EncryptNone},
+	})
+	if err = send(conn, &protocol.Packet{Cmd: protocol.HELLO, Body: hello}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	ack, err := protocol.ReadPacket(reader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if ack.Cmd != protocol.HELLO {
+		fmt.Println("HELLO 失败：", ack.SubCmd, string(ack.Body))
+		return
+	}
+	fmt.Println("HELLO 协商结果：", string(ack.Body))
 
-	for i := 0; i < 10; i++ {
-		val := strconv.Itoa(rand.Int())
-		_, err = conn.Write([]byte(val + "\n"))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		bufReader := bufio.NewReader(conn)
-		line, _, err := bufReader.ReadLine()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		if string(line) != val {
-			fmt.Println("get wrong response")
-			return
-		}
+	// 再登录验证
+	auth, _ := json.Marshal(map[string]string{"account": *account, "token": *token})
+	if err = send(conn, &protocol.Packet{Cmd: protocol.LOGIN_AUTH, Body: auth}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if reply, err := protocol.ReadPacket(reader); err == nil {
+		fmt.Println("登录验证结果：", reply.Cmd, reply.Accid, string(reply.Body))
+	}
+	if *useUDP {
+		// udp 的数据在发送队列里，等一会再退出
+		time.Sleep(500 * time.Millisecond)
+		_ = conn.Close()
 	}
 	//_ = conn.Close()
 	//for i := 0; i < 5; i++ {
@@ -46,3 +79,28 @@ func main() {
 	//closeChan <- struct{}{}
 	//time.Sleep(time.Second)
 }
+
+// dialUDP 连接可靠 udp，loss 大于 0 时模拟弱网
+func dialUDP(addr string, loss float64) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	if loss > 0 {
+		pc = rudp.NewLossyPacketConn(pc, loss, 20*time.Millisecond, 20*time.Millisecond)
+	}
+	return rudp.DialWithConn(pc, raddr, rudp.DefaultConfig())
+}
+
+func send(conn net.Conn, p *protocol.Packet) error {
+	bs, err := protocol.EncodePacket(p)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(bs)
+	return err
+}
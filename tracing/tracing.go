@@ -0,0 +1,127 @@
+package tracing
+
+/**
+ * 调用链追踪：基于 OpenTelemetry，http 登录请求、tcp/websocket 命令分发、mysql 和 redis 调用都会记录 span
+ * 客户端发起的命令可以在包头里带上 W3C traceparent，服务器的 span 接在客户端的调用链后面
+ * 没有配置导出方式时 span 不会被记录，只传递上下文
+ */
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 导出方式
+const (
+	ExporterNone   = ""       // 不导出
+	ExporterStdout = "stdout" // 每个 span 一行 JSON 输出到标准输出，调试用
+	ExporterOTLP   = "otlp"   // OTLP/HTTP 发给 collector
+)
+
+// 没有配置 collector 地址时的默认值，一般是本机的 collector
+const defaultEndpoint = "http://127.0.0.1:4318"
+
+// 退出时等待剩余 span 发送的时间
+const shutdownTimeout = 5 * time.Second
+
+// Config 追踪配置
+type Config struct {
+	Exporter string  `yaml:"exporter"` // 为空不开启，stdout 或者 otlp
+	Endpoint string  `yaml:"endpoint"` // otlp collector 的地址，默认 http://127.0.0.1:4318，https 开头时使用 TLS
+	Ratio    float64 `yaml:"ratio"`    // 采样比例 0-1，客户端带来的调用链按客户端的采样决定
+}
+
+// DefaultConfig 默认配置：不导出，开启后全部采样
+func DefaultConfig() Config {
+	return Config{Ratio: 1}
+}
+
+var tracer = otel.Tracer("gameserver")
+
+// Setup 按配置设置全局的 TracerProvider，service 是导出时的服务名
+// 返回的函数在进程退出前调用，把还没发出去的 span 发完
+func Setup(cfg Config, service string) (func(), error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone:
+		return func() {}, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New()
+	case ExporterOTLP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		}
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	default:
+		return nil, errors.New("不支持的追踪导出方式: " + cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	slog.Info("开启调用链追踪", "exporter", cfg.Exporter, "service", service, "ratio", cfg.Ratio)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("发送剩余的span失败", "err", err)
+		}
+	}, nil
+}
+
+// Start 开始一个 span，结束时调用 End
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End 结束 span，err 不为 nil 时记录错误
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract 从客户端带来的 traceparent 还原调用链，没有带或者格式错误时返回 ctx 本身
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// ExtractHTTP 从 http 请求头里还原调用链，websocket 升级请求也用这个
+func ExtractHTTP(req *http.Request) context.Context {
+	return propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// TraceID 当前调用链的 ID，记日志时用来关联，没有调用链时返回空
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -9,9 +9,9 @@ import (
 )
 
 type JsonResult struct {
-	Code int16       `json:"code"`
-	Msg  string      `json:"msg"`
-	data interface{} `json:"data"`
+	Code int16  `json:"code"`
+	Msg  string `json:"msg"`
+	data interface{}
 }
 
 func ReturnJson(code int16, msg string, data interface{}) JsonResult {
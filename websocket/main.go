@@ -1,7 +1,104 @@
 package main
 
-import "gameserver/websocket/wsocket"
+import (
+	"flag"
+	"gameserver/admin"
+	"gameserver/game"
+	"gameserver/gm"
+	"gameserver/ipfilter"
+	"gameserver/logger"
+	"gameserver/model"
+	"gameserver/ratelimit"
+	"gameserver/session"
+	"gameserver/tcp/tcp"
+	"gameserver/tracing"
+	"gameserver/websocket/wsocket"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// serverConfig 配置文件的结构，字段和 tcp 服务器的配置文件一样，websocket 配置在 websocket 下面
+type serverConfig struct {
+	WebSocket wsocket.Config       `yaml:"websocket"`  // 监听地址、允许的网页来源、认证和关闭超时
+	Workers   session.WorkerConfig `yaml:"workers"`    // 消息处理的工作协程池
+	RateLimit ratelimit.Config     `yaml:"rate-limit"` // 会话和 IP 限速，超速后逐级丢弃、警告、断开、封禁
+	IPFilter  ipfilter.Config      `yaml:"ip-filter"`  // 新连接的黑白名单和单个 IP 连接数上限
+
+	Admin   admin.Config   `yaml:"admin"`   // 管理端口：健康检查、就绪检查、指标、运维接口和 GM 控制台
+	Log     logger.Config  `yaml:"log"`     // 日志级别、格式和采样
+	Tracing tracing.Config `yaml:"tracing"` // 调用链追踪的导出方式和采样
+}
 
 func main() {
-	wsocket.StartWebsocket("20002")
+	configFile := flag.String("c", "", "配置文件路径（yaml），不指定时使用默认配置")
+	flag.Parse()
+
+	var config serverConfig
+	config.WebSocket.Address = ":20002"
+	config.WebSocket.MaxConnect = 10000
+	config.Workers.Workers = 64
+	config.Workers.QueueSize = 256
+	config.RateLimit = ratelimit.DefaultConfig()
+	config.Admin.Address = "127.0.0.1:9102"
+	config.Log = logger.DefaultConfig()
+	config.Tracing = tracing.DefaultConfig()
+	if *configFile != "" {
+		if err := tcp.LoadConfig(*configFile, &config); err != nil {
+			slog.Error("读取配置文件失败", "file", *configFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	if err := logger.Setup(config.Log); err != nil {
+		slog.Error("日志配置错误", "err", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := tracing.Setup(config.Tracing, "websocket")
+	if err != nil {
+		slog.Error("调用链追踪配置错误", "err", err)
+		os.Exit(1)
+	}
+
+	if config.Admin.Address != "" {
+		game.AddReadyChecks()
+		admin.HandleAPI("/api/", gm.Handler())
+		// 管理端口起不来时就绪检查一直失败，负载均衡不会把玩家转过来，直接退出，错误已经记了日志
+		go func() {
+			if err := admin.ListenAndServe(config.Admin); err != nil {
+				os.Exit(1)
+			}
+		}()
+		if config.Admin.Console != "" {
+			go func() {
+				if err := gm.ServeConsole(config.Admin.Console, config.Admin.Operators); err != nil {
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+	router := game.NewRouter()
+	router.UseWorkers(config.Workers)
+	gm.Setup(router)
+	go gm.WatchKicks()
+	go gm.WatchRevokedTokens()
+	gm.AddSessions(wsocket.Sessions)
+	ratelimit.Setup(config.RateLimit)
+	router.UseLimits(config.RateLimit)
+	if err := ipfilter.Setup(config.IPFilter); err != nil {
+		slog.Error("连接过滤配置错误", "err", err)
+		os.Exit(1)
+	}
+	// 封禁保存在 redis 里，所有节点共享
+	ratelimit.Bans.UseStore(model.IPBanStore{}, 5*time.Second)
+	// 停服维护的对局都结束后，走和 kill 一样的关闭流程
+	go game.WatchMaintenance(router, func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	})
+	if err := wsocket.ListenAndServeWithSignal(&config.WebSocket, router); err != nil {
+		slog.Error("websocket服务器退出", "err", err)
+		os.Exit(1)
+	}
+	router.Stop()
+	shutdownTracing()
 }
@@ -0,0 +1,111 @@
+package wsocket
+
+/**
+ * websocket 升级时的来源检查和 token 认证
+ * token 可以放在 ?account=&token= 查询参数里，或者 Sec-WebSocket-Protocol 里（浏览器不能自定义请求头），
+ * 都没有时升级后必须在 AuthTimeout 内发送 LOGIN_AUTH，和 tcp 的 CheckAuth 一样
+ */
+
+import (
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/session"
+	"gameserver/tracing"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 浏览器通过子协议传 token 时使用：new WebSocket(url, [AuthProtocol, account + "." + token])
+const AuthProtocol = "gameserver.auth"
+
+// 没有配置时的默认认证超时
+const defaultAuthTimeout = 10 * time.Second
+
+// checkOrigin 按配置的白名单检查来源，没有 Origin 头的原生客户端直接放行
+// 白名单为空时只允许同源，"*" 表示允许所有来源
+func checkOrigin(allow []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(allow) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, o := range allow {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		slog.Info("websocket来源不在白名单", "origin", origin)
+		return false
+	}
+}
+
+// credentials 从请求里取出账号和 token，返回浏览器需要回应的子协议
+func credentials(r *http.Request) (account string, token string, protocolHeader http.Header) {
+	q := r.URL.Query()
+	if q.Get("token") != "" {
+		return q.Get("account"), q.Get("token"), nil
+	}
+	protocols := websocketProtocols(r)
+	for i, p := range protocols {
+		if p == AuthProtocol && i+1 < len(protocols) {
+			parts := strings.SplitN(protocols[i+1], ".", 2)
+			if len(parts) == 2 {
+				// 浏览器要求服务器从客户端给出的子协议里选一个回应
+				header := http.Header{}
+				header.Set("Sec-WebSocket-Protocol", AuthProtocol)
+				return parts[0], parts[1], header
+			}
+		}
+	}
+	return "", "", nil
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, h := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// authenticate 在升级之前校验 token，没有带 token 时 ok 为 true、accinfo 为空，由 checkAuth 兜底
+func authenticate(r *http.Request) (accinfo model.Account, token string, header http.Header, ok bool) {
+	account, token, header := credentials(r)
+	if token == "" {
+		return model.Account{}, "", header, true
+	}
+	// 升级请求带了 traceparent 头时接在客户端的调用链后面
+	ctx, span := tracing.Start(tracing.ExtractHTTP(r), "ws auth")
+	accinfo, err := model.VerifyToken(ctx, account, token)
+	tracing.End(span, err)
+	if err != nil {
+		slog.Warn("websocket token认证失败", "account", account, "err", err)
+		return model.Account{}, "", nil, false
+	}
+	return accinfo, token, header, true
+}
+
+// checkAuth 升级时没有认证的连接，必须在规定时间内通过 LOGIN_AUTH 认证，不然就主动断开
+func (wsConn *wsConnection) checkAuth(timeout time.Duration) {
+	select {
+	case <-time.After(timeout):
+		if !wsConn.Authed() {
+			session.Log(wsConn).Info("认证超时，断开")
+			_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_AUTH, "login auth timeout"))
+			wsConn.shutdown(websocket.ClosePolicyViolation, "login auth timeout")
+		}
+	case <-wsConn.closeChan:
+	}
+}
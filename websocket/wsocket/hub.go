@@ -0,0 +1,209 @@
+package wsocket
+
+/**
+ * websocket 连接中心：登记所有连接，提供广播、单发、分组，并限制最大连接数
+ */
+
+import (
+	"errors"
+	"gameserver/metrics"
+	"gameserver/protocol"
+	"gameserver/session"
+	"log/slog"
+	"sync"
+)
+
+var (
+	// ErrHubFull 连接数已经达到上限
+	ErrHubFull = errors.New("连接数已满")
+	// ErrNotFound 连接不存在或者已经断开
+	ErrNotFound = errors.New("连接不存在")
+)
+
+// Hub 所有 websocket 连接，所有方法都可以在多个goroutine里调用
+type Hub struct {
+	MaxConnect int // 最大连接数，0 表示不限制
+
+	mu     sync.RWMutex
+	conns  map[int64]*wsConnection
+	groups map[string]map[int64]*wsConnection
+	router *session.Router
+}
+
+// NewHub 创建连接中心，连接断开时通过 router 通知游戏逻辑
+func NewHub(maxConnect int, router *session.Router) *Hub {
+	return &Hub{
+		MaxConnect: maxConnect,
+		conns:      make(map[int64]*wsConnection),
+		groups:     make(map[string]map[int64]*wsConnection),
+		router:     router,
+	}
+}
+
+// Full 是否已经达到连接上限，升级之前先检查，避免白白握手
+func (h *Hub) Full() bool {
+	if h.MaxConnect <= 0 {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns) >= h.MaxConnect
+}
+
+// Register 登记新连接，超过上限时返回 ErrHubFull
+func (h *Hub) Register(c *wsConnection) error {
+	h.mu.Lock()
+	if h.MaxConnect > 0 && len(h.conns) >= h.MaxConnect {
+		h.mu.Unlock()
+		return ErrHubFull
+	}
+	h.conns[c.id] = c
+	n := len(h.conns)
+	h.mu.Unlock()
+	metrics.Accepts.WithLabelValues(session.TransportWS).Inc()
+	metrics.Sessions.WithLabelValues(session.TransportWS).Inc()
+	slog.Debug("当前在线人数", "count", n)
+	return nil
+}
+
+// Unregister 移除连接并退出所有分组，然后把断开事件交给游戏逻辑
+func (h *Hub) Unregister(c *wsConnection) {
+	h.mu.Lock()
+	_, ok := h.conns[c.id]
+	if ok {
+		delete(h.conns, c.id)
+		for name, members := range h.groups {
+			delete(members, c.id)
+			if len(members) == 0 {
+				delete(h.groups, name)
+			}
+		}
+	}
+	h.mu.Unlock()
+	if ok {
+		metrics.Sessions.WithLabelValues(session.TransportWS).Dec()
+	}
+	if ok && h.router != nil {
+		h.router.Closed(c)
+	}
+}
+
+// Queued 所有连接写队列里还没发出去的消息数
+func (h *Hub) Queued() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, c := range h.conns {
+		n += len(c.outChan)
+	}
+	return n
+}
+
+// Count 当前连接数
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// Get 按会话ID查找连接
+func (h *Hub) Get(id int64) (session.Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c, ok := h.conns[id]
+	return c, ok
+}
+
+// Sessions 所有连接的快照
+func (h *Hub) Sessions() []session.Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]session.Session, 0, len(h.conns))
+	for _, c := range h.conns {
+		list = append(list, c)
+	}
+	return list
+}
+
+// SendTo 发给指定连接
+func (h *Hub) SendTo(id int64, p *protocol.Packet) error {
+	h.mu.RLock()
+	c, ok := h.conns[id]
+	h.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return c.Send(p)
+}
+
+// Broadcast 发给所有连接，写队列满的连接会跳过，不会阻塞其他连接
+func (h *Hub) Broadcast(p *protocol.Packet) {
+	h.mu.RLock()
+	list := make([]*wsConnection, 0, len(h.conns))
+	for _, c := range h.conns {
+		list = append(list, c)
+	}
+	h.mu.RUnlock()
+	broadcast(list, p)
+}
+
+// Join 把连接加入分组，比如一个频道或者一个房间
+func (h *Hub) Join(group string, id int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.conns[id]
+	if !ok {
+		return ErrNotFound
+	}
+	members := h.groups[group]
+	if members == nil {
+		members = make(map[int64]*wsConnection)
+		h.groups[group] = members
+	}
+	members[id] = c
+	return nil
+}
+
+// Leave 把连接移出分组，分组空了就删除
+func (h *Hub) Leave(group string, id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if members := h.groups[group]; members != nil {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(h.groups, group)
+		}
+	}
+}
+
+// SendGroup 发给分组内的所有连接
+func (h *Hub) SendGroup(group string, p *protocol.Packet) {
+	h.mu.RLock()
+	members := h.groups[group]
+	list := make([]*wsConnection, 0, len(members))
+	for _, c := range members {
+		list = append(list, c)
+	}
+	h.mu.RUnlock()
+	broadcast(list, p)
+}
+
+// Groups 所有分组及人数
+func (h *Hub) Groups() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	groups := make(map[string]int, len(h.groups))
+	for name, members := range h.groups {
+		groups[name] = len(members)
+	}
+	return groups
+}
+
+func broadcast(list []*wsConnection, p *protocol.Packet) {
+	for _, c := range list {
+		cp := *p
+		if err := c.trySend(&cp); err != nil {
+			session.Log(c).Warn("广播跳过连接", "err", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package wsocket
+
+/**
+ * websocket 服务器的启动和优雅关闭
+ * 关闭时先停止监听，再给每个连接发 1001 关闭帧（写队列里的消息先发完），等连接都断开或者超时后强制关闭
+ */
+
+import (
+	"context"
+	"errors"
+	"gameserver/admin"
+	"gameserver/ipfilter"
+	"gameserver/metrics"
+	"gameserver/session"
+	"gameserver/tcp/restart"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 没有配置时的默认关闭超时
+const defaultShutdownTimeout = 10 * time.Second
+
+// 当前运行的 http 服务器，启动和关闭可能在不同的goroutine里
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// StartWebsocket 启动 websocket 服务器，阻塞直到出错或者被 Shutdown 关闭
+// 被 Shutdown 关闭时返回 nil
+func StartWebsocket(cfg *Config, r *session.Router) error {
+	ln, err := Listen(cfg)
+	if err != nil {
+		return err
+	}
+	return Serve(ln, cfg, r)
+}
+
+// Listen 监听配置的地址，平滑重启时使用旧进程交过来的 socket
+func Listen(cfg *Config) (net.Listener, error) {
+	ln, err := restart.Listen("ws", cfg.Address)
+	if err != nil {
+		slog.Error("websocket服务器监听失败", "addr", cfg.Address, "err", err)
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve 在已经监听的 socket 上提供 websocket 服务，阻塞直到出错或者被 Shutdown 关闭
+func Serve(ln net.Listener, cfg *Config, r *session.Router) error {
+	config = cfg
+	if config.AuthTimeout <= 0 {
+		config.AuthTimeout = defaultAuthTimeout
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	upgrader.CheckOrigin = checkOrigin(cfg.AllowOrigins)
+	nets, err := ipfilter.ParseNets(cfg.TrustedProxies)
+	if err != nil {
+		slog.Error("反向代理配置错误", "err", err)
+		return err
+	}
+	trustedProxies = nets
+	router = r
+	serverMu.Lock()
+	hub = NewHub(cfg.MaxConnect, r)
+	serverMu.Unlock()
+	metrics.GaugeFunc("ws_outbound_queue", "websocket 写队列里还没发出去的消息数", func() float64 {
+		return float64(hub.Queued())
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", wsHandler)
+	srv := &http.Server{Addr: cfg.Address, Handler: mux}
+	serverMu.Lock()
+	server = srv
+	serverMu.Unlock()
+	slog.Info("websocket服务器开始监听", "addr", ln.Addr().String())
+	admin.SetListening("ws", true)
+	defer admin.SetListening("ws", false)
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		slog.Error("websocket服务器退出", "err", err)
+		return err
+	}
+	return nil
+}
+
+// Shutdown 停止接受新连接，通知所有连接关闭，在 timeout 内等待它们断开，超时的连接强制关闭
+func Shutdown(timeout time.Duration) error {
+	serverMu.Lock()
+	srv := server
+	serverMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	slog.Info("websocket服务器开始关闭...", "timeout", timeout)
+	admin.SetDraining()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// 升级后的连接已经被 hijack，不在 http.Server 的管理范围内，需要自己关闭
+	err := srv.Shutdown(ctx)
+	for _, s := range hub.Sessions() {
+		s.(*wsConnection).shutdown(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for hub.Count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Warn("等待连接关闭超时，强制关闭剩余连接", "count", hub.Count())
+			for _, s := range hub.Sessions() {
+				s.(*wsConnection).close()
+			}
+			if err == nil {
+				err = ctx.Err()
+			}
+			return err
+		}
+	}
+	slog.Info("websocket服务器已关闭")
+	return err
+}
+
+// Sessions 所有 websocket 连接的快照，服务器还没启动时为空
+func Sessions() []session.Session {
+	serverMu.Lock()
+	h := hub
+	serverMu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h.Sessions()
+}
+
+// ListenAndServeWithSignal 单独运行 websocket 服务器时使用，收到退出信号后优雅关闭
+func ListenAndServeWithSignal(cfg *Config, r *session.Router) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-sigCh
+		slog.Info("收到信号", "signal", sig.String())
+		_ = Shutdown(cfg.ShutdownTimeout)
+	}()
+	if err := StartWebsocket(cfg, r); err != nil {
+		return errors.New("websocket服务器启动失败: " + err.Error())
+	}
+	// Serve 在 Shutdown 一开始就会返回，要等连接都处理完再退出
+	<-done
+	return nil
+}
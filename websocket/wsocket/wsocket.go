@@ -1,12 +1,25 @@
 package wsocket
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"gameserver/ipfilter"
+	"gameserver/metrics"
+	"gameserver/model"
+	"gameserver/protocol"
+	"gameserver/session"
+	"gameserver/tcp/sync/atomic"
+	"gameserver/tracing"
 	"github.com/gorilla/websocket"
-
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"sync"
+	goatomic "sync/atomic"
 	"time"
 )
 
@@ -20,12 +33,27 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// 客户端消息的最大长度，按协议允许的最大消息体算
+	// 二进制消息是一个完整的包；文本消息的消息体是 base64 时会变长 1/3，另外留出信封其他字段的位置
+	maxMessageSize = int64(max(protocol.MaxPacketLen, (protocol.MaxBodyLen+2)/3*4+envelopeOverhead))
+
+	// JSON 信封里除了消息体之外的字段最多占多少字节
+	envelopeOverhead = 512
+
+	// 发出关闭帧之后等待客户端回应关闭帧的时间
+	closeGracePeriod = 3 * time.Second
 )
 
-// 最大的连接ID，每次连接都加1 处理
-var maxConnId int64
+// Config websocket 服务器配置
+type Config struct {
+	Address      string        `yaml:"address"`       // 监听地址，比如 :20002
+	MaxConnect   int           `yaml:"max-connect"`   // 最大连接数，0 表示不限制
+	AllowOrigins []string      `yaml:"allow-origins"` // 允许的来源，为空时只允许同源，"*" 允许所有
+	AuthTimeout  time.Duration `yaml:"auth-timeout"`  // 升级时没有带 token 的连接，必须在这个时间内 LOGIN_AUTH
+
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"` // 关闭服务器时等待连接断开的最长时间
+	TrustedProxies  []string      `yaml:"trusted-proxies"`  // 反向代理的网段，从这些地址来的请求按 X-Forwarded-For/X-Real-IP 取客户端 IP
+}
 
 // 客户端读写消息
 type wsMessage struct {
@@ -34,19 +62,24 @@ type wsMessage struct {
 	data        []byte
 }
 
+// 命令路由，和 tcp 服务器共用同一套游戏逻辑
+var router *session.Router
+
 // ws 的所有连接
 // 用于广播
-var wsConnAll map[int64]*wsConnection
+var hub *Hub
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// 允许所有的CORS 跨域请求，正式环境可以关闭
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
 }
 
+// 启动时的配置
+var config *Config
+
+// 受信任的反向代理
+var trustedProxies ipfilter.Nets
+
 // 客户端连接
 type wsConnection struct {
 	wsSocket *websocket.Conn // 底层websocket
@@ -55,30 +88,91 @@ type wsConnection struct {
 
 	mutex     sync.Mutex // 避免重复关闭管道,加锁处理
 	isClosed  bool
-	closeChan chan byte // 关闭通知
+	closeChan chan byte      // 关闭通知
+	closing   atomic.Boolean // 已经排队了关闭帧，不再接受新的消息
+	release   func()         // 连接关闭后归还 IP 连接数
+	clientIP  string         // 客户端真实 IP
 	id        int64
+
+	rtt        int64              // 最近一次 ping/pong 的往返时间，纳秒
+	accid      int64              // 认证后绑定的账号
+	authed     atomic.Boolean     // 认证状态
+	textMode   atomic.Boolean     // 客户端发的是文本消息时，回复也用 JSON 信封
+	attributes session.Attributes // 会话上挂的自定义数据
+
+	version   int32  // 协议版本，收到第一个二进制包或者 HELLO 之后确定，发二进制包时按它编码
+	codec     string // HELLO 协商的消息体编码，下面三个只在处理协程里读写
+	encrypt   string // HELLO 协商的加密方式
+	helloDone bool   // 是否完成 HELLO 握手
 }
 
 func wsHandler(resp http.ResponseWriter, req *http.Request) {
+	// 黑名单、封禁、连接太频繁或者连接数超限的 IP 不升级
+	ip := ipfilter.ForwardedIP(req, trustedProxies)
+	release, reason := ipfilter.Accept(ip)
+	if release == nil {
+		slog.Info("拒绝websocket连接", "ip", ip, "reason", reason)
+		status := http.StatusTooManyRequests
+		if reason == ipfilter.ReasonDenied || reason == ipfilter.ReasonNotAllowed {
+			status = http.StatusForbidden
+		}
+		http.Error(resp, reason, status)
+		return
+	}
+	// 注册成功之后由连接关闭时归还
+	registered := false
+	defer func() {
+		if !registered {
+			release()
+		}
+	}()
+	// 连接已满时不升级，直接返回 503
+	if hub.Full() {
+		http.Error(resp, ErrHubFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// 带了 token 的在升级前校验，失败直接返回 401
+	accinfo, token, header, ok := authenticate(req)
+	if !ok {
+		http.Error(resp, "token error", http.StatusUnauthorized)
+		return
+	}
 	// 应答客户端告知升级连接为websocket
-	wsSocket, err := upgrader.Upgrade(resp, req, nil)
+	wsSocket, err := upgrader.Upgrade(resp, req, header)
 	if err != nil {
-		log.Println("升级为websocket失败", err.Error())
+		slog.Info("升级为websocket失败", "ip", ip, "err", err)
 		return
 	}
-	maxConnId++
-	// TODO 如果要控制连接数可以计算，wsConnAll长度
-	// 连接数保持一定数量，超过的部分不提供服务
 	wsConn := &wsConnection{
 		wsSocket:  wsSocket,
 		inChan:    make(chan *wsMessage, 1000),
 		outChan:   make(chan *wsMessage, 1000),
 		closeChan: make(chan byte),
 		isClosed:  false,
-		id:        maxConnId,
+		release:   release,
+		clientIP:  ip,
+		id:        session.NextID(),
+	}
+	// 连接数保持一定数量，超过的部分不提供服务
+	if err := hub.Register(wsConn); err != nil {
+		session.Log(wsConn).Warn("拒绝websocket连接", "err", err)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+		_ = wsSocket.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		_ = wsSocket.Close()
+		return
+	}
+	registered = true
+	if accinfo.Accid != 0 {
+		// 升级时已经校验过 token，这里只过登录检查，被拒绝时发完通知再断开
+		session.SetToken(wsConn, token)
+		ctx := model.WithAccount(tracing.ExtractHTTP(req), accinfo)
+		if e := router.Login(ctx, wsConn, int64(accinfo.Accid)); e != nil {
+			_ = wsConn.Send(e)
+			wsConn.shutdown(websocket.ClosePolicyViolation, "login refused")
+		}
+	} else {
+		go wsConn.checkAuth(config.AuthTimeout)
 	}
-	wsConnAll[maxConnId] = wsConn
-	log.Println("当前在线人数", len(wsConnAll))
 
 	// 处理器,发送定时信息，避免意外关闭
 	go wsConn.processLoop()
@@ -91,21 +185,109 @@ func wsHandler(resp http.ResponseWriter, req *http.Request) {
 // 处理队列中的消息
 func (wsConn *wsConnection) processLoop() {
 	// 处理消息队列中的消息
-	// 获取到消息队列中的消息，处理完成后，发送消息给客户端
+	// 二进制消息按 tcp 同样的包格式解码，文本消息是 JSON 信封，解码后都交给命令路由
 	for {
 		msg, err := wsConn.wsRead()
 		if err != nil {
-			log.Println("获取消息出现错误", err.Error())
+			session.Log(wsConn).Debug("处理协程退出", "err", err)
 			break
 		}
-		log.Println("接收到消息", string(msg.data))
-		// 修改以下内容把客户端传递的消息传递给处理程序
-		err = wsConn.wsWrite(msg.messageType, msg.data)
+		var packet *protocol.Packet
+		switch msg.messageType {
+		case websocket.BinaryMessage:
+			wsConn.textMode.Set(false)
+			packet, err = protocol.ReadPacket(bufio.NewReader(bytes.NewReader(msg.data)))
+		case websocket.TextMessage:
+			// 客户端用什么格式发，就用什么格式回
+			wsConn.textMode.Set(true)
+			packet, err = protocol.DecodeEnvelope(msg.data)
+		default:
+			continue
+		}
 		if err != nil {
-			log.Println("发送消息给客户端出现错误", err.Error())
-			break
+			// websocket 自己分帧，一条消息错了不影响后面的消息，只回复错误
+			session.Log(wsConn).Warn("消息解析失败", "err", err)
+			metrics.DecodeErrors.WithLabelValues(session.TransportWS).Inc()
+			var verr *protocol.VersionError
+			if errors.As(err, &verr) {
+				_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_UPGRADE, verr.Error()))
+			} else {
+				_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_PROTOCOL, err.Error()))
+			}
+			continue
+		}
+		if msg.messageType == websocket.BinaryMessage {
+			if err := wsConn.checkPacket(packet); err != nil {
+				session.LogPacket(wsConn, packet).Warn("消息和协商的不一致", "err", err)
+				metrics.DecodeErrors.WithLabelValues(session.TransportWS).Inc()
+				_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_PROTOCOL, err.Error()))
+				continue
+			}
+		}
+		if packet.Cmd == protocol.HELLO {
+			wsConn.hello(packet)
+			continue
 		}
+		router.Dispatch(wsConn, packet)
+	}
+}
+
+// checkPacket 二进制包的版本要和第一个包或者 HELLO 协商的一样
+// websocket 只协商不压缩，压缩过的消息体也不接受
+func (wsConn *wsConnection) checkPacket(p *protocol.Packet) error {
+	if p.Flags&protocol.FlagCompressed != 0 {
+		return errors.New("compression not negotiated")
 	}
+	v := wsConn.Version()
+	if v == 0 {
+		goatomic.StoreInt32(&wsConn.version, int32(p.Version))
+		return nil
+	}
+	// HELLO 可以带着别的版本来协商
+	if p.Version != v && p.Cmd != protocol.HELLO {
+		return fmt.Errorf("version %d does not match negotiated version %d", p.Version, v)
+	}
+	return nil
+}
+
+// Version 当前使用的协议版本，还没收到二进制包时为 0
+func (wsConn *wsConnection) Version() uint8 {
+	return uint8(goatomic.LoadInt32(&wsConn.version))
+}
+
+// hello websocket 的 HELLO 是可选的，压缩交给 websocket 自己的扩展，这里只协商版本和编码
+// 协商结果保存在连接上，之后的二进制包按它检查和编码
+func (wsConn *wsConnection) hello(p *protocol.Packet) {
+	if wsConn.helloDone {
+		_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_PROTOCOL, "hello already done"))
+		return
+	}
+	var hello protocol.Hello
+	if err := json.Unmarshal(p.Body, &hello); err != nil {
+		_ = wsConn.Send(protocol.NewErrorPacket(protocol.ERR_PROTOCOL, "bad hello"))
+		return
+	}
+	if hello.Version == 0 {
+		hello.Version = p.Version
+	}
+	hello.Compress = []string{protocol.CompressNone}
+	ack, code := protocol.Negotiate(&hello)
+	if code != 0 {
+		_ = wsConn.Send(protocol.NewErrorPacket(code, "hello failed"))
+		wsConn.shutdown(websocket.ClosePolicyViolation, "hello failed")
+		return
+	}
+	body, _ := json.Marshal(ack)
+	if err := wsConn.Send(&protocol.Packet{Cmd: protocol.HELLO, Seq: p.Seq, Body: body}); err != nil {
+		session.Log(wsConn).Warn("HELLO 回复失败", "err", err)
+		return
+	}
+	// 回复之后再切换，和 tcp 一样
+	goatomic.StoreInt32(&wsConn.version, int32(ack.Version))
+	wsConn.codec = ack.Codec
+	wsConn.encrypt = ack.Encrypt
+	wsConn.helloDone = true
+	session.Log(wsConn).Debug("HELLO 协商完成", "version", ack.Version, "codec", ack.Codec, "encrypt", ack.Encrypt)
 }
 
 // 处理消息队列中的消息
@@ -113,12 +295,20 @@ func (wsConn *wsConnection) wsReadLoop() {
 	// 设置消息的最大长度
 	wsConn.wsSocket.SetReadLimit(maxMessageSize)
 	wsConn.wsSocket.SetReadDeadline(time.Now().Add(pongWait))
+	wsConn.wsSocket.SetPongHandler(func(data string) error {
+		// ping 里带着发送时间，收到 pong 时算出往返时间
+		if len(data) == 8 {
+			sent := int64(binary.BigEndian.Uint64([]byte(data)))
+			goatomic.StoreInt64(&wsConn.rtt, time.Now().UnixNano()-sent)
+		}
+		return wsConn.wsSocket.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
 		// 读一个message
 		msgType, data, err := wsConn.wsSocket.ReadMessage()
 		if err != nil {
 			websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure)
-			log.Println("消息读取出现错误", err.Error())
+			session.Log(wsConn).Info("连接断开", "err", err)
 			wsConn.close()
 			return
 		}
@@ -147,7 +337,7 @@ func (wsConn *wsConnection) wsWriteLoop() {
 		case msg := <-wsConn.outChan:
 			// 写给websocket
 			if err := wsConn.wsSocket.WriteMessage(msg.messageType, msg.data); err != nil {
-				log.Println("发送消息给客户端发生错误", err.Error())
+				session.Log(wsConn).Info("发送消息失败", "err", err)
 				// 切断服务
 				wsConn.close()
 				return
@@ -158,7 +348,9 @@ func (wsConn *wsConnection) wsWriteLoop() {
 		case <-ticker.C:
 			// 出现超时情况
 			wsConn.wsSocket.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := wsConn.wsSocket.WriteMessage(websocket.PingMessage, nil); err != nil {
+			ping := make([]byte, 8)
+			binary.BigEndian.PutUint64(ping, uint64(time.Now().UnixNano()))
+			if err := wsConn.wsSocket.WriteMessage(websocket.PingMessage, ping); err != nil {
 				return
 			}
 		}
@@ -167,6 +359,9 @@ func (wsConn *wsConnection) wsWriteLoop() {
 
 // 写入消息到队列中
 func (wsConn *wsConnection) wsWrite(messageType int, data []byte) error {
+	if wsConn.closing.Get() {
+		return errors.New("连接正在关闭")
+	}
 	select {
 	case wsConn.outChan <- &wsMessage{messageType, data}:
 	case <-wsConn.closeChan:
@@ -189,21 +384,158 @@ func (wsConn *wsConnection) wsRead() (*wsMessage, error) {
 
 // 关闭连接
 func (wsConn *wsConnection) close() {
-	log.Println("关闭连接被调用了")
+	session.Log(wsConn).Debug("关闭连接")
 	wsConn.wsSocket.Close()
 	wsConn.mutex.Lock()
-	defer wsConn.mutex.Unlock()
+	closed := false
 	if wsConn.isClosed == false {
 		wsConn.isClosed = true
-		// 删除这个连接的变量
-		delete(wsConnAll, wsConn.id)
 		close(wsConn.closeChan)
+		closed = true
+	}
+	wsConn.mutex.Unlock()
+	// 删除这个连接，并通知游戏逻辑，比如离开房间
+	if closed {
+		hub.Unregister(wsConn)
+		wsConn.release()
+	}
+}
+
+// shutdown 优雅关闭：关闭帧排到写队列最后，已经排队的消息先发完，再等客户端回应关闭帧
+// 只有第一次调用有效，写队列满或者连接已经断开时直接关闭
+func (wsConn *wsConnection) shutdown(code int, reason string) {
+	wsConn.mutex.Lock()
+	if wsConn.isClosed || wsConn.closing.Get() {
+		wsConn.mutex.Unlock()
+		return
+	}
+	wsConn.closing.Set(true)
+	wsConn.mutex.Unlock()
+
+	msg := &wsMessage{websocket.CloseMessage, websocket.FormatCloseMessage(code, reason)}
+	select {
+	case wsConn.outChan <- msg:
+	case <-wsConn.closeChan:
+	case <-time.After(writeWait):
+		session.Log(wsConn).Warn("写队列一直是满的，直接关闭连接")
+		wsConn.close()
+	}
+}
+
+// writeClose 发送关闭帧，客户端回应后读协程会收到关闭错误并断开，不回应的话读超时后断开
+func (wsConn *wsConnection) writeClose(data []byte) {
+	if err := wsConn.wsSocket.WriteControl(websocket.CloseMessage, data, time.Now().Add(writeWait)); err != nil {
+		session.Log(wsConn).Info("发送关闭帧失败", "err", err)
+		wsConn.close()
+		return
+	}
+	wsConn.wsSocket.SetReadDeadline(time.Now().Add(closeGracePeriod))
+}
+
+// ID 会话ID，和 tcp 连接共用一个计数器
+func (wsConn *wsConnection) ID() int64 {
+	return wsConn.id
+}
+
+// Accid 认证后绑定的账号
+func (wsConn *wsConnection) Accid() int64 {
+	return goatomic.LoadInt64(&wsConn.accid)
+}
+
+// Authed 是否已经认证
+func (wsConn *wsConnection) Authed() bool {
+	return wsConn.authed.Get()
+}
+
+// Authenticate 认证通过，绑定账号
+func (wsConn *wsConnection) Authenticate(accid int64) {
+	goatomic.StoreInt64(&wsConn.accid, accid)
+	wsConn.authed.Set(true)
+}
+
+// Send 按客户端使用的格式发送，文本客户端发 JSON 信封，否则发二进制包
+func (wsConn *wsConnection) Send(p *protocol.Packet) error {
+	msg, err := wsConn.encode(p)
+	if err != nil {
+		return err
+	}
+	if err := wsConn.wsWrite(msg.messageType, msg.data); err != nil {
+		return err
 	}
+	metrics.PacketsOut.WithLabelValues(session.TransportWS, metrics.Cmd(p.Cmd)).Inc()
+	return nil
+}
+
+// trySend 和 Send 一样，但写队列满时直接返回错误，广播时使用
+func (wsConn *wsConnection) trySend(p *protocol.Packet) error {
+	msg, err := wsConn.encode(p)
+	if err != nil {
+		return err
+	}
+	select {
+	case wsConn.outChan <- msg:
+		metrics.PacketsOut.WithLabelValues(session.TransportWS, metrics.Cmd(p.Cmd)).Inc()
+		return nil
+	case <-wsConn.closeChan:
+		return errors.New("连接已经关闭")
+	default:
+		return errors.New("写队列已满")
+	}
+}
+
+func (wsConn *wsConnection) encode(p *protocol.Packet) (*wsMessage, error) {
+	if wsConn.textMode.Get() {
+		bs, err := protocol.EncodeEnvelope(p)
+		if err != nil {
+			return nil, err
+		}
+		return &wsMessage{websocket.TextMessage, bs}, nil
+	}
+	// 按客户端的协议版本编码，广播的包是共用的，不能直接改
+	if p.Version == 0 {
+		cp := *p
+		cp.Version = wsConn.Version()
+		p = &cp
+	}
+	bs, err := protocol.EncodePacket(p)
+	if err != nil {
+		return nil, err
+	}
+	return &wsMessage{websocket.BinaryMessage, bs}, nil
+}
+
+// Close 实现 session.Session，之前发的消息（比如错误包）会先发出去再断开
+func (wsConn *wsConnection) Close() error {
+	wsConn.shutdown(websocket.CloseNormalClosure, "")
+	return nil
+}
+
+// RemoteAddr 对端地址
+func (wsConn *wsConnection) RemoteAddr() net.Addr {
+	return wsConn.wsSocket.RemoteAddr()
+}
+
+// ClientIP 客户端真实 IP，经过受信任的反向代理时从 X-Forwarded-For 取得
+func (wsConn *wsConnection) ClientIP() string {
+	return wsConn.clientIP
+}
+
+// RTT 最近一次 ping/pong 的往返时间，第一次 ping 之前为 0
+func (wsConn *wsConnection) RTT() time.Duration {
+	return time.Duration(goatomic.LoadInt64(&wsConn.rtt))
+}
+
+// Transport 传输方式
+func (wsConn *wsConnection) Transport() string {
+	return session.TransportWS
+}
+
+// Attributes 会话上挂的自定义数据
+func (wsConn *wsConnection) Attributes() *session.Attributes {
+	return &wsConn.attributes
 }
 
-// 启动程序
-func StartWebsocket(addrPort string) {
-	wsConnAll = make(map[int64]*wsConnection)
-	http.HandleFunc("/ws", wsHandler)
-	http.ListenAndServe(addrPort, nil)
+// Connections 所有 websocket 连接，用于广播和查询在线
+func Connections() *Hub {
+	return hub
 }